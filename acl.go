@@ -0,0 +1,150 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// POSIX ACL entry tags, as used in the system.posix_acl_access and system.posix_acl_default
+// xattrs.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclXattrVersion = 2
+	aclUndefinedID  = 0xFFFFFFFF
+)
+
+// aclEntry is an entry of a POSIX ACL.
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// encodeACL converts an ACL in the text form recorded by tar's SCHILY.acl.access and
+// SCHILY.acl.default records (e.g., "user::rw-,user:alice:r--,group::r--,mask::r--,other::---")
+// to the binary form of the system.posix_acl_* xattrs. Entries may be separated by commas or
+// newlines, and may have a fourth field with the numeric id of a named user or group, as star
+// writes, which is used if the name doesn't exist on this system.
+func encodeACL(text string) (string, error) {
+	var entries []aclEntry
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if i := strings.IndexByte(field, '#'); i > -1 {
+			field = field[:i]
+		}
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		e, err := parseACLEntry(field)
+		if err != nil {
+			return "", fmt.Errorf("invalid ACL entry %q: %v", field, err)
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	b := make([]byte, 4, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint16(b, e.tag)
+		b = binary.LittleEndian.AppendUint16(b, e.perm)
+		b = binary.LittleEndian.AppendUint32(b, e.id)
+	}
+	return string(b), nil
+}
+
+// parseACLEntry parses a single entry of the text form of an ACL.
+func parseACLEntry(field string) (aclEntry, error) {
+	parts := strings.Split(field, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return aclEntry{}, fmt.Errorf("expected TAG:QUALIFIER:PERMS")
+	}
+	tag, qualifier, perms := parts[0], parts[1], parts[2]
+
+	e := aclEntry{id: aclUndefinedID}
+	for _, c := range perms {
+		switch c {
+		case 'r':
+			e.perm |= 4
+		case 'w':
+			e.perm |= 2
+		case 'x':
+			e.perm |= 1
+		case '-':
+		default:
+			return e, fmt.Errorf("invalid permissions %q", perms)
+		}
+	}
+
+	var lookup func(string) (string, error)
+	switch tag {
+	case "user", "u":
+		e.tag, lookup = aclUserObj, lookupUID
+	case "group", "g":
+		e.tag, lookup = aclGroupObj, lookupGID
+	case "mask", "m":
+		e.tag = aclMask
+	case "other", "o":
+		e.tag = aclOther
+	default:
+		return e, fmt.Errorf("unrecognized tag %q", tag)
+	}
+	if qualifier == "" {
+		return e, nil
+	} else if lookup == nil {
+		return e, fmt.Errorf("%s entries have no qualifier", tag)
+	}
+
+	// Named users and groups.
+	e.tag <<= 1
+	id, err := numericID(qualifier)
+	if err != nil {
+		var s string
+		if s, err = lookup(qualifier); err == nil {
+			id, err = numericID(s)
+		} else if len(parts) == 4 {
+			id, err = numericID(parts[3])
+		}
+	}
+	if err != nil {
+		return e, err
+	}
+	e.id = uint32(id)
+	return e, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// arMagic begins every ar archive.
+const arMagic = "!<arch>\n"
+
+func init() {
+	registerFormat("ar", newArWriter)
+}
+
+// arWriter writes a common ar archive. Regular files become members; other entries have no
+// equivalent in ar and are skipped with a warning.
+type arWriter struct {
+	w       io.Writer
+	started bool  // Whether the magic has been written
+	left    int64 // Bytes of content left in the current member
+	pad     bool  // Whether the current member needs a padding byte
+}
+
+func newArWriter(w io.Writer) ArchiveWriter {
+	return &arWriter{w: w}
+}
+
+// WriteHeader writes a member header. Names over 16 bytes or containing spaces are written with
+// the BSD #1/LEN extension, which stores the name before the content so that members can be
+// streamed.
+func (a *arWriter) WriteHeader(hdr *tar.Header) error {
+	if err := a.Flush(); err != nil {
+		return err
+	}
+	if !a.started {
+		if _, err := io.WriteString(a.w, arMagic); err != nil {
+			return err
+		}
+		a.started = true
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		if hdr.Typeflag != tar.TypeDir {
+			warnf("skipping file: %s: cannot add to ar archive", hdr.Name)
+			recordSkip(hdr.Name, skipUnsupported, "cannot add to ar archive", nil)
+		}
+		return nil
+	}
+
+	name, size := hdr.Name, hdr.Size
+	var long string
+	if len(name) > 16 || strings.ContainsAny(name, " ") || strings.HasPrefix(name, "#1/") {
+		long = name
+		name = fmt.Sprintf("#1/%d", len(long))
+		size += int64(len(long))
+	}
+	if hdr.Uid > 999999 || hdr.Gid > 999999 {
+		return fmt.Errorf("uid or gid too large for ar (%d:%d)", hdr.Uid, hdr.Gid)
+	} else if size > 9999999999 {
+		return fmt.Errorf("file too large for ar (%d bytes)", size)
+	}
+
+	const regular = 0100000
+	header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n",
+		name, hdr.ModTime.Unix(), hdr.Uid, hdr.Gid, regular|hdr.Mode&07777, size)
+	if _, err := io.WriteString(a.w, header+long); err != nil {
+		return err
+	}
+	a.left, a.pad = hdr.Size, size%2 == 1
+	return nil
+}
+
+func (a *arWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > a.left {
+		return 0, tar.ErrWriteTooLong
+	}
+	n, err := a.w.Write(p)
+	a.left -= int64(n)
+	return n, err
+}
+
+// Flush pads the current member once its content is written.
+func (a *arWriter) Flush() error {
+	if a.left > 0 {
+		return fmt.Errorf("ar: missed writing %d bytes", a.left)
+	}
+	if a.pad {
+		a.pad = false
+		_, err := io.WriteString(a.w, "\n")
+		return err
+	}
+	return nil
+}
+
+func (a *arWriter) Close() error {
+	if err := a.Flush(); err != nil {
+		return err
+	}
+	if !a.started {
+		a.started = true
+		_, err := io.WriteString(a.w, arMagic)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"io"
+)
+
+// ArchiveWriter writes an archive as a sequence of entries, each a header followed by its
+// content. The add and concatenate logic only writes through this interface, so output formats
+// other than tar only need to implement it and register themselves with registerFormat.
+//
+// If an ArchiveWriter buffers or pads entries, it should also implement Flush to write out the
+// end of the current entry, as *tar.Writer does. Flush is called after each entry's content is
+// written and before the state of a run is saved.
+type ArchiveWriter interface {
+	WriteHeader(hdr *tar.Header) error
+	Write(p []byte) (int, error)
+	Close() error
+}
+
+// outputFormat is the name of the archive format written, as registered in archiveFormats.
+var outputFormat = "tar"
+
+// archiveFormats maps the names of output formats, as given to -F, to functions that create
+// their writers.
+var archiveFormats = map[string]func(w io.Writer) ArchiveWriter{
+	"tar": func(w io.Writer) ArchiveWriter { return tar.NewWriter(w) },
+}
+
+// registerFormat registers an output format by name. It's meant to be called from init.
+func registerFormat(name string, newWriter func(w io.Writer) ArchiveWriter) {
+	if _, ok := archiveFormats[name]; ok {
+		panic("archive format already registered: " + name)
+	}
+	archiveFormats[name] = newWriter
+}
+
+// isArchiveFormat returns whether name is a registered output format other than tar, whose
+// header formats are set separately.
+func isArchiveFormat(name string) bool {
+	_, ok := archiveFormats[name]
+	return ok && name != "tar"
+}
+
+func newArchiveWriter(w io.Writer) ArchiveWriter {
+	return archiveFormats[outputFormat](w)
+}
+
+// flushArchive flushes the end of the current entry to w's output, if w supports it.
+func flushArchive(w ArchiveWriter) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
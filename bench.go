@@ -0,0 +1,198 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+type benchResult struct {
+	bufSize int
+	files   int64
+	bytes   int64
+	elapsed time.Duration
+}
+
+func (r benchResult) filesPerSec() float64 {
+	return float64(r.files) / r.elapsed.Seconds()
+}
+
+func (r benchResult) mbPerSec() float64 {
+	return float64(r.bytes) / (1 << 20) / r.elapsed.Seconds()
+}
+
+func benchUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar bench [-o FILE] [-b SIZES] [-n RUNS] DIR
+
+Adds DIR to a tar archive the same way 'mtar DIR' does, once for each copy
+buffer size (see --copy-buffer), then reports files/sec and MB/sec for each
+run. The archive is discarded unless -o is given.
+
+  -o FILE
+    Write the archive to FILE instead of discarding it. FILE is truncated
+    before each run. As when writing an archive, file content may be copied
+    to FILE directly, bypassing the copy buffer.
+  -b SIZES
+    Comma-separated list of copy buffer sizes to try. Sizes may have a K, M,
+    or G suffix. (default: 32K,256K,1M)
+  -n RUNS
+    Number of times to repeat each size. (default: 1)
+`)
+}
+
+func bench(argv Args) {
+	var (
+		outPath  string
+		bufSizes = []int{32 << 10, 256 << 10, 1 << 20}
+		runs     = 1
+		dir      string
+	)
+
+	for s, ok := argv.Shift(); ok; s, ok = argv.Shift() {
+		switch s {
+		case "-h", "--help":
+			benchUsage()
+			exit(exitUsage)
+		case "-o", "-b", "-n":
+			arg, ok := argv.Shift()
+			if !ok {
+				usageErrorf("bench: %s: missing argument", s)
+			}
+			var err error
+			switch s {
+			case "-o":
+				outPath = arg
+			case "-b":
+				bufSizes, err = parseIntList(arg, func(s string) (int, error) {
+					n, err := parseSize(s)
+					return int(n), err
+				})
+			case "-n":
+				runs, err = strconv.Atoi(arg)
+				if err == nil && runs < 1 {
+					err = fmt.Errorf("must be at least 1")
+				}
+			}
+			failOnUsageError("bench: "+s, err)
+		default:
+			if dir != "" {
+				usageErrorf("bench: unexpected argument %q", s)
+			}
+			dir = s
+		}
+	}
+
+	if dir == "" {
+		benchUsage()
+		exit(exitUsage)
+	}
+
+	bufSizes = dedupInts(bufSizes)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "buffer\tfiles\tMiB\tseconds\tfiles/s\tMiB/s\t")
+	for _, bs := range bufSizes {
+		for i := 0; i < runs; i++ {
+			r := benchRun(dir, outPath, bs)
+			fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.3f\t%.1f\t%.1f\t\n",
+				formatSize(int64(r.bufSize)), r.files,
+				float64(r.bytes)/(1<<20), r.elapsed.Seconds(),
+				r.filesPerSec(), r.mbPerSec(),
+			)
+		}
+	}
+	failOnError("bench: error writing results", tw.Flush())
+}
+
+// benchRun adds dir to an archive written to outPath, or discarded, through the same writer and
+// addArgs path as when writing an archive, copying content through a buffer of bufSize bytes.
+func benchRun(dir, outPath string, bufSize int) benchResult {
+	var out io.Writer = ioutil.Discard
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		failOnError("bench: cannot create output", err)
+		defer func() { failOnError("bench: cannot close output", f.Close()) }()
+		out = f
+	}
+
+	// Each run starts from the same state, so that no entry is skipped as already written.
+	resetArgState()
+	directOutput = nil
+	copyBufferSize = bufSize
+	atomic.StoreInt64(&stats.entries, 0)
+	atomic.StoreInt64(&stats.bytes, 0)
+
+	start := time.Now()
+	w := newArchiveWriter(&countingWriter{w: newOutputSink(out), n: &stats.outBytes})
+	addArgs(w, Args{args: []string{dir}})
+	failOnError("bench: error writing output", w.Close())
+
+	return benchResult{
+		bufSize: bufSize,
+		files:   atomic.LoadInt64(&stats.entries),
+		bytes:   atomic.LoadInt64(&stats.bytes),
+		elapsed: time.Since(start),
+	}
+}
+
+func parseIntList(s string, parse func(string) (int, error)) ([]int, error) {
+	var ints []int
+	for _, f := range strings.FieldsFunc(s, isComma) {
+		n, err := parse(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("value must be at least 1: %q", f)
+		}
+		ints = append(ints, n)
+	}
+	if len(ints) == 0 {
+		return nil, fmt.Errorf("empty list: %q", s)
+	}
+	return ints, nil
+}
+
+func dedupInts(ints []int) []int {
+	seen := map[int]struct{}{}
+	out := ints[:0]
+	for _, n := range ints {
+		if _, ok := seen[n]; ok {
+			continue
+		}
+		seen[n] = struct{}{}
+		out = append(out, n)
+	}
+	return out
+}
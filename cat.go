@@ -0,0 +1,126 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func catUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar cat [-h|--help] ARCHIVE MEMBER
+
+Writes the contents of the entry named MEMBER in ARCHIVE to standard output,
+stopping once it's been written. ARCHIVE may be '-' to read standard input, and
+may be compressed with gzip, zstd, xz, bzip2, or lz4. If the archive has more
+than one entry named MEMBER, only the first is written.
+
+MEMBER must be a regular file or a hard link. Hard links can only be followed
+if ARCHIVE is a file, since the archive is read again to find the link target.
+If MEMBER isn't found, or is another type of entry, mtar exits with status 2.
+`)
+}
+
+// catMember writes the contents of an archive member to standard output, as selected by cat.
+func catMember(argv Args) {
+	if len(argv.args) > 0 && (argv.args[0] == "-h" || argv.args[0] == "--help") || len(argv.args) != 2 {
+		catUsage()
+		exit(exitUsage)
+	}
+	archive, member := argv.args[0], argv.args[1]
+
+	// Follow hard links, as long as they don't lead back to a name already seen.
+	seen := map[string]bool{}
+	for {
+		name := strings.Join(nameElems(member), "/")
+		if seen[name] {
+			fatalf("cat: %s: hard link loop", member)
+		}
+		seen[name] = true
+
+		link, err := catEntry(archive, name)
+		failOnError("cat", err)
+		if link == "" {
+			return
+		} else if archive == "-" {
+			fatalf("cat: %s: cannot follow hard link to %s when reading standard input", member, link)
+		}
+		member = link
+	}
+}
+
+// catEntry writes the contents of the first regular file named name in archive to standard
+// output. If the entry is a hard link, its target is returned instead.
+func catEntry(archive, name string) (link string, err error) {
+	in := os.Stdin
+	if archive != "-" {
+		f, err := os.Open(archive)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		in = f
+	}
+	r, err := decompressedReader(bufio.NewReader(in))
+	if err != nil {
+		return "", err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("%s: not found in archive", name)
+		} else if err != nil {
+			return "", fmt.Errorf("error reading tar header: %w", err)
+		}
+		if strings.Join(nameElems(hdr.Name), "/") != name {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			w := bufio.NewWriter(os.Stdout)
+			if _, err := io.Copy(w, tr); err != nil {
+				return "", err
+			}
+			return "", w.Flush()
+		case tar.TypeLink:
+			return hdr.Linkname, nil
+		case tar.TypeSymlink:
+			return "", fmt.Errorf("%s: is a symlink to %s", name, hdr.Linkname)
+		case tar.TypeDir:
+			return "", fmt.Errorf("%s: is a directory", name)
+		default:
+			return "", fmt.Errorf("%s: is not a regular file", name)
+		}
+	}
+}
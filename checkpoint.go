@@ -0,0 +1,112 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkpointRecordSize is the size of a record for the purpose of counting checkpoints. This is
+// GNU tar's default record size (a blocking factor of 20).
+const (
+	checkpointBlockingFactor = 20
+	checkpointRecordSize     = checkpointBlockingFactor * 512
+)
+
+var (
+	checkpointEvery   int64 // Number of records between checkpoints (0 to disable)
+	checkpointActions []checkpointAction
+)
+
+type checkpointAction func(n int64) error
+
+func parseCheckpointAction(s string) (checkpointAction, error) {
+	switch {
+	case s == "echo":
+		return func(n int64) error {
+			log.Printf("write checkpoint %d", n)
+			return nil
+		}, nil
+	case s == "dot":
+		return func(int64) error {
+			_, err := io.WriteString(os.Stderr, ".")
+			return err
+		}, nil
+	case strings.HasPrefix(s, "exec="):
+		command := strings.TrimPrefix(s, "exec=")
+		if command == "" {
+			return nil, fmt.Errorf("exec: missing command")
+		}
+		return func(n int64) error {
+			cmd := shellCommand(command)
+			cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+			cmd.Env = append(os.Environ(),
+				"TAR_CHECKPOINT="+strconv.FormatInt(n, 10),
+				"TAR_BLOCKING_FACTOR="+strconv.Itoa(checkpointBlockingFactor),
+				"TAR_FORMAT="+strings.ToLower(hdrFormat.String()),
+			)
+			return cmd.Run()
+		}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized action %q", s)
+	}
+}
+
+// checkpointWriter fires checkpoint actions every checkpointEvery records written through it.
+type checkpointWriter struct {
+	w    io.Writer
+	n    int64 // Bytes written
+	next int64 // Record count of the next checkpoint
+}
+
+func newCheckpointWriter(w io.Writer) io.Writer {
+	if checkpointEvery <= 0 {
+		return w
+	}
+	if len(checkpointActions) == 0 {
+		action, _ := parseCheckpointAction("echo")
+		checkpointActions = []checkpointAction{action}
+	}
+	return &checkpointWriter{w: w, next: checkpointEvery}
+}
+
+func (c *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	for c.n/checkpointRecordSize >= c.next {
+		for _, action := range checkpointActions {
+			if aerr := action(c.next); aerr != nil {
+				warnf("checkpoint %d: action failed: %v", c.next, aerr)
+			}
+		}
+		c.next += checkpointEvery
+	}
+	return n, err
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// compression is the name of the compression applied to the output, as registered in
+// compressors, or empty for none.
+var compression string
+
+// compressionLevel is the level set by --compress-level. If it's unset (-1), each compressor's
+// default level is used.
+var compressionLevel = -1
+
+// compressionThreads is the number of goroutines to compress with, as set by --threads. If it's 0,
+// one is used per CPU.
+var compressionThreads = 1
+
+// zstdWindowLog is the log2 of the zstd window size set by --zstd-long, or 0 to use the
+// default for the level. A larger window lets zstd match content further back in the archive.
+var zstdWindowLog int
+
+// defaultZstdWindowLog is the window log that --zstd-long uses if one isn't given, which is
+// the same as zstd --long.
+const defaultZstdWindowLog = 27
+
+// zstdDictPath is the path of the dictionary set by --zstd-dict. It's loaded into zstdDict by
+// checkCompression.
+var zstdDictPath string
+
+// zstdDict is the zstd dictionary to compress with, and zstdDictID is its ID, which zstd records
+// in each frame so that the dictionary can be found to decompress it.
+var (
+	zstdDict   []byte
+	zstdDictID uint32
+)
+
+// compressionBlockSize is the size of the blocks that parallel gzip compresses on separate
+// goroutines. zstd picks its own block sizes.
+const compressionBlockSize = 1 << 20
+
+// threads returns the number of goroutines to compress with.
+func threads() int {
+	if compressionThreads == 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return compressionThreads
+}
+
+// compressor describes a compression format: the range of levels it accepts, the level it uses by
+// default, and how to create its writer at a given level.
+type compressor struct {
+	minLevel, maxLevel, defaultLevel int
+
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+// compressors maps the names of compression formats to their compressors.
+var compressors = map[string]compressor{
+	"gzip":   {1, 9, 6, newGzipWriter},
+	"zstd":   {1, 22, 3, newZstdWriter},
+	"xz":     {0, 9, 6, newXzWriter},
+	"bzip2":  {1, 9, 6, newBzip2Writer},
+	"lz4":    {0, 9, 0, newLz4Writer},
+	"brotli": {0, 11, 6, newBrotliWriter},
+}
+
+// newGzipWriter returns a gzip writer for level. If more than one thread is used, the output is
+// compressed in blocks in parallel, pgzip-style, which is still a single standard gzip stream.
+func newGzipWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if rsyncable {
+		return newRsyncableGzipWriter(w, level)
+	}
+	n := threads()
+	if n == 1 {
+		return gzip.NewWriterLevel(w, level)
+	}
+	gw, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if err := gw.SetConcurrency(compressionBlockSize, n); err != nil {
+		return nil, err
+	}
+	return gw, nil
+}
+
+func newZstdWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(threads()),
+	}
+	if zstdWindowLog != 0 {
+		opts = append(opts, zstd.WithWindowSize(1<<zstdWindowLog))
+	}
+	if zstdDict != nil {
+		opts = append(opts, zstd.WithEncoderDict(zstdDict))
+	}
+	if seekable {
+		return newSeekableZstdWriter(w, opts...)
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+// xzDictCaps are the dictionary sizes of the xz presets, which ulikunitz/xz doesn't have levels
+// for.
+var xzDictCaps = [...]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+func newXzWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+}
+
+func newBzip2Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+}
+
+// newLz4Writer returns an lz4 writer for level, where 0 is lz4's fast mode and 1 through 9 are
+// its high compression levels.
+func newLz4Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	lw := lz4.NewWriter(w)
+	cl := lz4.Fast
+	if level > 0 {
+		cl = lz4.Level1 << (level - 1)
+	}
+	if err := lw.Apply(lz4.CompressionLevelOption(cl)); err != nil {
+		return nil, err
+	}
+	return lw, nil
+}
+
+func newBrotliWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return brotli.NewWriterLevel(w, level), nil
+}
+
+// compressionExtensions maps the extensions of output files to the compression they imply.
+var compressionExtensions = map[string]string{
+	".tar.gz":  "gzip",
+	".tgz":     "gzip",
+	".tar.zst": "zstd",
+	".tzst":    "zstd",
+	".tar.xz":  "xz",
+	".txz":     "xz",
+	".tar.bz2": "bzip2",
+	".tbz2":    "bzip2",
+	".tbz":     "bzip2",
+	".tar.lz4": "lz4",
+	".tar.br":  "brotli",
+}
+
+// detectCompression sets the compression from the extension of the output file, if it isn't set
+// explicitly.
+func detectCompression() {
+	if compression != "" || !isFileOutput() || outputFormat != "tar" || imageMode {
+		return
+	}
+	p := strings.ToLower(outputPath)
+	for ext, name := range compressionExtensions {
+		if strings.HasSuffix(p, ext) {
+			debugf("compressing with %s, since the output ends in %s", name, ext)
+			compression = name
+			return
+		}
+	}
+}
+
+// checkCompression checks that compression is only used with outputs that can be compressed.
+func checkCompression() {
+	if compression == "" {
+		if compressionLevel != -1 {
+			usageErrorf("--compress-level: may only be used with compression")
+		}
+		if compressionThreads != 1 {
+			usageErrorf("--threads: may only be used with compression")
+		}
+		if rsyncable {
+			usageErrorf("--rsyncable: may only be used with gzip")
+		}
+		if zstdWindowLog != 0 {
+			usageErrorf("--zstd-long: may only be used with zstd")
+		}
+		if zstdDictPath != "" {
+			usageErrorf("--zstd-dict: may only be used with zstd")
+		}
+		if seekable {
+			usageErrorf("--seekable: may only be used with zstd")
+		}
+		return
+	}
+	if compressionThreads != 1 && compression != "gzip" && compression != "zstd" {
+		usageErrorf("--threads: %s cannot be compressed in parallel", compression)
+	}
+	if zstdWindowLog != 0 && compression != "zstd" {
+		usageErrorf("--zstd-long: may only be used with zstd")
+	}
+	if zstdDictPath != "" && compression != "zstd" {
+		usageErrorf("--zstd-dict: may only be used with zstd")
+	}
+	if seekable && compression != "zstd" {
+		usageErrorf("--seekable: may only be used with zstd")
+	}
+	if rsyncable && compression != "gzip" {
+		usageErrorf("--rsyncable: may only be used with gzip")
+	}
+	if rsyncable && compressionThreads != 1 {
+		usageErrorf("--rsyncable: may not be used with --threads")
+	}
+	if c := compressors[compression]; compressionLevel != -1 &&
+		(compressionLevel < c.minLevel || compressionLevel > c.maxLevel) {
+		usageErrorf("--compress-level: %s level must be from %d to %d, got %d",
+			compression, c.minLevel, c.maxLevel, compressionLevel)
+	}
+	switch {
+	case statePath != "":
+		usageErrorf("--state: compressed output cannot be resumed")
+	case remoteURL != "":
+		usageErrorf("--remote: may not be used with compression")
+	case imageMode || releaseVars != nil || shardCount > 0:
+		usageErrorf("%s: may not be used with image output, release, or shard", compression)
+	case outputFormat == "squashfs":
+		usageErrorf("-F squashfs: may not be used with compression")
+	}
+	if zstdDictPath != "" {
+		loadZstdDict()
+	}
+}
+
+// loadZstdDict reads the dictionary at zstdDictPath. It must be a trained dictionary, such as
+// from zstd --train, since its ID is needed to decompress the archive.
+func loadZstdDict() {
+	p, err := os.ReadFile(zstdDictPath)
+	failOnError("--zstd-dict", err)
+	d, err := zstd.InspectDictionary(p)
+	failOnError("--zstd-dict: "+zstdDictPath, err)
+	zstdDict, zstdDictID = p, d.ID()
+	debugf("compressing with zstd dictionary %s (id %d)", zstdDictPath, zstdDictID)
+}
+
+// compressOutput wraps w to compress the archive, if compression is set. The compressor is closed
+// along with the other output filters, writing out the end of the compressed stream.
+func compressOutput(w io.Writer) io.Writer {
+	if compression == "" {
+		return w
+	}
+
+	c, level := compressors[compression], compressionLevel
+	if level == -1 {
+		level = c.defaultLevel
+	}
+	cw, err := c.newWriter(&countingWriter{w: w, n: &stats.zBytes}, level)
+	failOnError(fmt.Sprintf("%s: cannot compress output at level %d", compression, level), err)
+	outputFilters = append(outputFilters, cw)
+	return cw
+}
+
+// decompressedReader returns a reader for the archive in r, decompressing it if it starts with
+// the magic number of a supported compression format. brotli has no magic number, so it isn't
+// detected.
+func decompressedReader(r *bufio.Reader) (io.Reader, error) {
+	magic, err := r.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return zr, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return zr, nil
+	case bytes.HasPrefix(magic, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return lz4.NewReader(r), nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		zr, err := bzip2.NewReader(r, nil)
+		if err != nil {
+			return nil, fmt.Errorf("bzip2: %w", err)
+		}
+		return zr, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X'}):
+		zr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("xz: %w", err)
+		}
+		return zr, nil
+	}
+	return r, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	configPath string              // Path to the config file, if set by --config
+	profiles   map[string][]string // Profiles loaded from the config file
+	profileSet = map[string]bool{} // Profiles already applied, to catch loops
+
+	// profileArgs are the non-global arguments of all profiles used. These are inserted before
+	// the first non-global argument.
+	profileArgs []string
+)
+
+// defaultConfigPath returns the path of the config file to use if --config isn't set: either
+// $MTAR_CONFIG or $XDG_CONFIG_HOME/mtar/config (defaulting to ~/.config/mtar/config).
+func defaultConfigPath() string {
+	if p := os.Getenv("MTAR_CONFIG"); p != "" {
+		return p
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "mtar", "config")
+}
+
+// applyProfile parses the arguments of the named profile. Its global options take effect
+// immediately, while the rest are added to profileArgs.
+func applyProfile(name string) {
+	if profiles == nil {
+		p := configPath
+		if p == "" {
+			p = defaultConfigPath()
+		}
+		var err error
+		profiles, err = loadConfig(p)
+		failOnUsageError("--profile: cannot load config", err)
+	}
+
+	args, ok := profiles[name]
+	if !ok {
+		usageErrorf("--profile: no profile named %q", name)
+	} else if profileSet[name] {
+		usageErrorf("--profile: profile %q includes itself", name)
+	}
+	profileSet[name] = true
+
+	argv := Args{args: args}
+	parseGlobalOptions(&argv)
+	profileArgs = append(profileArgs, argv.args...)
+}
+
+// loadConfig reads profiles from the config file at p. The file consists of profile names in
+// brackets, each followed by arguments for the profile:
+//
+//	# Comment
+//	[release]
+//	-U
+//	-F ustar
+//	-O '\.debug$'
+//
+// Arguments are separated by whitespace and may be quoted with single or double quotes. A
+// backslash escapes the following character outside of single quotes.
+func loadConfig(p string) (map[string][]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := map[string][]string{}
+	var (
+		name   string
+		lineno int
+		scan   = bufio.NewScanner(f)
+	)
+	for scan.Scan() {
+		lineno++
+		line := strings.TrimSpace(scan.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			name = strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" {
+				return nil, fmt.Errorf("%s:%d: empty profile name", p, lineno)
+			} else if _, dup := config[name]; dup {
+				return nil, fmt.Errorf("%s:%d: duplicate profile %q", p, lineno, name)
+			}
+			config[name] = []string{}
+		case name == "":
+			return nil, fmt.Errorf("%s:%d: arguments must follow a [profile] line", p, lineno)
+		default:
+			fields, err := splitArgs(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", p, lineno, err)
+			}
+			config[name] = append(config[name], fields...)
+		}
+	}
+	return config, scan.Err()
+}
+
+// splitArgs splits line into arguments separated by whitespace, handling quotes and escapes.
+func splitArgs(line string) (args []string, err error) {
+	var (
+		arg    strings.Builder
+		inArg  bool
+		quote  rune
+		escape bool
+	)
+	for _, r := range line {
+		switch {
+		case escape:
+			arg.WriteRune(r)
+			escape = false
+		case r == '\\' && quote != '\'':
+			escape, inArg = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	} else if escape {
+		return nil, errors.New("trailing backslash")
+	} else if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,323 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// archiveDiff is a difference between an archive member and the file on disk, as reported by the
+// diff command.
+type archiveDiff struct {
+	Name    string `json:"name"`
+	Field   string `json:"field"`
+	Archive string `json:"archive"`
+	Disk    string `json:"disk"`
+}
+
+func diffUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar diff [-h|--help] [--format=FORMAT] ARCHIVE [DIR]
+
+Compares the entries of ARCHIVE to the files in DIR (default: .) and writes
+each difference to standard output. ARCHIVE may be '-' to read standard input,
+and may be compressed with gzip, zstd, xz, bzip2, or lz4.
+
+Each difference is written as a line with four tab-separated fields: the entry
+name, the field that differs, its value in the archive, and its value on disk.
+The fields compared are:
+
+  missing
+    The file doesn't exist on disk. Its disk value is '-'.
+  type
+    The file is of a different type (file, dir, symlink, fifo, char, or
+    block), in which case nothing else is compared.
+  mode
+    The permissions, in octal.
+  mtime
+    The modification time, in seconds since the epoch, since not every
+    archive records fractional seconds.
+  size
+    The size of a regular file, in bytes.
+  content
+    The digest of a regular file of the same size, prefixed with the
+    digest algorithm (e.g., sha256:).
+  linkname
+    The target of a symlink, or for a hard link, the entry it's linked to
+    if the file on disk isn't the same file.
+
+Ownership isn't compared. If any differences are found, mtar exits with status
+1.
+
+Options:
+
+  --format=FORMAT
+    Set the output format: 'text' (default) or 'json', which writes each
+    difference as a JSON object with the fields name, field, archive, and
+    disk.
+  --digest-algo=ALGO
+    Set the digest algorithm used to compare content: sha256 (default),
+    sha512, or blake3.
+`)
+}
+
+// diffArchive compares an archive to the files on disk, as selected by the diff command.
+func diffArchive(argv Args) {
+	jsonFormat := false
+	var paths []string
+	for s, ok := argv.Shift(); ok; s, ok = argv.Shift() {
+		switch {
+		case s == "-h", s == "--help":
+			diffUsage()
+			exit(exitUsage)
+		case strings.HasPrefix(s, "--format="):
+			switch format := strings.TrimPrefix(s, "--format="); format {
+			case "text", "json":
+				jsonFormat = format == "json"
+			default:
+				usageErrorf("diff: --format: unrecognized format %q", format)
+			}
+		case strings.HasPrefix(s, "--digest-algo="):
+			setDigestAlgo(strings.TrimPrefix(s, "--digest-algo="))
+		case s == "--":
+			paths = append(paths, argv.args...)
+			argv.args = nil
+		case strings.HasPrefix(s, "-") && s != "-":
+			usageErrorf("diff: unrecognized option %q", s)
+		default:
+			paths = append(paths, s)
+		}
+	}
+	if len(paths) < 1 || len(paths) > 2 {
+		diffUsage()
+		exit(exitUsage)
+	}
+	dir := "."
+	if len(paths) == 2 {
+		dir = paths[1]
+	}
+
+	in := os.Stdin
+	if paths[0] != "-" {
+		f, err := os.Open(paths[0])
+		failOnError("diff: cannot open archive", err)
+		defer f.Close()
+		in = f
+	}
+	r, err := decompressedReader(bufio.NewReader(in))
+	failOnError("diff: cannot read archive", err)
+
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	differs := false
+	report := func(d archiveDiff) {
+		differs = true
+		var err error
+		if jsonFormat {
+			err = enc.Encode(d)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Name, d.Field, d.Archive, d.Disk)
+		}
+		failOnError("diff: error writing output", err)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		failOnError("diff: error reading tar header", err)
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		diffEntry(dir, hdr, tr, report)
+	}
+	failOnError("diff: error writing output", w.Flush())
+	if differs {
+		exit(exitPartial)
+	}
+	exit(exitStatus())
+}
+
+// diffPath returns the path of the entry name under dir, or false if name can't be compared
+// because it's absolute or has a '..' component.
+func diffPath(dir, name string) (string, bool) {
+	elems := nameElems(name)
+	if strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	for _, elem := range elems {
+		if elem == ".." {
+			return "", false
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(strings.Join(elems, "/"))), true
+}
+
+// diffEntry compares the entry hdr, with content r, to the file under dir, passing each difference
+// to report.
+func diffEntry(dir string, hdr *tar.Header, r io.Reader, report func(archiveDiff)) {
+	p, ok := diffPath(dir, hdr.Name)
+	if !ok {
+		warnf("diff: %s: not comparing a name outside of the directory", hdr.Name)
+		return
+	}
+	differ := func(field, archive, disk string) {
+		if archive != disk {
+			report(archiveDiff{Name: hdr.Name, Field: field, Archive: archive, Disk: disk})
+		}
+	}
+
+	fi, err := os.Lstat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		differ("missing", entryTypeName(hdr.Typeflag), "-")
+		return
+	} else if err != nil {
+		warnf("diff: %s: %v", hdr.Name, err)
+		return
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		target, ok := diffPath(dir, hdr.Linkname)
+		tfi, err := os.Lstat(target)
+		if !ok || err != nil || !os.SameFile(fi, tfi) {
+			differ("linkname", hdr.Linkname, "-")
+		}
+		return
+	}
+
+	if typ := fileTypeName(fi); typ != entryTypeName(hdr.Typeflag) {
+		differ("type", entryTypeName(hdr.Typeflag), typ)
+		return
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		differ("mode", fmt.Sprintf("%04o", hdr.Mode&07777), fmt.Sprintf("%04o", fileModeBits(fi)))
+	}
+	differ("mtime", strconv.FormatInt(hdr.ModTime.Unix(), 10), strconv.FormatInt(fi.ModTime().Unix(), 10))
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		link, err := os.Readlink(p)
+		if err != nil {
+			warnf("diff: %s: %v", hdr.Name, err)
+			return
+		}
+		differ("linkname", hdr.Linkname, link)
+	case tar.TypeReg, tar.TypeRegA:
+		if hdr.Size != fi.Size() {
+			differ("size", strconv.FormatInt(hdr.Size, 10), strconv.FormatInt(fi.Size(), 10))
+			return
+		}
+		want, err := digestReader(r)
+		failOnError("diff: error reading "+hdr.Name, err)
+		f, err := os.Open(p)
+		if err != nil {
+			warnf("diff: %s: %v", hdr.Name, err)
+			return
+		}
+		defer f.Close()
+		got, err := digestReader(f)
+		if err != nil {
+			warnf("diff: %s: %v", hdr.Name, err)
+			return
+		}
+		differ("content", want, got)
+	}
+}
+
+// digestReader returns the digest of the contents of r, as ALGO:HEX.
+func digestReader(r io.Reader) (string, error) {
+	h := newDigest()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return digestAlgo + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// entryTypeName returns the name of the file type of an entry with typeflag, as used by diff.
+func entryTypeName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeLink:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeFifo:
+		return "fifo"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	}
+	return "type " + strconv.QuoteRune(rune(typeflag))
+}
+
+// fileTypeName returns the name of the type of fi, as used by diff.
+func fileTypeName(fi os.FileInfo) string {
+	switch m := fi.Mode(); {
+	case m.IsRegular():
+		return "file"
+	case m.IsDir():
+		return "dir"
+	case m&os.ModeSymlink != 0:
+		return "symlink"
+	case m&os.ModeNamedPipe != 0:
+		return "fifo"
+	case m&os.ModeCharDevice != 0:
+		return "char"
+	case m&os.ModeDevice != 0:
+		return "block"
+	}
+	return "other"
+}
+
+// fileModeBits returns the permission, setuid, setgid, and sticky bits of fi as Unix mode bits.
+func fileModeBits(fi os.FileInfo) int64 {
+	m := fi.Mode()
+	bits := int64(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
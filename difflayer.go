@@ -0,0 +1,180 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// diffOld and diffNew, if set, are the directories compared by diff-layer. Only entries that
+	// differ from diffOld are written.
+	diffOld string
+	diffNew string
+
+	// unchanged is the set of entries skipped by diff-layer because they're the same in diffOld.
+	// They're still part of the layered tree, so they aren't whited out.
+	unchanged = map[string]struct{}{}
+
+	// pendingDirs are unchanged directories, outermost first, whose headers are only written if an
+	// entry below them is.
+	pendingDirs []*tar.Header
+)
+
+func diffLayerUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar diff-layer [-h|--help] OLDDIR NEWDIR [OPTION|FILE]...
+
+Writes a tar layer containing the files in NEWDIR that were added or changed
+since OLDDIR, plus whiteouts for files that were removed, so that applying it
+on top of OLDDIR gives NEWDIR.
+
+Global options and per-file options are the same as when writing an archive,
+and FILEs are relative to NEWDIR, so mappings and options can be used to place
+files in the layer. If no FILE is given, all of NEWDIR is added. Each entry is
+compared to the path with the same name under OLDDIR. Directories are
+unchanged if their type, mode, and owner are the same; other files must also
+have the same size, modification time, and link target. Unchanged directories
+are only written if they contain changes.
+`)
+}
+
+// diffLayerArgs parses the directories given to diff-layer and returns the remaining arguments.
+// The files and whiteouts written are chosen as for --layer-base, with OLDDIR as the base.
+func diffLayerArgs(argv Args) Args {
+	if len(argv.args) > 0 && (argv.args[0] == "-h" || argv.args[0] == "--help") || len(argv.args) < 2 {
+		diffLayerUsage()
+		exit(exitUsage)
+	}
+	oldDir, _ := argv.Shift()
+	diffNew, _ = argv.Shift()
+
+	var err error
+	diffOld, err = filepath.Abs(oldDir)
+	failOnError("diff-layer: invalid directory", err)
+	basePaths, err = readDirBase(diffOld)
+	failOnError("diff-layer: cannot read "+oldDir, err)
+	return argv
+}
+
+// diffFileArgs returns the file arguments for diff-layer, relative to NEWDIR.
+func diffFileArgs(args []string) []string {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	return append([]string{"-C", diffNew}, args...)
+}
+
+// readDirBase returns the paths under dir, mapped to whether they're directories.
+func readDirBase(dir string) (map[string]bool, error) {
+	paths := map[string]bool{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if name := layerPath(filepath.ToSlash(rel)); name != "" {
+			paths[name] = d.IsDir()
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// isUnchanged returns whether the file src, added as name, is the same in diffOld.
+func isUnchanged(src, name string, st os.FileInfo) bool {
+	if diffOld == "" || src == "-" {
+		return false
+	}
+	old := filepath.Join(diffOld, filepath.FromSlash(name))
+	var ost os.FileInfo
+	var err error
+	if followLinks {
+		ost, err = os.Stat(old)
+	} else {
+		ost, err = os.Lstat(old)
+	}
+	if err != nil || ost.Mode() != st.Mode() {
+		return false
+	}
+
+	uid, gid, ok := platform.Owner(st)
+	ouid, ogid, ook := platform.Owner(ost)
+	if ok != ook || uid != ouid || gid != ogid {
+		return false
+	}
+
+	switch {
+	case st.IsDir():
+		// A directory's mtime changes with its contents, which are compared separately.
+		return true
+	case st.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		olink, oerr := os.Readlink(old)
+		return err == nil && oerr == nil && link == olink
+	default:
+		return st.Size() == ost.Size() && st.ModTime().Equal(ost.ModTime())
+	}
+}
+
+// deferDir holds the header of an unchanged directory until an entry below it is written.
+func deferDir(hdr *tar.Header) {
+	trimPendingDirs(hdr.Name)
+	pendingDirs = append(pendingDirs, hdr)
+}
+
+// writePendingDirs writes the headers of pending directories containing name.
+func writePendingDirs(w ArchiveWriter, name string) error {
+	trimPendingDirs(name)
+	parents := pendingDirs
+	pendingDirs = nil
+	for _, hdr := range parents {
+		if err := writeHeader(w, hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimPendingDirs drops pending directories that don't contain name. Entries are added in walk
+// order, so nothing more will be written below them.
+func trimPendingDirs(name string) {
+	i := 0
+	for _, hdr := range pendingDirs {
+		if strings.HasPrefix(name, hdr.Name) && name != hdr.Name {
+			pendingDirs[i] = hdr
+			i++
+		}
+	}
+	pendingDirs = pendingDirs[:i]
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+
+	"lukechampine.com/blake3"
+)
+
+// digestAlgo is the algorithm used for the digests mtar computes: those taken by --verify and
+// diff, and those written to a release's checksum file and the MTAR.build provenance record. It
+// may be sha256, sha512, or blake3.
+var digestAlgo = "sha256"
+
+// setDigestAlgo sets digestAlgo from the value of --digest-algo.
+func setDigestAlgo(algo string) {
+	switch algo {
+	case "sha256", "sha512", "blake3":
+		digestAlgo = algo
+	default:
+		usageErrorf("--digest-algo: unrecognized algorithm %q", algo)
+	}
+}
+
+// newDigest returns a new hash for digestAlgo.
+func newDigest() hash.Hash {
+	switch digestAlgo {
+	case "sha512":
+		return sha512.New()
+	case "blake3":
+		return blake3.New(32, nil)
+	default:
+		return sha256.New()
+	}
+}
+
+// digestSumsName returns the name of a release's checksum file for digestAlgo, as expected by
+// the tool that checks it (sha256sum, sha512sum, or b3sum).
+func digestSumsName() string {
+	switch digestAlgo {
+	case "sha512":
+		return "SHA512SUMS"
+	case "blake3":
+		return "B3SUMS"
+	default:
+		return "SHA256SUMS"
+	}
+}
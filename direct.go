@@ -0,0 +1,102 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// outputSink is the last writer in the output chain. While discard is set, writes are reported
+// as written without writing anything, since their content was already written to the output
+// directly.
+type outputSink struct {
+	w       io.Writer
+	discard bool
+}
+
+func (s *outputSink) Write(p []byte) (int, error) {
+	if s.discard {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+var (
+	output *outputSink
+
+	// directOutput, if not nil, is the output file that entry content may be copied to directly,
+	// skipping the tar writer. This allows the kernel to copy file content (e.g., using
+	// copy_file_range or sendfile) without passing it through userspace. It's only set if the
+	// output is a regular file and nothing transforms the output.
+	directOutput *os.File
+)
+
+func newOutputSink(w io.Writer) *outputSink {
+	output = &outputSink{w: w}
+	// Content copied directly wouldn't be seen by --verify.
+	if f, ok := w.(*os.File); ok && !verifyOutput {
+		if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+			directOutput = f
+		}
+	}
+	return output
+}
+
+// copyFile copies up to size bytes of content from rr to w. If possible, content is copied to the
+// output directly. If that fails partway through, the remaining content is copied through w.
+func copyFile(w ArchiveWriter, rr *retryReader, size int64) (int64, error) {
+	var n int64
+	if directOutput != nil && rr.f != nil {
+		n, _ = directOutput.ReadFrom(io.LimitReader(rr.f, size))
+		rr.off += n
+		if err := skipContent(w, n); err != nil {
+			return n, err
+		}
+	}
+	m, err := copyContent(w, io.LimitReader(rr, size-n))
+	return n + m, err
+}
+
+// skipContent advances w past n bytes of content that were already written to the output.
+func skipContent(w ArchiveWriter, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	discard := output.discard
+	output.discard = true
+	defer func() { output.discard = discard }()
+	_, err := io.CopyBuffer(w, io.LimitReader(noopReader{}, n), make([]byte, 1<<20))
+	atomic.AddInt64(&stats.bytes, n)
+	return err
+}
+
+// noopReader is a reader that reports reading len(p) bytes without modifying p.
+type noopReader struct{}
+
+func (noopReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/term"
+)
+
+var (
+	// ageRecipients, if not empty, are the recipients the output is encrypted to with age.
+	ageRecipients []age.Recipient
+
+	// gpgRecipients, if not empty, are the key IDs the output is encrypted to with gpg.
+	gpgRecipients []string
+
+	// encryptPass controls whether the output is encrypted with a passphrase. The passphrase is
+	// read from the environment variable passphraseEnv if set, and prompted for otherwise.
+	encryptPass   bool
+	passphraseEnv string
+
+	// outputFilters are the writers wrapping the output (e.g., for encryption), in the order they
+	// were applied. They're closed in reverse order before the output is closed.
+	outputFilters []io.WriteCloser
+)
+
+// parseAgeRecipients parses a comma-separated list of age recipients. Recipients may be age
+// X25519 public keys (age1...) or SSH public keys (ssh-ed25519 or ssh-rsa).
+func parseAgeRecipients(s string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, arg := range strings.Split(s, ",") {
+		arg = strings.TrimSpace(arg)
+		var r age.Recipient
+		var err error
+		switch {
+		case arg == "":
+			continue
+		case strings.HasPrefix(arg, "age1"):
+			r, err = age.ParseX25519Recipient(arg)
+		case strings.HasPrefix(arg, "ssh-"):
+			r, err = agessh.ParseRecipient(arg)
+		default:
+			err = fmt.Errorf("unrecognized recipient %q", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients given")
+	}
+	return recipients, nil
+}
+
+// filterOutput wraps w with any writers that transform the output, such as encryption.
+func filterOutput(w io.Writer) io.Writer {
+	methods := 0
+	for _, set := range []bool{len(ageRecipients) > 0, len(gpgRecipients) > 0, encryptPass} {
+		if set {
+			methods++
+		}
+	}
+	if methods == 0 {
+		return w
+	} else if methods > 1 {
+		usageErrorf("only one of --encrypt-age, --encrypt-gpg, and --encrypt-pass may be used")
+	}
+	if statePath != "" {
+		usageErrorf("--state: encrypted output cannot be resumed")
+	}
+
+	if encryptPass {
+		r, err := age.NewScryptRecipient(readPassphrase())
+		failOnError("--encrypt-pass", err)
+		ageRecipients = []age.Recipient{r}
+	}
+
+	var fw io.WriteCloser
+	if len(ageRecipients) > 0 {
+		ew, err := age.Encrypt(w, ageRecipients...)
+		failOnError("--encrypt-age: cannot encrypt output", err)
+		fw = ew
+	} else {
+		args := []string{"--batch", "--no-tty", "--encrypt", "--output", "-"}
+		for _, r := range gpgRecipients {
+			args = append(args, "--recipient", r)
+		}
+		fw = startCommandFilter(w, "gpg", args...)
+	}
+	outputFilters = append(outputFilters, fw)
+	return fw
+}
+
+// readPassphrase returns the passphrase to encrypt the output with, either from passphraseEnv or
+// by prompting for it twice on the terminal.
+func readPassphrase() string {
+	if passphraseEnv != "" {
+		pass := os.Getenv(passphraseEnv)
+		if pass == "" {
+			usageErrorf("--encrypt-pass: $%s is not set", passphraseEnv)
+		}
+		return pass
+	}
+
+	tty, err := openTTY()
+	if err != nil {
+		usageErrorf("--encrypt-pass: cannot prompt for a passphrase (set one with --encrypt-pass=ENVVAR): %v", err)
+	}
+	defer tty.Close()
+	prompt := func(msg string) string {
+		_, _ = fmt.Fprint(os.Stderr, msg)
+		pass, err := term.ReadPassword(int(tty.Fd()))
+		_, _ = fmt.Fprintln(os.Stderr)
+		failOnError("--encrypt-pass: cannot read passphrase", err)
+		return string(pass)
+	}
+	pass := prompt("Passphrase: ")
+	if pass == "" {
+		usageErrorf("--encrypt-pass: passphrase is empty")
+	} else if prompt("Confirm passphrase: ") != pass {
+		usageErrorf("--encrypt-pass: passphrases do not match")
+	}
+	return pass
+}
+
+// commandFilter pipes the output through a command, which writes to the next writer in the
+// output chain.
+type commandFilter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func startCommandFilter(w io.Writer, name string, args ...string) *commandFilter {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	failOnError("cannot start "+name, err)
+	failOnError("cannot start "+name, cmd.Start())
+	return &commandFilter{cmd: cmd, stdin: stdin}
+}
+
+// Write writes p to the command. If the write fails, the error includes how the command exited,
+// since that's usually the cause.
+func (c *commandFilter) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	if err != nil {
+		if werr := c.cmd.Wait(); werr != nil {
+			err = fmt.Errorf("%w (%s: %v)", err, c.cmd.Args[0], werr)
+		}
+	}
+	return n, err
+}
+
+// Close closes the command's input and waits for it to exit.
+func (c *commandFilter) Close() error {
+	if err := c.stdin.Close(); err != nil {
+		return err
+	}
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %w", c.cmd.Args[0], err)
+	}
+	return nil
+}
+
+// closeOutputFilters closes the writers wrapping the output, flushing anything they buffered.
+func closeOutputFilters() error {
+	for i := len(outputFilters) - 1; i >= 0; i-- {
+		if err := outputFilters[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// eventFile, if not nil, is where events are written by --log-json, one JSON object per line.
+	eventFile *os.File
+	eventMu   sync.Mutex
+)
+
+// Event names.
+const (
+	eventAdded   = "entry-added"
+	eventSkipped = "entry-skipped"
+	eventWarning = "warning"
+	eventError   = "error"
+	eventEnd     = "totals"
+)
+
+// event is a record of something that happened during the run, written by --log-json.
+type event struct {
+	Time   time.Time    `json:"time"`
+	Event  string       `json:"event"`
+	Path   string       `json:"path,omitempty"`
+	Type   string       `json:"type,omitempty"`
+	Size   *int64       `json:"size,omitempty"`
+	Reason string       `json:"reason,omitempty"`
+	Msg    string       `json:"msg,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Totals *eventTotals `json:"totals,omitempty"`
+}
+
+// eventTotals are the totals for a run, written once the archive is complete.
+type eventTotals struct {
+	Entries  int64 `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	OutBytes int64 `json:"out_bytes"`
+	Skipped  int   `json:"skipped"`
+	Failed   int   `json:"failed"`
+	Status   int   `json:"status"`
+}
+
+// openEventLog opens the file given to --log-json. If dest is fd:N, events are written to the
+// inherited file descriptor N instead.
+func openEventLog(dest string) {
+	if strings.HasPrefix(dest, "fd:") {
+		fd := strings.TrimPrefix(dest, "fd:")
+		n, err := strconv.ParseUint(fd, 10, 0)
+		if err != nil {
+			usageErrorf("--log-json: invalid file descriptor %q", fd)
+		}
+		eventFile = os.NewFile(uintptr(n), dest)
+		return
+	}
+	f, err := os.Create(dest)
+	failOnUsageError("--log-json: cannot create event log", err)
+	eventFile = f
+}
+
+// writeEvent writes ev to the event log, if there is one. Errors writing events are ignored,
+// since they have nowhere else to be reported.
+func writeEvent(ev *event) {
+	if eventFile == nil || precomputing {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	p, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	_, _ = eventFile.Write(append(p, '\n'))
+}
+
+// addedEvent writes an entry-added event for hdr.
+func addedEvent(hdr *tar.Header) {
+	if eventFile == nil {
+		return
+	}
+	size := hdr.Size
+	writeEvent(&event{Event: eventAdded, Path: hdr.Name, Type: headerTypeName(hdr), Size: &size})
+}
+
+// logEventRecord writes a warning or error event for a message logged at level.
+func logEventRecord(level, path, msg string, err error) {
+	if eventFile == nil {
+		return
+	}
+	ev := &event{Event: eventWarning, Path: path, Msg: msg}
+	if level == levelError {
+		ev.Event = eventError
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	writeEvent(ev)
+}
+
+// totalsEvent writes the totals for the run, once it's ending with status.
+func totalsEvent(status int) {
+	writeEvent(&event{Event: eventEnd, Totals: &eventTotals{
+		Entries:  atomic.LoadInt64(&stats.entries),
+		Bytes:    atomic.LoadInt64(&stats.bytes),
+		OutBytes: atomic.LoadInt64(&stats.outBytes),
+		Skipped:  len(skipped),
+		Failed:   failed,
+		Status:   status,
+	}})
+}
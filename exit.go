@@ -0,0 +1,82 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Exit statuses. These match tar's: 1 for a result that's usable but incomplete, and 2 for one that
+// isn't usable at all.
+const (
+	exitSuccess = 0 // The archive was written
+	exitPartial = 1 // The archive was written, but files were skipped, differed, or warnings logged
+	exitFatal   = 2 // An error occurred; no archive was written, or it's incomplete
+	exitUsage   = 2 // Arguments or options were invalid; output may be incomplete
+)
+
+// warned is set once any warning has been logged.
+var warned bool
+
+// warnf logs a warning. Warnings cause mtar to exit with exitPartial once the archive has been
+// written. Warnings are not logged while precomputing totals, since they'll be logged again when
+// the archive is written.
+func warnf(format string, args ...interface{}) {
+	if precomputing {
+		return
+	}
+	warned = true
+	logEvent(levelWarning, "", fmt.Sprintf(format, args...), nil)
+}
+
+// usageErrorf logs an error with mtar's arguments and exits with exitUsage.
+func usageErrorf(format string, args ...interface{}) {
+	logEvent(levelError, "", fmt.Sprintf(format, args...), nil)
+	exit(exitUsage)
+}
+
+// failOnUsageError logs prefix and err and exits with exitUsage if err is not nil.
+func failOnUsageError(prefix string, err error) {
+	if err != nil {
+		logEvent(levelError, "", prefix, err)
+		exit(exitUsage)
+	}
+}
+
+// exit exits with status. Every exit goes through exit, so that the partially written output is
+// removed after an error.
+func exit(status int) {
+	removeOutputTemp()
+	os.Exit(status)
+}
+
+// exitStatus returns the status to exit with once the archive has been written.
+func exitStatus() int {
+	if warned || failed > 0 {
+		return exitPartial
+	}
+	return exitSuccess
+}
@@ -0,0 +1,865 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// extractPath is the archive read by -x, or "-" for standard input.
+	extractPath = "-"
+
+	// extractDir is the directory that entries are extracted into.
+	extractDir = "."
+
+	// unsafeExtract allows entries to be extracted outside of extractDir, whether by absolute
+	// names, '..' components, or being written through symlinks.
+	unsafeExtract bool
+
+	// existingFiles controls what happens when an entry is extracted to a path that exists.
+	existingFiles = existingReplace
+
+	// extractMappings are the members given to -x. If there are any, only entries that they
+	// match are extracted.
+	extractMappings []*extractMapping
+
+	// extractOne is set by --member to stop reading the archive once the member is extracted.
+	extractOne bool
+
+	// stripComponents is the number of leading components removed from entry names.
+	stripComponents int
+
+	// sameOwner controls whether the owners of entries are restored: always (1), never (-1), or
+	// only if running as root or mapping owners (0).
+	sameOwner int
+
+	// ownerMaps and groupMaps map the owners and groups of entries to ids on this system.
+	ownerMaps, groupMaps []idMapping
+
+	// extractXattrs and extractACLs control whether extended attributes and POSIX ACLs are
+	// restored from PAX records.
+	extractXattrs, extractACLs bool
+
+	// toCommand is the shell command that the contents of regular files are piped to, instead of
+	// being written to disk, as set by --to-command.
+	toCommand string
+)
+
+// idMapping maps an owner or group name, or a range of ids, in the archive to an id on this
+// system. A range of ids is mapped to a range of the same size starting at to.
+type idMapping struct {
+	name   string // The name to map, or empty to map lo through hi
+	lo, hi int
+	to     int
+}
+
+// extractMapping selects the entry named member, and the entries under it, to extract. If dest is
+// set, member is replaced by dest in their names.
+type extractMapping struct {
+	member, dest []string
+	arg          string
+	exact        bool // Whether only the entry named member is selected, not those under it
+	found        bool
+}
+
+// existingFilePolicy controls what happens when an entry other than a directory is extracted to a
+// path that already exists. Existing directories are always kept.
+type existingFilePolicy int
+
+const (
+	existingReplace   existingFilePolicy = iota // Replace files, but not directories in the way
+	existingOverwrite                           // Replace anything, including empty directories
+	existingSkip                                // Keep existing files
+	existingKeepNewer                           // Keep existing files newer than the entry
+)
+
+func extractUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar x [-h|--help] [EXTRACT OPTION]... [--] [MEMBER[:DEST]]...
+       mtar -x [-h|--help] [EXTRACT OPTION]... [--] [MEMBER[:DEST]]...
+
+Extracts the archive read from standard input (or the file given by -f) into
+the current directory (or the directory given by -C). The archive may be
+compressed with gzip, zstd, xz, bzip2, or lz4.
+
+If any MEMBERs are given, only the entries they name and the entries under them
+are extracted. If a MEMBER is followed by :DEST, it's replaced by DEST in the
+names of those entries, the same way SRC:DEST names entries when writing an
+archive. For example, app/config:etc/app extracts app/config/app.conf to
+etc/app/app.conf. A MEMBER that matches no entries is logged once the archive
+has been read, and mtar exits with status 1.
+
+Entries are never extracted outside of the directory: entries with absolute
+names or '..' components are refused, as are entries that would be written
+through a symlink, including symlinks extracted earlier from the same archive.
+Hard links are refused if their target would be refused. Refused entries are
+logged and skipped, and mtar exits with status 1 once it's done.
+
+By default, existing files are replaced by extracted entries, and existing
+directories are kept and their modes and times updated. An entry that would
+replace a directory, or a directory entry that would replace a file, is an
+error unless --overwrite is given. If mtar is run as root, the owners of
+entries are restored, by name if the name exists and by id otherwise, unless
+they're mapped by --owner-map or --group-map. Directory times and modes are
+set once all entries have been extracted, so that read-only directories can be
+extracted into.
+
+Extract options:
+
+  -f PATH | --file=PATH
+    Read the archive from PATH. If PATH is '-', it's read from standard
+    input. (default: -)
+  -C DIR
+    Extract entries into DIR, which must exist. (default: .)
+  --overwrite
+    Replace existing files and symlinks, empty directories in the way of
+    other entries, and files in the way of directories.
+  --skip-old-files
+    Keep existing files, skipping their entries.
+  --keep-newer-files
+    Keep existing files that are newer than their entries, skipping the
+    entries.
+  --member=MEMBER[:DEST] | --member MEMBER[:DEST]
+    Extract only the entry named MEMBER, and not the entries under it,
+    and stop reading the archive once it's extracted. This is faster than
+    giving MEMBER as an argument when pulling a single file out of a large
+    archive, but if the archive has more than one entry named MEMBER, only
+    the first is extracted. May not be used with MEMBER arguments.
+  --strip-components=N
+    Remove the first N components from entry names, after replacing any
+    MEMBER with its DEST. Entries with N or fewer components are skipped.
+    Hard link targets are renamed the same way.
+  --owner-map=FROM:TO | --group-map=FROM:TO
+    Restore the owner or group FROM as TO. FROM may be a name, an id, or
+    a range of ids (LO-HI), which are mapped to the range of the same size
+    starting at TO. TO may be a name or id on this system, but must be an
+    id if FROM is a range. For example, --owner-map=0-65535:100000 maps
+    ids for a rootless container. Names are mapped before ids, and the
+    first mapping that matches is used. Implies --same-owner.
+  --same-owner | --no-same-owner
+    Restore the owners of entries, or don't. (default: only as root)
+  --xattrs
+    Restore the extended attributes of regular files and directories from
+    PAX SCHILY.xattr records, such as security.capability. Attributes are
+    only written on Linux, and some (e.g., security.* and trusted.*) can
+    only be written by root. ACLs recorded as attributes are only
+    restored with --acls.
+  --acls
+    Restore the POSIX ACLs of regular files and directories, from PAX
+    SCHILY.acl.access and SCHILY.acl.default records as written by GNU tar
+    and star, and from system.posix_acl_* attributes in SCHILY.xattr
+    records. ACLs are only written on Linux.
+  --to-command=CMD | --to-command CMD
+    Instead of writing entries to disk, run CMD with the system shell for
+    each regular file, with the file's contents as its standard input.
+    Other entries are skipped. CMD's standard output and error are mtar's.
+    The entry is described by the following environment variables:
+      * MTAR_NAME     the name it would be extracted as
+      * MTAR_TYPE     its typeflag (always 0)
+      * MTAR_SIZE     its size in bytes
+      * MTAR_MODE     its mode, in octal
+      * MTAR_UID, MTAR_GID, MTAR_UNAME, MTAR_GNAME
+                      its owner and group
+      * MTAR_MTIME    its modification time, in seconds since the epoch
+    If CMD fails, it's logged and mtar exits with status 1 once it's done.
+  --unsafe
+    Extract entries with absolute names to those paths, resolve '..'
+    components, and follow symlinks, even if it writes outside of the
+    directory. Only use this with archives you trust.
+  -v | -vv
+    List entries on stderr as they're extracted. With -vv, entries are
+    listed in long format.
+  -q
+    Only log errors.
+  --log-level=LEVEL
+    Only log messages at LEVEL or above, as for writing an archive.
+`)
+}
+
+// extract extracts an archive, as selected by x.
+func extract(argv Args) {
+	for s, ok := argv.Shift(); ok; s, ok = argv.Shift() {
+		switch {
+		case s == "-h", s == "--help":
+			extractUsage()
+			exit(exitUsage)
+		case s == "-f", s == "-C":
+			arg, ok := argv.Shift()
+			if !ok {
+				usageErrorf("-x: %s: missing argument", s)
+			}
+			if s == "-f" {
+				extractPath = arg
+			} else {
+				extractDir = arg
+			}
+		case strings.HasPrefix(s, "--file="):
+			extractPath = strings.TrimPrefix(s, "--file=")
+		case s == "--overwrite":
+			existingFiles = existingOverwrite
+		case s == "--skip-old-files":
+			existingFiles = existingSkip
+		case s == "--keep-newer-files":
+			existingFiles = existingKeepNewer
+		case s == "--xattrs":
+			extractXattrs = true
+		case s == "--acls":
+			extractACLs = true
+		case strings.HasPrefix(s, "--to-command="):
+			toCommand = strings.TrimPrefix(s, "--to-command=")
+		case s == "--to-command":
+			if toCommand, ok = argv.Shift(); !ok {
+				usageErrorf("-x: %s: missing argument", s)
+			}
+		case s == "--unsafe":
+			unsafeExtract = true
+		case s == "-v":
+			verbosity = 1
+		case s == "-vv":
+			verbosity = 2
+		case s == "-q":
+			verbosity = -1
+		case strings.HasPrefix(s, "--log-level="):
+			setLogLevel(strings.TrimPrefix(s, "--log-level="))
+		case strings.HasPrefix(s, "--owner-map="):
+			ownerMaps = append(ownerMaps, parseIDMapping(s, lookupUID))
+		case strings.HasPrefix(s, "--group-map="):
+			groupMaps = append(groupMaps, parseIDMapping(s, lookupGID))
+		case s == "--same-owner":
+			sameOwner = 1
+		case s == "--no-same-owner":
+			sameOwner = -1
+		case strings.HasPrefix(s, "--strip-components="):
+			n, err := strconv.Atoi(strings.TrimPrefix(s, "--strip-components="))
+			if err == nil && n < 0 {
+				err = errors.New("may not be negative")
+			}
+			failOnUsageError("-x: --strip-components", err)
+			stripComponents = n
+		case strings.HasPrefix(s, "--member="), s == "--member":
+			arg := strings.TrimPrefix(s, "--member=")
+			if s == "--member" {
+				if arg, ok = argv.Shift(); !ok {
+					usageErrorf("-x: %s: missing argument", s)
+				}
+			}
+			if extractOne {
+				usageErrorf("-x: --member: may only be given once")
+			}
+			addExtractMapping(arg)
+			extractMappings[len(extractMappings)-1].exact = true
+			extractOne = true
+		case s == "--":
+			for _, arg := range argv.args {
+				addExtractMapping(arg)
+			}
+			argv.args = nil
+		case strings.HasPrefix(s, "-"):
+			usageErrorf("-x: unrecognized option %q", s)
+		default:
+			addExtractMapping(s)
+		}
+	}
+
+	if extractOne && len(extractMappings) > 1 {
+		usageErrorf("-x: --member: may not be used with MEMBER arguments")
+	}
+
+	in := os.Stdin
+	if extractPath != "-" {
+		f, err := os.Open(extractPath)
+		failOnError("-x: cannot open archive", err)
+		defer f.Close()
+		in = f
+	}
+
+	dir, err := filepath.Abs(extractDir)
+	failOnError("-x: invalid directory", err)
+	fi, err := os.Stat(dir)
+	failOnError("-x: cannot extract", err)
+	if !fi.IsDir() {
+		fatalf("-x: cannot extract: %s is not a directory", extractDir)
+	}
+
+	x := &extractor{dir: dir, chown: sameOwner == 1 ||
+		sameOwner == 0 && (os.Geteuid() == 0 || len(ownerMaps) > 0 || len(groupMaps) > 0)}
+	r, err := decompressedReader(bufio.NewReader(in))
+	failOnError("-x: cannot read archive", err)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		failOnError("-x: error reading tar header", err)
+		x.extractEntry(hdr, tr)
+		if extractOne && extractMappings[0].found {
+			break
+		}
+	}
+	x.finish()
+	for _, m := range extractMappings {
+		if !m.found {
+			warnf("%s: not found in archive", m.arg)
+		}
+	}
+	exit(exitStatus())
+}
+
+// extractedDir is a directory whose mode and times are set once all entries are extracted.
+type extractedDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// extractor extracts entries into dir.
+type extractor struct {
+	dir   string
+	chown bool // Whether to restore owners
+	dirs  []extractedDir
+
+	uids map[string]int // Cached uids by user name, or -1 if the name doesn't exist
+	gids map[string]int
+}
+
+// extractEntry extracts a single entry, logging a warning if it's refused or can't be extracted.
+func (x *extractor) extractEntry(hdr *tar.Header, r io.Reader) {
+	switch hdr.Typeflag {
+	case tar.TypeXGlobalHeader:
+		return
+	}
+
+	name, ok := extractName(hdr.Name, true)
+	if !ok {
+		return
+	}
+	if toCommand != "" {
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			listEntry(hdr)
+			pipeEntry(name, hdr, r)
+		}
+		return
+	}
+	p, err := x.target(name)
+	if err != nil {
+		warnf("refusing to extract %s: %v", hdr.Name, err)
+		return
+	}
+	var link string
+	if hdr.Typeflag == tar.TypeLink {
+		target, ok := extractName(hdr.Linkname, false)
+		if !ok {
+			warnf("refusing to extract %s: link to %s: target is stripped", hdr.Name, hdr.Linkname)
+			return
+		}
+		if link, err = x.target(target); err != nil {
+			warnf("refusing to extract %s: link to %s: %v", hdr.Name, hdr.Linkname, err)
+			return
+		}
+	}
+	listEntry(hdr)
+	if err := x.write(p, link, hdr, r); err != nil {
+		warnf("cannot extract %s: %v", hdr.Name, err)
+	}
+}
+
+// pipeEntry runs toCommand with the contents of the regular file hdr as its input.
+func pipeEntry(name string, hdr *tar.Header, r io.Reader) {
+	cmd := shellCommand(toCommand)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"MTAR_NAME="+name,
+		"MTAR_TYPE="+string(tar.TypeReg),
+		"MTAR_SIZE="+strconv.FormatInt(hdr.Size, 10),
+		"MTAR_MODE="+fmt.Sprintf("%04o", hdr.Mode&07777),
+		"MTAR_UID="+strconv.Itoa(hdr.Uid),
+		"MTAR_GID="+strconv.Itoa(hdr.Gid),
+		"MTAR_UNAME="+hdr.Uname,
+		"MTAR_GNAME="+hdr.Gname,
+		"MTAR_MTIME="+strconv.FormatInt(hdr.ModTime.Unix(), 10),
+	)
+	if err := cmd.Run(); err != nil {
+		warnf("--to-command: %s: %v", hdr.Name, err)
+	}
+}
+
+// addExtractMapping adds a MEMBER[:DEST] argument to extractMappings.
+func addExtractMapping(arg string) {
+	member, dest := splitMapping(arg)
+	if strings.Contains(dest, ":") {
+		usageErrorf("-x: %s: members have no options", arg)
+	}
+	m := &extractMapping{member: nameElems(member), arg: arg}
+	if len(m.member) == 0 {
+		usageErrorf("-x: %s: empty member name", arg)
+	}
+	if dest != "" {
+		m.dest = nameElems(dest)
+	}
+	extractMappings = append(extractMappings, m)
+}
+
+// nameElems splits an entry name into its components, dropping empty and '.' components.
+// Components of '..' are kept, so that target can refuse them.
+func nameElems(name string) []string {
+	elems := strings.Split(name, "/")
+	n := 0
+	for _, elem := range elems {
+		if elem != "" && elem != "." {
+			elems[n] = elem
+			n++
+		}
+	}
+	return elems[:n]
+}
+
+// extractName returns the name that the entry name is extracted as, after replacing any member
+// with its dest and stripping components. It returns false if the entry is skipped. If selecting,
+// entries that no mapping matches are also skipped, and matching mappings are marked as found.
+func extractName(name string, selecting bool) (string, bool) {
+	abs := strings.HasPrefix(name, "/")
+	elems := nameElems(name)
+
+	var match *extractMapping
+	for _, m := range extractMappings {
+		if hasElemPrefix(elems, m.member) && (!m.exact || len(elems) == len(m.member)) {
+			match = m
+			break
+		}
+	}
+	if match != nil {
+		if selecting {
+			match.found = true
+		}
+		if match.dest != nil {
+			elems = append(append([]string(nil), match.dest...), elems[len(match.member):]...)
+			abs = false
+		}
+	} else if selecting && len(extractMappings) > 0 {
+		return "", false
+	}
+
+	if stripComponents > 0 {
+		if len(elems) <= stripComponents {
+			return "", false
+		}
+		elems, abs = elems[stripComponents:], false
+	}
+	if len(elems) == 0 {
+		return ".", true
+	} else if abs {
+		return "/" + strings.Join(elems, "/"), true
+	}
+	return strings.Join(elems, "/"), true
+}
+
+// hasElemPrefix returns whether prefix is a leading subsequence of elems.
+func hasElemPrefix(elems, prefix []string) bool {
+	if len(elems) < len(prefix) {
+		return false
+	}
+	for i, elem := range prefix {
+		if elems[i] != elem {
+			return false
+		}
+	}
+	return true
+}
+
+// target returns the path that the entry name is extracted to. Unless unsafeExtract is set, it
+// returns an error if the path is outside of the directory or would be written through a
+// symlink.
+func (x *extractor) target(name string) (string, error) {
+	rel := filepath.FromSlash(name)
+	if unsafeExtract {
+		if filepath.IsAbs(rel) {
+			return filepath.Clean(rel), nil
+		}
+		return filepath.Join(x.dir, rel), nil
+	}
+
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return "", errors.New("name is absolute")
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", errors.New("name contains '..'")
+		}
+	}
+
+	p := filepath.Join(x.dir, rel)
+	// Check each existing parent directory under dir, so that nothing is written through a
+	// symlink, whether it was extracted from the archive or was already there.
+	parent := x.dir
+	elems := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+	for _, elem := range elems {
+		if elem == "." || elem == "" {
+			continue
+		}
+		parent = filepath.Join(parent, elem)
+		fi, err := os.Lstat(parent)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symlink", parent)
+		}
+	}
+	return p, nil
+}
+
+// write writes the entry hdr to p. If it's a hard link, link is the path of its target.
+func (x *extractor) write(p, link string, hdr *tar.Header, r io.Reader) error {
+	if p == x.dir && hdr.Typeflag != tar.TypeDir {
+		return errors.New("not a directory")
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return x.writeDir(p, hdr)
+	case tar.TypeReg, tar.TypeRegA, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	default:
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+
+	// Replace whatever is at p, rather than writing through it if it's a symlink or into another
+	// name for it if it's a hard link.
+	if fi, err := os.Lstat(p); err == nil {
+		if keepExisting(fi, hdr) {
+			debugf("keeping existing file %s", p)
+			return nil
+		}
+		if fi.IsDir() && existingFiles != existingOverwrite {
+			return errors.New("a directory is in the way")
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, p); err != nil {
+			return err
+		}
+		return x.setOwner(p, hdr)
+	case tar.TypeLink:
+		return os.Link(link, p)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := makeNode(p, hdr); err != nil {
+			return err
+		}
+	default:
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := x.setOwner(p, hdr); err != nil {
+		return err
+	}
+	// Attributes are set after the owner, since changing the owner clears security.capability.
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		if err := restoreXattrs(p, hdr); err != nil {
+			return err
+		}
+	}
+	return x.setModeAndTimes(p, hdr)
+}
+
+// writeDir creates the directory p, if it doesn't exist. Its mode and times are set by finish.
+func (x *extractor) writeDir(p string, hdr *tar.Header) error {
+	if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+		if existingFiles != existingOverwrite {
+			return errors.New("a file is in the way")
+		} else if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(p, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	if err := x.setOwner(p, hdr); err != nil {
+		return err
+	}
+	if err := restoreXattrs(p, hdr); err != nil {
+		return err
+	}
+	x.dirs = append(x.dirs, extractedDir{path: p, hdr: hdr})
+	return nil
+}
+
+// restoreXattrs restores the extended attributes and ACLs of p from the PAX records of hdr, as
+// selected by --xattrs and --acls.
+func restoreXattrs(p string, hdr *tar.Header) error {
+	if !extractXattrs && !extractACLs {
+		return nil
+	}
+
+	keys := make([]string, 0, len(hdr.PAXRecords))
+	for k := range hdr.PAXRecords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name, value := "", hdr.PAXRecords[k]
+		switch {
+		case strings.HasPrefix(k, "SCHILY.xattr."):
+			name = strings.TrimPrefix(k, "SCHILY.xattr.")
+			if isACLXattr(name) && !extractACLs || !isACLXattr(name) && !extractXattrs {
+				continue
+			}
+		case k == "SCHILY.acl.access", k == "SCHILY.acl.default" && hdr.Typeflag == tar.TypeDir:
+			if !extractACLs {
+				continue
+			}
+			name = "system.posix_acl_" + strings.TrimPrefix(k, "SCHILY.acl.")
+			acl, err := encodeACL(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			value = acl
+		default:
+			continue
+		}
+		if err := writeXattr(p, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isACLXattr returns whether the xattr name holds a POSIX ACL.
+func isACLXattr(name string) bool {
+	return name == "system.posix_acl_access" || name == "system.posix_acl_default"
+}
+
+// keepExisting returns whether the existing file fi is kept instead of extracting hdr over it.
+func keepExisting(fi os.FileInfo, hdr *tar.Header) bool {
+	switch existingFiles {
+	case existingSkip:
+		return !fi.IsDir()
+	case existingKeepNewer:
+		return !fi.IsDir() && fi.ModTime().After(hdr.ModTime)
+	}
+	return false
+}
+
+// finish sets the modes and times of extracted directories, deepest first, now that nothing else
+// will be written to them.
+func (x *extractor) finish() {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		// A later entry may have replaced the directory (e.g., with --overwrite), possibly with a
+		// symlink that chmod and chtimes would follow out of the directory.
+		if !x.isDir(d.path) {
+			debugf("%s: no longer a directory, not setting its mode and times", d.hdr.Name)
+			continue
+		}
+		if err := x.setModeAndTimes(d.path, d.hdr); err != nil {
+			warnf("cannot extract %s: %v", d.hdr.Name, err)
+		}
+	}
+}
+
+// isDir returns whether p is still a directory under dir, reached without following any symlinks.
+func (x *extractor) isDir(p string) bool {
+	if !unsafeExtract {
+		rel, err := filepath.Rel(x.dir, p)
+		if err != nil {
+			return false
+		}
+		if rel != "." {
+			if _, err := x.target(filepath.ToSlash(rel)); err != nil {
+				return false
+			}
+		}
+	}
+	fi, err := os.Lstat(p)
+	return err == nil && fi.IsDir()
+}
+
+// setModeAndTimes sets the mode and times of p from hdr.
+func (x *extractor) setModeAndTimes(p string, hdr *tar.Header) error {
+	mode := os.FileMode(hdr.Mode & 0777)
+	if hdr.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if hdr.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if hdr.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	if hdr.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(p, atime, hdr.ModTime)
+}
+
+// setOwner sets the owner of p from hdr, if restoring owners. Mapped owners are used first, then
+// owner names if they exist on this system, then ids.
+func (x *extractor) setOwner(p string, hdr *tar.Header) error {
+	if !x.chown {
+		return nil
+	}
+	uid, ok := mapID(ownerMaps, hdr.Uname, hdr.Uid)
+	if !ok {
+		uid = x.lookupID(&x.uids, hdr.Uname, hdr.Uid, lookupUID)
+	}
+	gid, ok := mapID(groupMaps, hdr.Gname, hdr.Gid)
+	if !ok {
+		gid = x.lookupID(&x.gids, hdr.Gname, hdr.Gid, lookupGID)
+	}
+	return os.Lchown(p, uid, gid)
+}
+
+// lookupUID returns the uid of the user name.
+func lookupUID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+// lookupGID returns the gid of the group name.
+func lookupGID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// parseIDMapping parses an --owner-map or --group-map option, using lookup to find the id of a
+// name given as TO.
+func parseIDMapping(s string, lookup func(string) (string, error)) idMapping {
+	opt, v, _ := strings.Cut(s, "=")
+	from, to, ok := strings.Cut(v, ":")
+	if !ok || from == "" || to == "" {
+		usageErrorf("-x: %s: expected FROM:TO, got %q", opt, v)
+	}
+
+	var m idMapping
+	toID, err := numericID(to)
+	if err != nil {
+		var id string
+		if id, err = lookup(to); err == nil {
+			toID, err = numericID(id)
+		}
+		failOnUsageError(fmt.Sprintf("-x: %s: cannot find %s", opt, to), err)
+	}
+	m.to = toID
+
+	lo, hi, isRange := strings.Cut(from, "-")
+	if m.lo, err = numericID(lo); err != nil {
+		if isRange {
+			usageErrorf("-x: %s: invalid range %q", opt, from)
+		}
+		m.name = from
+		return m
+	}
+	m.hi = m.lo
+	if isRange {
+		if m.hi, err = numericID(hi); err != nil || m.hi < m.lo {
+			usageErrorf("-x: %s: invalid range %q", opt, from)
+		}
+		if _, err := numericID(to); err != nil {
+			usageErrorf("-x: %s: a range must be mapped to an id, not %q", opt, to)
+		}
+	}
+	return m
+}
+
+// mapID returns the id that maps maps the name or id of an entry's owner or group to, if any.
+func mapID(maps []idMapping, name string, id int) (int, bool) {
+	for _, m := range maps {
+		if m.name != "" && m.name == name {
+			return m.to, true
+		}
+	}
+	for _, m := range maps {
+		if m.name == "" && id >= m.lo && id <= m.hi {
+			return m.to + id - m.lo, true
+		}
+	}
+	return 0, false
+}
+
+// lookupID returns the id of name, looked up by lookup and cached in ids, or id if name is empty
+// or doesn't exist.
+func (x *extractor) lookupID(ids *map[string]int, name string, id int, lookup func(string) (string, error)) int {
+	if name == "" {
+		return id
+	}
+	if *ids == nil {
+		*ids = map[string]int{}
+	}
+	n, ok := (*ids)[name]
+	if !ok {
+		n = -1
+		if s, err := lookup(name); err == nil {
+			if v, err := numericID(s); err == nil {
+				n = v
+			}
+		}
+		(*ids)[name] = n
+	}
+	if n == -1 {
+		return id
+	}
+	return n
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// isFilterOption returns whether s is one of the filter options (-i, -I, -o, -O, or -R).
+func isFilterOption(s string) bool {
+	switch {
+	case s == "-R", s == "-Ri", s == "-Ro":
+		return true
+	case strings.HasPrefix(s, "-i"), strings.HasPrefix(s, "-I"),
+		strings.HasPrefix(s, "-o"), strings.HasPrefix(s, "-O"):
+		return true
+	}
+	return false
+}
+
+// addFilter applies the filter option s, shifting its regexp from argv if it's not attached.
+func addFilter(s string, argv *Args) {
+	switch s {
+	case "-Ro": // reset output filters
+		skipDestGlobs = nil
+		return
+	case "-Ri": // reset input filters
+		skipSrcGlobs = nil
+		return
+	case "-R": // reset all filters
+		skipSrcGlobs, skipDestGlobs = nil, nil
+		return
+	}
+
+	opt, expr := s[:2], s[2:]
+	if expr == "" {
+		var ok bool
+		if expr, ok = argv.Shift(); !ok {
+			usageErrorf("%s: missing regexp", opt)
+		}
+	}
+
+	m := compileMatcher(opt, expr)
+	switch opt {
+	case "-i", "-I": // filter input by regexp
+		skipSrcGlobs = append(skipSrcGlobs, m)
+	case "-o", "-O": // filter output by regexp (after mapping)
+		skipDestGlobs = append(skipDestGlobs, m)
+	}
+}
+
+// compileMatcher compiles the regexp expr for the filter option opt. Lowercase options select
+// paths that match and uppercase options reject them. Invalid regexps are usage errors.
+func compileMatcher(opt, expr string) Matcher {
+	rx, err := regexp.Compile(expr)
+	if err != nil {
+		usageErrorf("%s: invalid regexp %q: %v", opt, expr, err)
+	}
+	return Matcher{rx: rx, want: opt == "-i" || opt == "-o"}
+}
+
+func testFilterUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar test-filter [FILTER|PATH]... [--] [PATH]...
+
+Reports which filters match each sample PATH and whether mtar would add it.
+Filters (-i, -I, -o, -O, -Ri, -Ro, and -R) are applied in order, the same way
+they are when creating an archive, so a filter only affects the paths after
+it. After --, all arguments are paths.
+
+PATH may be SRC or SRC:DEST, as when adding files. Input filters are tested
+against SRC and output filters against the entry name (DEST, or SRC made
+relative). End SRC with a / to test it as a directory. The files do not need
+to exist.
+
+For each path, every filter is listed with whether its regexp matched and
+whether the path passed it, followed by the decision: added, or skipped by
+the first filter it didn't pass.
+`)
+}
+
+func testFilter(argv Args) {
+	if len(argv.args) == 0 {
+		testFilterUsage()
+		exit(exitUsage)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	paths := false
+	for s, ok := argv.Shift(); ok; s, ok = argv.Shift() {
+		switch {
+		case paths:
+		case s == "-h" || s == "--help":
+			testFilterUsage()
+			exit(exitUsage)
+		case s == "--":
+			paths = true
+			continue
+		case isFilterOption(s):
+			addFilter(s, &argv)
+			continue
+		}
+		testFilterPath(tw, s)
+	}
+	failOnError("test-filter: error writing output", tw.Flush())
+}
+
+// testFilterPath writes the result of each filter for the sample path s to w, followed by the
+// decision.
+func testFilterPath(w io.Writer, s string) {
+	src, dest := splitMapping(s)
+	if idx := strings.IndexByte(dest, ':'); idx > -1 {
+		dest = dest[:idx] // Options don't affect filtering
+	}
+	name := entryName(src, dest)
+	if strings.HasSuffix(src, "/") {
+		name += "/"
+	}
+	src = filepath.ToSlash(src)
+
+	fmt.Fprintf(w, "%s -> %s\n", src, name)
+	var skippedBy string
+	test := func(stage string, set []Matcher, s string) {
+		for _, m := range set {
+			matched, result := "no match", "pass"
+			if m.rx.MatchString(s) {
+				matched = "match"
+			}
+			if !m.matches(s) {
+				result = "skip"
+				if skippedBy == "" {
+					skippedBy = stage + " " + m.String()
+				}
+			}
+			fmt.Fprintf(w, "  %s\t%v\t%s\t%s\n", stage, m, matched, result)
+		}
+	}
+	test("input", skipSrcGlobs, src)
+	test("output", skipDestGlobs, name)
+
+	if skippedBy == "" {
+		fmt.Fprintf(w, "  added\n")
+	} else {
+		fmt.Fprintf(w, "  skipped by %s\n", skippedBy)
+	}
+}
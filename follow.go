@@ -0,0 +1,98 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// followLinks controls whether symlinks are followed (-L), adding what they point to instead of
+// the link itself.
+var followLinks bool
+
+// dirID identifies a directory by device and inode. Where the platform can't provide those, the
+// directory's resolved path is used instead.
+type dirID struct {
+	dev, ino uint64
+	path     string
+}
+
+// activeDirs maps the directories currently being added recursively to the paths they were
+// entered through. Following a symlink to one of these would loop forever.
+var activeDirs = map[dirID]string{}
+
+func dirIDOf(src string, st os.FileInfo) dirID {
+	if dev, ino, ok := platform.FileID(st); ok {
+		return dirID{dev: dev, ino: ino}
+	}
+	p, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		p = src
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	return dirID{path: p}
+}
+
+// isDirLoop returns whether the directory src is already being added recursively, and reports
+// it as skipped if so.
+func isDirLoop(src string, st os.FileInfo) bool {
+	prev, loop := activeDirs[dirIDOf(src, st)]
+	if !loop {
+		return false
+	}
+	warnf("skipping file: %s: symlink loop (same directory as %s)", src, prev)
+	recordSkip(src, skipLoop, "same directory as "+prev, nil)
+	return true
+}
+
+// enterDir marks the directory src as being added recursively until the returned function is
+// called.
+func enterDir(src string) (leave func()) {
+	st, err := os.Stat(src)
+	if err != nil {
+		return func() {}
+	}
+	id := dirIDOf(src, st)
+	activeDirs[id] = filepath.Clean(src)
+	return func() { delete(activeDirs, id) }
+}
+
+// enterWalkedDir marks the directory p, with info, as being walked until the returned function
+// is called, so that a symlink under it that leads back to it is detected as a loop. It does
+// nothing unless links are followed, or if p was already entered (e.g., as the root of the walk).
+func enterWalkedDir(p string, info os.FileInfo) (leave func()) {
+	if !followLinks {
+		return func() {}
+	}
+	id := dirIDOf(p, info)
+	if _, ok := activeDirs[id]; ok {
+		return func() {}
+	}
+	activeDirs[id] = filepath.Clean(p)
+	return func() { delete(activeDirs, id) }
+}
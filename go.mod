@@ -1,3 +1,22 @@
 module go.spiff.io/mtar
 
-go 1.13
+go 1.19
+
+require (
+	filippo.io/age v1.2.1
+	github.com/andybalholm/brotli v1.0.6
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.16.7
+	github.com/klauspost/pgzip v1.2.6
+	github.com/pierrec/lz4/v4 v4.1.18
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/sys v0.21.0
+	golang.org/x/term v0.21.0
+	lukechampine.com/blake3 v1.2.1
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+)
@@ -0,0 +1,117 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+)
+
+var (
+	// goEmbedName, if set, is the name of the accessor for the archive in the Go source written
+	// in place of the archive.
+	goEmbedName string
+
+	// goPackage is the package of the Go source. If empty, it's $GOPACKAGE, as set by go generate.
+	goPackage string
+)
+
+// goSourceOutput wraps w to write Go source embedding the archive, if --go-embed is set. The
+// archive is escaped into a string constant as it's written, and the accessor is written once
+// the writer is closed along with the output filters.
+func goSourceOutput(w io.Writer) io.Writer {
+	if goEmbedName == "" {
+		return w
+	}
+	if !token.IsIdentifier(goEmbedName) {
+		usageErrorf("--go-embed: %q is not a Go identifier", goEmbedName)
+	}
+	if goPackage == "" {
+		goPackage = os.Getenv("GOPACKAGE")
+	}
+	if goPackage == "" {
+		usageErrorf("--go-embed: no package given with --go-package or $GOPACKAGE")
+	} else if !token.IsIdentifier(goPackage) {
+		usageErrorf("--go-package: %q is not a Go identifier", goPackage)
+	}
+	if len(outputFilters) > 0 || statePath != "" || imageMode {
+		usageErrorf("--go-embed: may not be used with compression, encryption, --state, or image output")
+	}
+
+	g := &goSource{w: bufio.NewWriter(w)}
+	fmt.Fprintf(g.w, `// Code generated by mtar; DO NOT EDIT.
+
+package %s
+
+import (
+	"archive/tar"
+	"strings"
+)
+
+// %sData is the content of the embedded archive.
+const %sData = "`, goPackage, goEmbedName, goEmbedName)
+	outputFilters = append(outputFilters, g)
+	return g
+}
+
+// goSource escapes the bytes written to it into the body of a Go string literal.
+type goSource struct {
+	w *bufio.Writer
+}
+
+func (g *goSource) Write(p []byte) (int, error) {
+	const hex = "0123456789abcdef"
+	for _, c := range p {
+		switch {
+		case c == '"' || c == '\\':
+			g.w.WriteByte('\\')
+			g.w.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			g.w.WriteByte(c)
+		default:
+			g.w.Write([]byte{'\\', 'x', hex[c>>4], hex[c&0xf]})
+		}
+	}
+	// Write errors are sticky in bufio.Writer, so they're only checked once per write.
+	if _, err := g.w.Write(nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the string constant and writes the accessor.
+func (g *goSource) Close() error {
+	fmt.Fprintf(g.w, `"
+
+// %s returns a reader for the embedded archive.
+func %s() *tar.Reader {
+	return tar.NewReader(strings.NewReader(%sData))
+}
+`, goEmbedName, goEmbedName, goEmbedName)
+	return g.w.Flush()
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// entryHook is a command run before or after each entry whose name matches rx is written.
+type entryHook struct {
+	rx      *regexp.Regexp
+	command string
+}
+
+var preAddHooks, postAddHooks []entryHook
+
+// parseEntryHook parses a PATTERN:CMD hook for the option opt.
+func parseEntryHook(opt, s string) entryHook {
+	expr, command, ok := strings.Cut(s, ":")
+	if !ok || command == "" {
+		usageErrorf("%s: expected PATTERN:CMD, got %q", opt, s)
+	}
+	rx, err := regexp.Compile(expr)
+	if err != nil {
+		usageErrorf("%s: invalid regexp %q: %v", opt, expr, err)
+	}
+	return entryHook{rx: rx, command: command}
+}
+
+// hooksApply returns whether hooks should run for the entry about to be added. Hooks don't run
+// while precomputing totals or for entries already written by an interrupted run.
+func hooksApply() bool {
+	if len(preAddHooks) == 0 && len(postAddHooks) == 0 || precomputing {
+		return false
+	}
+	return !resuming || atomic.LoadInt64(&stats.entries) >= resumeEntries
+}
+
+// runEntryHooks runs each hook whose pattern matches the entry's name. A hook that fails is
+// fatal, since a pre-add hook that failed to quiesce a file means its content can't be trusted.
+// It returns whether any hook ran.
+func runEntryHooks(event string, hooks []entryHook, src string, hdr *tar.Header) (ran bool) {
+	for _, h := range hooks {
+		if !h.rx.MatchString(hdr.Name) {
+			continue
+		}
+		ran = true
+		debugf("%s: running %s hook: %s", hdr.Name, event, h.command)
+		cmd := shellCommand(h.command)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		cmd.Env = append(os.Environ(),
+			"MTAR_HOOK="+event,
+			"MTAR_SOURCE="+src,
+			"MTAR_NAME="+hdr.Name,
+			"MTAR_TYPE="+string(hdr.Typeflag),
+			"MTAR_SIZE="+strconv.FormatInt(hdr.Size, 10),
+		)
+		failOnError(fmt.Sprintf("%s hook for %s", event, hdr.Name), cmd.Run())
+	}
+	return ran
+}
+
+// onStart and onComplete are commands run before the output is opened and once the archive is
+// complete.
+var onStart, onComplete string
+
+// hookOutput returns the output passed to lifecycle hooks: the output path or URL, or "-" for
+// standard output.
+func hookOutput() string {
+	switch {
+	case outputPath != "" && outputPath != "-":
+		return outputPath
+	case remoteURL != "":
+		return remoteURL
+	}
+	return "-"
+}
+
+// runLifecycleHook runs command for event, exiting with an error if it fails.
+func runLifecycleHook(event, command string, env ...string) {
+	if command == "" {
+		return
+	}
+	debugf("running %s hook: %s", event, command)
+	cmd := shellCommand(command)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(append(os.Environ(), "MTAR_HOOK="+event, "MTAR_OUTPUT="+hookOutput()), env...)
+	failOnError(event+" hook", cmd.Run())
+}
+
+func runOnStart() {
+	runLifecycleHook("on-start", onStart)
+}
+
+// runOnComplete runs the --on-complete hook with the totals for the archive and the status mtar
+// is about to exit with.
+func runOnComplete() {
+	runLifecycleHook("on-complete", onComplete,
+		"MTAR_ENTRIES="+strconv.FormatInt(atomic.LoadInt64(&stats.entries), 10),
+		"MTAR_BYTES="+strconv.FormatInt(atomic.LoadInt64(&stats.bytes), 10),
+		"MTAR_OUTPUT_BYTES="+strconv.FormatInt(atomic.LoadInt64(&stats.outBytes), 10),
+		"MTAR_SKIPPED="+strconv.Itoa(len(skipped)),
+		"MTAR_FAILED="+strconv.Itoa(failed),
+		"MTAR_EXIT_STATUS="+strconv.Itoa(exitStatus()),
+	)
+}
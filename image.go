@@ -0,0 +1,504 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Media types for the OCI image written by --image.
+const (
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var (
+	imageMode     bool
+	imageTags     []string
+	imageConfig   string   // Path to a base image config
+	imageLayers   []string // Paths to lower layers, bottom first
+	imagePlatform string
+	imageEnv      []string
+	imageLabels   []string
+	imageEntry    string
+	imageCmd      string
+	imageWorkdir  string
+	imageUser     string
+
+	imageBase  map[string]any // Base image config, as read from imageConfig
+	imageSpool *layerSpool    // The layer being written
+
+	// ociLayout, if set, is an OCI image layout directory to add the image to instead of writing
+	// it to the output.
+	ociLayout string
+)
+
+// blob is a content-addressed file in an image.
+type blob struct {
+	MediaType string            `json:"mediaType"`
+	Digest    string            `json:"digest"`
+	Size      int64             `json:"size"`
+	Annots    map[string]string `json:"annotations,omitempty"`
+}
+
+func (b blob) path() string {
+	return "blobs/sha256/" + strings.TrimPrefix(b.Digest, "sha256:")
+}
+
+// checkImage validates image options and reads the base image config, if any. Image options
+// other than --image and --oci-layout require one of them.
+func checkImage() {
+	if appendDir != "" {
+		if ociLayout != "" {
+			usageErrorf("oci-append: --oci-layout may not be used")
+		}
+		ociLayout = appendDir
+	}
+	if ociLayout != "" {
+		imageMode = true
+		if outputPath != "" || remoteURL != "" || len(ageRecipients) > 0 || len(gpgRecipients) > 0 || encryptPass {
+			usageErrorf("--oci-layout: may not be used with -f, --remote, or encryption")
+		}
+		var err error
+		ociLayout, err = filepath.Abs(ociLayout)
+		failOnError("--oci-layout: invalid directory", err)
+	}
+	if !imageMode {
+		if imageConfig != "" || len(imageLayers) > 0 || imagePlatform != "" || len(imageEnv) > 0 ||
+			len(imageLabels) > 0 || imageEntry != "" || imageCmd != "" || imageWorkdir != "" || imageUser != "" {
+			usageErrorf("--image-*: requires --image or --oci-layout")
+		}
+		return
+	}
+	if statePath != "" {
+		usageErrorf("--image, --oci-layout: may not be used with --state")
+	}
+	if outputFormat != "tar" {
+		usageErrorf("--image, --oci-layout: may not be used with -F %s", outputFormat)
+	}
+
+	imageBase = map[string]any{}
+	if appendDir != "" {
+		loadAppendImage()
+	} else if imageConfig != "" {
+		p, err := os.ReadFile(imageConfig)
+		failOnError("--image-config: cannot read config", err)
+		failOnError("--image-config: cannot parse config", json.Unmarshal(p, &imageBase))
+	}
+	// Layers are read once all files are added, after -C may have changed the working directory.
+	for i, p := range imageLayers {
+		_, err := os.Stat(p)
+		failOnError("--image-layer: cannot read layer", err)
+		imageLayers[i], err = filepath.Abs(p)
+		failOnError("--image-layer: cannot read layer", err)
+	}
+	for _, kv := range append(imageEnv, imageLabels...) {
+		if !strings.Contains(kv, "=") {
+			usageErrorf("--image-env, --image-label: expected KEY=VALUE, got %q", kv)
+		}
+	}
+	for _, s := range []string{imageEntry, imageCmd} {
+		if _, err := parseImageCommand(s); err != nil {
+			usageErrorf("--image-entrypoint, --image-cmd: cannot parse %q: %v", s, err)
+		}
+	}
+}
+
+// imageStore is where the blobs and metadata files of an image are written.
+type imageStore interface {
+	// addSpool adds the layer written to s.
+	addSpool(s *layerSpool) blob
+	// addLayer adds the layer in the file at path p.
+	addLayer(p string) blob
+	addBlob(mediaType string, p []byte) blob
+	writeFile(name string, p []byte)
+}
+
+// layerSpool is a temporary file that a layer is written to. Its digest is computed as it's
+// written.
+type layerSpool struct {
+	f *os.File
+	h hash.Hash
+	n int64
+}
+
+func newLayerSpool(dir string) *layerSpool {
+	f, err := os.CreateTemp(dir, ".mtar-layer-*.tmp")
+	failOnError("--image: cannot create layer file", err)
+	return &layerSpool{f: f, h: sha256.New()}
+}
+
+func (s *layerSpool) Write(p []byte) (int, error) {
+	n, err := s.f.Write(p)
+	s.h.Write(p[:n])
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *layerSpool) blob() blob {
+	return blob{MediaType: mediaTypeLayer, Digest: "sha256:" + hex.EncodeToString(s.h.Sum(nil)), Size: s.n}
+}
+
+func (s *layerSpool) remove() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+// createImageLayer creates the temporary file that the layer is written to.
+func createImageLayer() io.Writer {
+	dir := ""
+	if ociLayout != "" {
+		dir = filepath.Join(ociLayout, "blobs", "sha256")
+		failOnError("--oci-layout: cannot create layout", os.MkdirAll(dir, 0777))
+	}
+	imageSpool = newLayerSpool(dir)
+	return imageSpool
+}
+
+// writeImage writes the image: the lower layers and spooled layer, its config, and its manifest.
+// With --oci-layout, the image is added to the layout directory. Otherwise, it's written to w in
+// both OCI image layout and docker save formats, so the result can be loaded by docker load or
+// read as an OCI image layout.
+func writeImage(w io.Writer) {
+	if imageSpool == nil {
+		return
+	}
+
+	var store imageStore
+	var tw *tar.Writer
+	if ociLayout != "" {
+		store = layoutStore{}
+	} else {
+		tw = tar.NewWriter(w)
+		writeDir(tw, "blobs/")
+		writeDir(tw, "blobs/sha256/")
+		store = &tarStore{tw: tw, written: map[string]bool{}}
+	}
+
+	layers := append([]blob{}, appendLayers...)
+	diffIDs := append([]string{}, appendDiffIDs...)
+	for _, p := range imageLayers {
+		layers = append(layers, store.addLayer(p))
+	}
+	layers = append(layers, store.addSpool(imageSpool))
+	for _, l := range layers[len(appendLayers):] {
+		diffIDs = append(diffIDs, l.Digest)
+	}
+
+	config := store.addBlob(mediaTypeConfig, imageConfigJSON(diffIDs))
+	manifest := store.addBlob(mediaTypeManifest, mustJSON(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeManifest,
+		"config":        config,
+		"layers":        layers,
+	}))
+
+	var manifests []blob
+	for _, tag := range imageTags {
+		if appendDir != "" {
+			break // Tags select the image to append to
+		}
+		m := manifest
+		m.Annots = map[string]string{
+			"io.containerd.image.name":          tag,
+			"org.opencontainers.image.ref.name": tagName(tag),
+		}
+		manifests = append(manifests, m)
+	}
+	if len(manifests) == 0 {
+		manifests = append(manifests, manifest)
+	}
+	if appendDir != "" {
+		manifests = appendedIndex(manifest)
+	} else if ociLayout != "" {
+		manifests = mergeIndex(manifests)
+	}
+
+	store.writeFile("oci-layout", mustJSON(map[string]string{"imageLayoutVersion": "1.0.0"}))
+	store.writeFile("index.json", mustJSON(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeIndex,
+		"manifests":     manifests,
+	}))
+	if tw == nil {
+		return
+	}
+
+	layerPaths := make([]string, len(layers))
+	for i, l := range layers {
+		layerPaths[i] = l.path()
+	}
+	store.writeFile("manifest.json", mustJSON([]map[string]any{{
+		"Config":   config.path(),
+		"RepoTags": append([]string{}, imageTags...),
+		"Layers":   layerPaths,
+	}}))
+	failOnError("--image: error writing image", tw.Close())
+}
+
+// imageConfigJSON returns the image config: the base config with the options given and the
+// rootfs replaced by diffIDs.
+func imageConfigJSON(diffIDs []string) []byte {
+	cfg := imageBase
+	if imagePlatform != "" {
+		parts := strings.SplitN(imagePlatform, "/", 3)
+		cfg["os"] = parts[0]
+		delete(cfg, "architecture")
+		delete(cfg, "variant")
+		if len(parts) > 1 {
+			cfg["architecture"] = parts[1]
+		}
+		if len(parts) > 2 {
+			cfg["variant"] = parts[2]
+		}
+	}
+	if _, ok := cfg["os"]; !ok {
+		cfg["os"] = "linux"
+	}
+	if _, ok := cfg["architecture"]; !ok {
+		cfg["architecture"] = runtime.GOARCH
+	}
+	created := startupTime.UTC().Format("2006-01-02T15:04:05.999999999Z07:00")
+	cfg["created"] = created
+	cfg["rootfs"] = map[string]any{"type": "layers", "diff_ids": diffIDs}
+
+	// Keep the base history only if it still describes the lower layers. When appending, the
+	// lower layers are the image's own, and --image-layer adds more above them.
+	history, _ := cfg["history"].([]any)
+	lower, lowerBy, added := len(imageLayers), "mtar --image-layer", 0
+	if appendDir != "" {
+		lower, lowerBy, added = len(appendLayers), "", len(imageLayers)
+	}
+	if countLayerHistory(history) != lower {
+		history = nil
+		for i := 0; i < lower; i++ {
+			history = append(history, map[string]any{"created": created, "created_by": lowerBy})
+		}
+	}
+	for i := 0; i < added; i++ {
+		history = append(history, map[string]any{"created": created, "created_by": "mtar --image-layer"})
+	}
+	cfg["history"] = append(history, map[string]any{"created": created, "created_by": "mtar"})
+
+	run, _ := cfg["config"].(map[string]any)
+	if run == nil {
+		run = map[string]any{}
+	}
+	if len(imageEnv) > 0 {
+		run["Env"] = mergeEnv(run["Env"], imageEnv)
+	}
+	if len(imageLabels) > 0 {
+		labels, _ := run["Labels"].(map[string]any)
+		if labels == nil {
+			labels = map[string]any{}
+		}
+		for _, kv := range imageLabels {
+			k, v, _ := strings.Cut(kv, "=")
+			labels[k] = v
+		}
+		run["Labels"] = labels
+	}
+	if imageEntry != "" {
+		run["Entrypoint"], _ = parseImageCommand(imageEntry)
+		// As with a Dockerfile, setting the entrypoint resets the base command.
+		delete(run, "Cmd")
+	}
+	if imageCmd != "" {
+		run["Cmd"], _ = parseImageCommand(imageCmd)
+	}
+	if imageWorkdir != "" {
+		run["WorkingDir"] = imageWorkdir
+	}
+	if imageUser != "" {
+		run["User"] = imageUser
+	}
+	cfg["config"] = run
+	return mustJSON(cfg)
+}
+
+// countLayerHistory returns the number of history entries that have a layer.
+func countLayerHistory(history []any) (n int) {
+	for _, h := range history {
+		if h, ok := h.(map[string]any); ok && h["empty_layer"] != true {
+			n++
+		}
+	}
+	return n
+}
+
+// mergeEnv returns base with each KEY=VALUE in env set, replacing any existing value of KEY.
+func mergeEnv(base any, env []string) []string {
+	var merged []string
+	if list, ok := base.([]any); ok {
+		for _, kv := range list {
+			if s, ok := kv.(string); ok {
+				merged = append(merged, s)
+			}
+		}
+	}
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		i := 0
+		for i < len(merged) && !strings.HasPrefix(merged[i], k+"=") {
+			i++
+		}
+		if i < len(merged) {
+			merged[i] = kv
+		} else {
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
+
+// parseImageCommand parses an entrypoint or command. A JSON array is used as-is. Anything else is
+// run with /bin/sh -c, as in a Dockerfile.
+func parseImageCommand(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		var argv []string
+		err := json.Unmarshal([]byte(s), &argv)
+		return argv, err
+	}
+	return []string{"/bin/sh", "-c", s}, nil
+}
+
+// tagName returns the tag of an image name, or latest if it has none.
+func tagName(name string) string {
+	if i := strings.LastIndexAny(name, ":/"); i > -1 && name[i] == ':' {
+		return name[i+1:]
+	}
+	return "latest"
+}
+
+func mustJSON(v any) []byte {
+	p, err := json.Marshal(v)
+	failOnError("--image: cannot encode JSON", err)
+	return p
+}
+
+// tarStore writes an image to a tar file.
+type tarStore struct {
+	tw      *tar.Writer
+	written map[string]bool // Digests of blobs written
+}
+
+func (t *tarStore) addSpool(s *layerSpool) blob {
+	defer s.remove()
+	b := s.blob()
+	_, err := s.f.Seek(0, io.SeekStart)
+	failOnError("--image: cannot read layer", err)
+	t.copyBlob(b, s.f)
+	return b
+}
+
+// addLayer adds the layer at p. The file is read twice: once to find its digest, and again to copy
+// it.
+func (t *tarStore) addLayer(p string) blob {
+	f, err := os.Open(p)
+	failOnError("--image-layer: cannot open layer", err)
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	failOnError("--image-layer: cannot read layer "+p, err)
+	_, err = f.Seek(0, io.SeekStart)
+	failOnError("--image-layer: cannot read layer "+p, err)
+
+	b := blob{MediaType: mediaTypeLayer, Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: size}
+	t.copyBlob(b, f)
+	return b
+}
+
+func (t *tarStore) copyBlob(b blob, r io.Reader) {
+	if t.written[b.Digest] {
+		return
+	}
+	t.written[b.Digest] = true
+
+	failOnError("--image: error writing image", t.tw.WriteHeader(imageHeader(b.path(), b.Size)))
+	n, err := io.Copy(t.tw, io.LimitReader(r, b.Size))
+	if err == nil && n != b.Size {
+		err = fmt.Errorf("layer changed size while writing (%d of %d bytes)", n, b.Size)
+	}
+	failOnError("--image: error writing layer", err)
+}
+
+func (t *tarStore) addBlob(mediaType string, p []byte) blob {
+	b := bytesBlob(mediaType, p)
+	if !t.written[b.Digest] {
+		t.written[b.Digest] = true
+		t.writeFile(b.path(), p)
+	}
+	return b
+}
+
+func (t *tarStore) writeFile(name string, p []byte) {
+	writeImageFile(t.tw, name, p)
+}
+
+func bytesBlob(mediaType string, p []byte) blob {
+	sum := sha256.Sum256(p)
+	return blob{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(p))}
+}
+
+func writeImageFile(tw *tar.Writer, name string, p []byte) {
+	failOnError("--image: error writing image", tw.WriteHeader(imageHeader(name, int64(len(p)))))
+	_, err := tw.Write(p)
+	failOnError("--image: error writing image", err)
+}
+
+func writeDir(tw *tar.Writer, name string) {
+	hdr := imageHeader(name, 0)
+	hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+	failOnError("--image: error writing image", tw.WriteHeader(hdr))
+}
+
+func imageHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  startupTime,
+		Format:   tar.FormatPAX,
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Whiteout prefixes for OCI image layers. A file named .wh.NAME hides NAME in lower layers, and a
+// file named .wh..wh..opq hides every lower entry in its directory.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// layerBase, if set, is a tar archive or manifest of the layers below the one being written. Paths
+// in it that aren't written are deleted with whiteouts once all files have been added.
+var layerBase string
+
+// basePaths is the set of paths read from layerBase, mapped to whether they're directories.
+var basePaths map[string]bool
+
+// loadLayerBase reads the layer base into basePaths. It's read before any files are added, since
+// -C may change the working directory.
+func loadLayerBase() {
+	var err error
+	basePaths, err = readLayerBase(layerBase)
+	failOnError("--layer-base: cannot read base", err)
+}
+
+// readLayerBase reads the paths in the base at p, mapped to whether they're directories. If p is a
+// tar archive, whiteouts in it are applied. Otherwise, p is a manifest listing one path per line,
+// with directories ending in a slash.
+func readLayerBase(p string) (map[string]bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if block, err := br.Peek(512); err == nil && string(block[257:262]) == "ustar" {
+		return readBaseArchive(br)
+	}
+
+	paths := map[string]bool{}
+	sc := bufio.NewScanner(br)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name := layerPath(line); name != "" {
+			paths[name] = strings.HasSuffix(line, "/")
+		}
+	}
+	return paths, sc.Err()
+}
+
+func readBaseArchive(r io.Reader) (map[string]bool, error) {
+	paths := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return paths, nil
+		} else if err != nil {
+			return nil, err
+		}
+		name := layerPath(hdr.Name)
+		dir, base := path.Split(name)
+		switch {
+		case name == "":
+		case base == whiteoutOpaque:
+			deleteBasePaths(paths, path.Clean(dir), false)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleteBasePaths(paths, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true)
+		default:
+			paths[name] = hdr.Typeflag == tar.TypeDir
+		}
+	}
+}
+
+// deleteBasePaths removes everything under p from paths, and p itself if self is set.
+func deleteBasePaths(paths map[string]bool, p string, self bool) {
+	if self {
+		delete(paths, p)
+	}
+	for name := range paths {
+		if strings.HasPrefix(name, p+"/") || p == "." {
+			delete(paths, name)
+		}
+	}
+}
+
+// layerPath normalizes an entry name for comparison between layers. It returns an empty string
+// for the root directory.
+func layerPath(name string) string {
+	name = path.Clean(strings.TrimPrefix(path.Clean("/"+name), "/"))
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// writeWhiteouts writes whiteouts for every path in the layer base that wasn't written. Where a
+// directory is deleted, only the directory is whited out. Where every path in a surviving
+// directory is deleted, a single opaque whiteout is written for the directory instead.
+func writeWhiteouts(w ArchiveWriter) {
+	if basePaths == nil || precomputing {
+		return
+	}
+	base := basePaths
+	present := map[string]bool{}
+	for name := range written {
+		if p := layerPath(name); p != "" {
+			present[p] = true
+		}
+	}
+	for name := range unchanged {
+		present[layerPath(name)] = true
+	}
+
+	// Group deleted paths by parent, skipping those whose parent is deleted too.
+	deleted := map[string][]string{}
+	children := map[string]int{}
+	for p := range base {
+		parent := path.Dir(p)
+		children[parent]++
+		if present[p] {
+			continue
+		}
+		if _, ok := base[parent]; ok && !present[parent] {
+			continue
+		}
+		deleted[parent] = append(deleted[parent], p)
+	}
+
+	parents := make([]string, 0, len(deleted))
+	for parent := range deleted {
+		parents = append(parents, parent)
+	}
+	sort.Strings(parents)
+
+	for _, parent := range parents {
+		paths := deleted[parent]
+		if len(paths) > 1 && len(paths) == children[parent] {
+			writeBaseWhiteout(w, path.Join(parent, whiteoutOpaque))
+			continue
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			writeBaseWhiteout(w, path.Join(parent, whiteoutPrefix+path.Base(p)))
+		}
+	}
+}
+
+// writeBaseWhiteout writes a whiteout for the layer base unless the same whiteout was already
+// added explicitly.
+func writeBaseWhiteout(w ArchiveWriter, name string) {
+	if _, ok := written[name]; !ok {
+		writeWhiteout(w, name, nil)
+	}
+}
+
+// addWhiteout adds a whiteout for the entry named by dest, or by src if dest is empty. With the
+// opaque option, the whiteout hides everything below the entry instead of the entry itself.
+func addWhiteout(w ArchiveWriter, src, dest string, opts *FileOpts) {
+	name := entryName(src, dest)
+	if opts.opaque {
+		name = path.Join(name, whiteoutOpaque)
+	} else if name == "." {
+		usageErrorf("whiteout: cannot white out the root directory")
+	} else {
+		name = path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+	}
+	if shouldSkip(skipDestGlobs, name) {
+		return
+	}
+	writeWhiteout(w, name, opts)
+}
+
+func writeWhiteout(w ArchiveWriter, name string, opts *FileOpts) {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		ModTime:  startupTime,
+		Format:   hdrFormat,
+	}
+	// There's no file to take ownership from, so only options set it.
+	if opts != nil && opts.user != nil {
+		hdr.Uid, _ = numericID(opts.user.Uid)
+		hdr.Uname = opts.user.Username
+	}
+	if opts != nil && opts.group != nil {
+		hdr.Gid, _ = numericID(opts.group.Gid)
+		hdr.Gname = opts.group.Name
+	}
+	opts.setHeaderFields(hdr)
+
+	if precomputing {
+		written[hdr.Name] = struct{}{}
+		totals.entries++
+		return
+	}
+	if !withinLimits(hdr) {
+		return
+	}
+	failOnError("write header: "+name, writeHeader(w, hdr))
+}
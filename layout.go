@@ -0,0 +1,137 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// layoutStore adds an image to the OCI image layout directory ociLayout. Blobs are written to
+// temporary files in the layout's blob directory, hashed as they're written, and renamed to their
+// digests once complete.
+type layoutStore struct{}
+
+func (layoutStore) addSpool(s *layerSpool) blob {
+	b := s.blob()
+	err := s.f.Close()
+	if err == nil && fsyncOutput {
+		err = syncPath(s.f.Name())
+	}
+	if err == nil {
+		err = os.Rename(s.f.Name(), layoutPath(b.path()))
+	}
+	if err != nil {
+		os.Remove(s.f.Name())
+	}
+	failOnError("--oci-layout: cannot write layer", err)
+	return b
+}
+
+func (l layoutStore) addLayer(p string) blob {
+	f, err := os.Open(p)
+	failOnError("--image-layer: cannot open layer", err)
+	defer f.Close()
+
+	s := newLayerSpool(layoutPath("blobs/sha256"))
+	if _, err = io.Copy(s, f); err != nil {
+		s.remove()
+		failOnError("--image-layer: cannot copy layer "+p, err)
+	}
+	return l.addSpool(s)
+}
+
+func (l layoutStore) addBlob(mediaType string, p []byte) blob {
+	b := bytesBlob(mediaType, p)
+	if _, err := os.Stat(layoutPath(b.path())); err != nil {
+		l.writeFile(b.path(), p)
+	}
+	return b
+}
+
+// writeFile writes a file in the layout, replacing it atomically if it exists.
+func (layoutStore) writeFile(name string, p []byte) {
+	dest := layoutPath(name)
+	tmp := dest + ".tmp"
+	err := writeStateFile(tmp, p)
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err == nil && fsyncOutput {
+		err = syncDir(filepath.Dir(dest))
+	}
+	failOnError("--oci-layout: cannot write "+name, err)
+}
+
+func layoutPath(name string) string {
+	return filepath.Join(ociLayout, filepath.FromSlash(name))
+}
+
+// mergeIndex returns the manifests of the layout's existing index.json, if any, followed by
+// manifests. Existing manifests with the same reference name as a new one are dropped, so that
+// tags move to the new image.
+func mergeIndex(manifests []blob) []blob {
+	p, err := os.ReadFile(layoutPath("index.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return manifests
+	}
+	failOnError("--oci-layout: cannot read index.json", err)
+
+	var index struct {
+		Manifests []blob `json:"manifests"`
+	}
+	failOnError("--oci-layout: cannot parse index.json", json.Unmarshal(p, &index))
+
+	names := map[string]bool{}
+	for _, m := range manifests {
+		if name := m.Annots["org.opencontainers.image.ref.name"]; name != "" {
+			names[name] = true
+		}
+	}
+	var merged []blob
+	for _, m := range index.Manifests {
+		if !names[m.Annots["org.opencontainers.image.ref.name"]] {
+			merged = append(merged, m)
+		}
+	}
+	return append(merged, manifests...)
+}
+
+// syncPath syncs the file at p to disk.
+func syncPath(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
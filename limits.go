@@ -0,0 +1,89 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"sync/atomic"
+)
+
+// limitPolicy controls what happens when adding an entry would exceed a limit.
+type limitPolicy int
+
+const (
+	limitAbort limitPolicy = iota // Exit with an error
+	limitStop                     // Stop adding entries and finish the archive
+)
+
+var (
+	limitEntries int64 // Maximum number of entries (0 for no limit)
+	limitSize    int64 // Maximum size of the output in bytes (0 for no limit)
+	limitAction  = limitAbort
+
+	limitReached bool // Set once a limit is reached under limitStop
+)
+
+// withinLimits returns whether hdr can be added without exceeding the entry or size limits. If it
+// can't, then depending on the limit policy, either mtar exits or the entry is recorded as
+// skipped and false is returned. Once a limit is reached, all later entries are skipped.
+func withinLimits(hdr *tar.Header) bool {
+	if precomputing || (limitEntries <= 0 && limitSize <= 0) {
+		return true
+	}
+
+	var reason string
+	switch {
+	case limitReached:
+		reason = "limit reached"
+	case limitEntries > 0 && atomic.LoadInt64(&stats.entries) >= limitEntries:
+		reason = fmt.Sprintf("entry limit of %d reached", limitEntries)
+	case limitSize > 0 && atomic.LoadInt64(&stats.outBytes)+entrySize(hdr) > limitSize:
+		reason = fmt.Sprintf("size limit of %d bytes reached", limitSize)
+	default:
+		return true
+	}
+
+	if limitAction == limitAbort {
+		fatalf("cannot add %s: %s", hdr.Name, reason)
+	}
+	if !limitReached {
+		warnf("%s: no more entries will be added", reason)
+		limitReached = true
+	}
+	recordSkip(hdr.Name, skipLimit, reason, nil)
+	return false
+}
+
+// entrySize returns the minimum number of bytes hdr takes up in the archive, including its
+// content. Extended headers are not counted.
+func entrySize(hdr *tar.Header) int64 {
+	const blockSize = 512
+	size := int64(blockSize)
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		size += (hdr.Size + blockSize - 1) / blockSize * blockSize
+	}
+	return size
+}
@@ -0,0 +1,422 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// listPath is the archive read by -t, or "-" for standard input.
+	listPath = "-"
+
+	// listLong controls whether -t lists entries in long format, as set by -v or -tv.
+	listLong bool
+
+	// listJSON controls whether -t lists entries as JSON objects, as set by --list-format=json.
+	listJSON bool
+
+	// listColor controls whether -t colors entry names by type: "auto" (if standard output is a
+	// terminal), "always", or "never".
+	listColor = "auto"
+
+	// listColors are the SGR sequences that names are colored with, by LS_COLORS key.
+	listColors = map[string]string{
+		"di": "01;34", // Directory
+		"ln": "01;36", // Symlink
+		"pi": "33",    // FIFO
+		"bd": "01;33", // Block device
+		"cd": "01;33", // Character device
+		"ex": "01;32", // Executable
+		"su": "37;41", // Setuid
+		"sg": "30;43", // Setgid
+	}
+)
+
+// listRecord is an entry listed by -t --list-format=json.
+type listRecord struct {
+	Name       string            `json:"name"`
+	Typeflag   string            `json:"typeflag"`
+	Size       int64             `json:"size"`
+	Mode       string            `json:"mode"`
+	Uid        int               `json:"uid"`
+	Gid        int               `json:"gid"`
+	Uname      string            `json:"uname,omitempty"`
+	Gname      string            `json:"gname,omitempty"`
+	Linkname   string            `json:"linkname,omitempty"`
+	Devmajor   int64             `json:"devmajor,omitempty"`
+	Devminor   int64             `json:"devminor,omitempty"`
+	ModTime    *time.Time        `json:"mtime,omitempty"`
+	AccessTime *time.Time        `json:"atime,omitempty"`
+	ChangeTime *time.Time        `json:"ctime,omitempty"`
+	PAXRecords map[string]string `json:"pax,omitempty"`
+}
+
+// newListRecord returns the listRecord for hdr.
+func newListRecord(hdr *tar.Header) *listRecord {
+	timePtr := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		t = t.In(timeZone)
+		return &t
+	}
+	return &listRecord{
+		Name:       hdr.Name,
+		Typeflag:   string(hdr.Typeflag),
+		Size:       hdr.Size,
+		Mode:       fmt.Sprintf("%04o", hdr.Mode),
+		Uid:        hdr.Uid,
+		Gid:        hdr.Gid,
+		Uname:      hdr.Uname,
+		Gname:      hdr.Gname,
+		Linkname:   hdr.Linkname,
+		Devmajor:   hdr.Devmajor,
+		Devminor:   hdr.Devminor,
+		ModTime:    timePtr(hdr.ModTime),
+		AccessTime: timePtr(hdr.AccessTime),
+		ChangeTime: timePtr(hdr.ChangeTime),
+		PAXRecords: hdr.PAXRecords,
+	}
+}
+
+func listUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar t [-h|--help] [-v] [-f PATH] [FILTER]...
+       mtar tv [-h|--help] [-f PATH] [FILTER]...
+
+The t and tv commands may also be given as -t and -tv.
+
+Lists the names of the entries in the archive read from standard input (or the
+file given by -f) on standard output. The archive may be compressed with gzip,
+zstd, xz, bzip2, or lz4.
+
+With -v (or tv), entries are listed in long format, as 'tar -tv' does: the
+type and permissions, owner and group, size (or device numbers), modification
+time, and name, followed by the target of a symlink or hard link. Owners and
+groups are listed by name, or by id if the archive has no name. Times are
+listed in the local time zone, or the zone given by --timezone.
+
+Filters (-i, -I, -o, -O, -Ri, -Ro, and -R) select which entries are listed, the
+same as when writing an archive, except that input and output filters are both
+tested against entry names. Unlike when writing an archive, filters apply to
+every entry regardless of their order.
+
+Options:
+
+  -f PATH | --file=PATH
+    Read the archive from PATH. If PATH is '-', it's read from standard
+    input. (default: -)
+  -v
+    List entries in long format.
+  --list-format=FORMAT
+    Set the format entries are listed in: 'text' (default) or 'json'. In
+    json format, each entry is listed as a JSON object on its own line,
+    with the fields name, typeflag, size, mode (in octal), uid, gid,
+    uname, gname, linkname, devmajor, devminor, mtime, atime, and ctime
+    (in RFC 3339 format), and pax (an object of the entry's PAX records).
+    Empty fields other than name, typeflag, size, mode, uid, and gid are
+    omitted.
+  --color=WHEN
+    Color entry names by type, as 'ls --color' does: 'auto' (default) to
+    color them if standard output is a terminal, 'always', or 'never'.
+    Colors are taken from LS_COLORS, if set (e.g., di=01;34 for
+    directories, ln for symlinks, ex for executables). With 'auto', names
+    aren't colored if NO_COLOR is set.
+  --timezone=ZONE
+    List times in the IANA time zone ZONE (e.g., UTC or America/Chicago).
+`)
+}
+
+// listLongArchive lists the entries of an archive in long format, as selected by tv.
+func listLongArchive(argv Args) {
+	listLong = true
+	listArchive(argv)
+}
+
+// listArchive lists the entries of an archive, as selected by t.
+func listArchive(argv Args) {
+	for s, ok := argv.Shift(); ok; s, ok = argv.Shift() {
+		switch {
+		case s == "-h", s == "--help":
+			listUsage()
+			exit(exitUsage)
+		case s == "-f":
+			if listPath, ok = argv.Shift(); !ok {
+				usageErrorf("-t: %s: missing argument", s)
+			}
+		case strings.HasPrefix(s, "--file="):
+			listPath = strings.TrimPrefix(s, "--file=")
+		case s == "-v":
+			listLong = true
+		case strings.HasPrefix(s, "--color="):
+			switch listColor = strings.TrimPrefix(s, "--color="); listColor {
+			case "auto", "always", "never":
+			default:
+				usageErrorf("-t: --color: expected auto, always, or never, got %q", listColor)
+			}
+		case strings.HasPrefix(s, "--list-format="):
+			switch format := strings.TrimPrefix(s, "--list-format="); format {
+			case "text":
+				listJSON = false
+			case "json":
+				listJSON = true
+			default:
+				usageErrorf("-t: --list-format: unrecognized format %q", format)
+			}
+		case strings.HasPrefix(s, "--timezone="):
+			loc, err := time.LoadLocation(strings.TrimPrefix(s, "--timezone="))
+			failOnUsageError("-t: --timezone", err)
+			timeZone = loc
+		case isFilterOption(s):
+			addFilter(s, &argv)
+		default:
+			usageErrorf("-t: unexpected argument %q", s)
+		}
+	}
+
+	in := os.Stdin
+	if listPath != "-" {
+		f, err := os.Open(listPath)
+		failOnError("-t: cannot open archive", err)
+		defer f.Close()
+		in = f
+	}
+	r, err := decompressedReader(bufio.NewReader(in))
+	failOnError("-t: cannot read archive", err)
+
+	color := listColor == "always" ||
+		listColor == "auto" && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+	if color {
+		loadLSColors()
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		failOnError("-t: error reading tar header", err)
+		if hdr.Typeflag == tar.TypeXGlobalHeader || !matchesFilters(hdr.Name) {
+			continue
+		}
+		if listJSON {
+			failOnError("-t: error writing listing", enc.Encode(newListRecord(hdr)))
+			continue
+		}
+		line := hdr.Name
+		if color {
+			line = colorName(hdr)
+		}
+		if listLong {
+			line = longListingName(hdr, line)
+		}
+		_, err = fmt.Fprintln(w, line)
+		failOnError("-t: error writing listing", err)
+	}
+	failOnError("-t: error writing listing", w.Flush())
+}
+
+// loadLSColors overrides listColors with the colors set in LS_COLORS, which has the form
+// KEY=SGR:KEY=SGR:....
+func loadLSColors() {
+	for _, field := range strings.Split(os.Getenv("LS_COLORS"), ":") {
+		key, sgr, ok := strings.Cut(field, "=")
+		if _, known := listColors[key]; ok && known {
+			listColors[key] = sgr
+		}
+	}
+}
+
+// colorName returns the name of hdr wrapped in the color for its type, if it has one.
+func colorName(hdr *tar.Header) string {
+	var key string
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		key = "di"
+	case tar.TypeSymlink:
+		key = "ln"
+	case tar.TypeFifo:
+		key = "pi"
+	case tar.TypeBlock:
+		key = "bd"
+	case tar.TypeChar:
+		key = "cd"
+	case tar.TypeReg, tar.TypeRegA:
+		switch {
+		case hdr.Mode&04000 != 0:
+			key = "su"
+		case hdr.Mode&02000 != 0:
+			key = "sg"
+		case hdr.Mode&0111 != 0:
+			key = "ex"
+		}
+	}
+	sgr := listColors[key]
+	if sgr == "" {
+		return hdr.Name
+	}
+	return "\x1b[" + sgr + "m" + hdr.Name + "\x1b[0m"
+}
+
+// matchesFilters returns whether name passes all input and output filters.
+func matchesFilters(name string) bool {
+	for _, set := range [][]Matcher{skipSrcGlobs, skipDestGlobs} {
+		for _, m := range set {
+			if !m.matches(name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// headerTypeName returns the name of the type of the entry hdr, as logged for -v and --log-json.
+func headerTypeName(hdr *tar.Header) string {
+	if hdr.Typeflag == tar.TypeLink {
+		return "link"
+	}
+	return entryTypeName(hdr.Typeflag)
+}
+
+// listEntry writes hdr to stderr as it is added to the archive, if verbose. At verbosity 1, only
+// the entry name is written. At 2 or higher, the entry is written in long format.
+func listEntry(hdr *tar.Header) {
+	if verbosity < 1 || precomputing {
+		return
+	}
+	if logJSON {
+		size := hdr.Size
+		writeLogRecord(&logRecord{Level: levelInfo, Msg: "added", Path: hdr.Name, Type: headerTypeName(hdr), Size: &size})
+		return
+	}
+
+	line := hdr.Name
+	if verbosity >= 2 {
+		line = longListing(hdr)
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	_, _ = fmt.Fprintln(logOutput, line)
+}
+
+// longListing formats hdr in the same style as 'tar -tv'.
+func longListing(hdr *tar.Header) string {
+	return longListingName(hdr, hdr.Name)
+}
+
+// longListingName formats hdr in the same style as 'tar -tv', with name in place of its name (e.g.,
+// to color it).
+func longListingName(hdr *tar.Header, name string) string {
+	owner := hdr.Uname
+	if owner == "" {
+		owner = strconv.Itoa(hdr.Uid)
+	}
+	group := hdr.Gname
+	if group == "" {
+		group = strconv.Itoa(hdr.Gid)
+	}
+
+	size := strconv.FormatInt(hdr.Size, 10)
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		size = strconv.FormatInt(hdr.Devmajor, 10) + "," + strconv.FormatInt(hdr.Devminor, 10)
+	}
+
+	// Pad the size so that the owner/group and size columns take up at least 19 characters, as GNU
+	// tar does.
+	width := 17 - len(owner) - len(group)
+	if width < len(size) {
+		width = len(size)
+	}
+	line := fmt.Sprintf("%s %s/%s %*s %s %s",
+		modeString(hdr), owner, group, width, size,
+		hdr.ModTime.In(timeZone).Format("2006-01-02 15:04"),
+		name,
+	)
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		line += " -> " + hdr.Linkname
+	case tar.TypeLink:
+		line += " link to " + hdr.Linkname
+	}
+	return line
+}
+
+// modeString returns the type and permissions of hdr as a string, as used by ls -l.
+func modeString(hdr *tar.Header) string {
+	var b [10]byte
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		b[0] = 'd'
+	case tar.TypeSymlink:
+		b[0] = 'l'
+	case tar.TypeLink:
+		b[0] = 'h'
+	case tar.TypeChar:
+		b[0] = 'c'
+	case tar.TypeBlock:
+		b[0] = 'b'
+	case tar.TypeFifo:
+		b[0] = 'p'
+	default:
+		b[0] = '-'
+	}
+
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if hdr.Mode&(1<<uint(8-i)) != 0 {
+			b[i+1] = rwx[i]
+		} else {
+			b[i+1] = '-'
+		}
+	}
+
+	special := func(bit int64, i int, set, unset byte) {
+		if hdr.Mode&bit == 0 {
+			return
+		} else if b[i] == '-' {
+			b[i] = unset
+		} else {
+			b[i] = set
+		}
+	}
+	special(04000, 3, 's', 'S')
+	special(02000, 6, 's', 'S')
+	special(01000, 9, 't', 'T')
+	return string(b[:])
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Log levels.
+const (
+	levelDebug   = "debug"
+	levelInfo    = "info"
+	levelWarning = "warning"
+	levelError   = "error"
+)
+
+var (
+	logJSON bool // Whether to write log records as JSON
+
+	// verbosity controls which messages are logged. At -1, only errors are logged. At 2 or
+	// higher, debug messages are logged.
+	verbosity int
+
+	// logLevel, if set by --log-level, is the least severe level logged, in place of the level
+	// set by verbosity.
+	logLevel string
+
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr // Where log records are written
+)
+
+// logRecord is a log message as written when logging JSON.
+type logRecord struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+	Op    string    `json:"op,omitempty"`
+	Path  string    `json:"path,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Errno int       `json:"errno,omitempty"`
+
+	// Type and Size are set on records of entries listed by -v.
+	Type string `json:"type,omitempty"`
+	Size *int64 `json:"size,omitempty"`
+}
+
+// logWriter is the output of the standard logger. It writes log lines to logOutput, converting
+// them to info records when logging JSON.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	if !logEnabled(levelInfo) {
+		return len(p), nil
+	} else if logJSON {
+		writeLogRecord(&logRecord{Level: levelInfo, Msg: strings.TrimSuffix(string(p), "\n")})
+		return len(p), nil
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	return logOutput.Write(p)
+}
+
+func setLogOutput(w io.Writer) {
+	logMu.Lock()
+	logOutput = w
+	logMu.Unlock()
+}
+
+// logEvent logs msg at the given level. If err is not nil, its message is appended to msg in text
+// logs. In JSON logs, the operation, path, and errno of err are included if it has them. If path
+// is not empty, it's used in place of any path in err.
+func logEvent(level, path, msg string, err error) {
+	if level == levelWarning || level == levelError {
+		logEventRecord(level, path, msg, err)
+	}
+	if !logEnabled(level) {
+		return
+	} else if !logJSON {
+		if level == levelDebug {
+			msg = "debug: " + msg
+		}
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		logMu.Lock()
+		defer logMu.Unlock()
+		_, _ = fmt.Fprintf(logOutput, "%s%s\n", log.Prefix(), msg)
+		return
+	}
+
+	rec := &logRecord{Level: level, Msg: msg, Path: path}
+	if err != nil {
+		rec.Error = err.Error()
+		var pe *os.PathError
+		var le *os.LinkError
+		var se *os.SyscallError
+		switch {
+		case errors.As(err, &pe):
+			rec.Op = pe.Op
+			if rec.Path == "" {
+				rec.Path = pe.Path
+			}
+		case errors.As(err, &le):
+			rec.Op = le.Op
+			if rec.Path == "" {
+				rec.Path = le.Old
+			}
+		case errors.As(err, &se):
+			rec.Op = se.Syscall
+		}
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			rec.Errno = int(errno)
+		}
+	}
+	writeLogRecord(rec)
+}
+
+func writeLogRecord(rec *logRecord) {
+	rec.Time = time.Now().UTC()
+	p, err := json.Marshal(rec)
+	if err != nil {
+		// Shouldn't happen, but don't lose the message if it does.
+		p = []byte(fmt.Sprintf(`{"level":%q,"msg":%q}`, levelError, "cannot encode log record: "+err.Error()))
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	_, _ = logOutput.Write(append(p, '\n'))
+}
+
+// levelSeverity orders log levels from least to most severe.
+var levelSeverity = map[string]int{
+	levelDebug:   0,
+	levelInfo:    1,
+	levelWarning: 2,
+	levelError:   3,
+}
+
+// setLogLevel sets the least severe level logged, as given to --log-level.
+func setLogLevel(level string) {
+	if level == "warn" {
+		level = levelWarning
+	}
+	if _, ok := levelSeverity[level]; !ok {
+		usageErrorf("--log-level: unrecognized level %q (debug, info, warn, error)", level)
+	}
+	logLevel = level
+}
+
+// logEnabled returns whether messages at level are logged at the current log level or verbosity.
+func logEnabled(level string) bool {
+	if logLevel != "" {
+		return levelSeverity[level] >= levelSeverity[logLevel]
+	}
+	switch level {
+	case levelError:
+		return true
+	case levelDebug:
+		return verbosity >= 2
+	default:
+		return verbosity >= 0
+	}
+}
+
+// debugf logs a debug message.
+func debugf(format string, args ...interface{}) {
+	if logEnabled(levelDebug) {
+		logEvent(levelDebug, "", fmt.Sprintf(format, args...), nil)
+	}
+}
+
+// fatalf logs an error and exits with exitFatal.
+func fatalf(format string, args ...interface{}) {
+	logEvent(levelError, "", fmt.Sprintf(format, args...), nil)
+	exit(exitFatal)
+}
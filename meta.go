@@ -0,0 +1,116 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// metaSource collects file metadata that not every platform can provide. Where a platform lacks
+// some piece of metadata, its metaSource reports that (ok is false, or no xattrs are returned)
+// and the corresponding header fields are left unset.
+type metaSource interface {
+	// Mode returns the permission bits to record for a file.
+	Mode(fi os.FileInfo) int64
+	// Owner returns the uid and gid of a file.
+	Owner(fi os.FileInfo) (uid, gid string, ok bool)
+	// FileID returns the device and inode numbers that identify a file.
+	FileID(fi os.FileInfo) (dev, ino uint64, ok bool)
+	// Xattrs returns the extended attributes of the file at path.
+	Xattrs(path string) (map[string]string, error)
+}
+
+// platform is the metaSource for the platform mtar was built for.
+var platform metaSource = sysMeta{}
+
+// recordXattrs controls whether extended attributes are recorded as PAX records.
+var recordXattrs bool
+
+// setXattrs records the extended attributes of src in hdr. Xattrs are only recorded in PAX
+// headers, since other formats have nowhere to put them.
+func setXattrs(hdr *tar.Header, src string) {
+	if !recordXattrs || hdr.Format != tar.FormatPAX {
+		return
+	}
+	attrs, err := platform.Xattrs(src)
+	if err != nil {
+		warnf("%s: cannot read xattrs: %v", src, err)
+		return
+	}
+	for name, value := range attrs {
+		if readXattrOpts && strings.HasPrefix(name, xattrOptsPrefix) {
+			continue // Applied as options, not part of the file
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, len(attrs))
+		}
+		hdr.PAXRecords["SCHILY.xattr."+name] = value
+	}
+}
+
+// xattrOptsPrefix is the prefix of extended attributes read as per-file options.
+const xattrOptsPrefix = "user.mtar."
+
+// readXattrOpts controls whether per-file options are read from xattrs on source files.
+var readXattrOpts bool
+
+// xattrFileOpts returns opts with the per-file options set on src as user.mtar.* xattrs applied.
+// An attribute user.mtar.NAME with the value VALUE is applied as the option NAME=VALUE, or as
+// NAME if VALUE is empty. If src has no such attributes, opts is returned as-is.
+func xattrFileOpts(src string, opts *FileOpts) (*FileOpts, error) {
+	attrs, err := platform.Xattrs(src)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range attrs {
+		if strings.HasPrefix(name, xattrOptsPrefix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return opts, nil
+	}
+	sort.Strings(names)
+
+	fo := newFileOpts()
+	if opts != nil {
+		*fo = *opts
+	}
+	for _, name := range names {
+		opt := strings.TrimPrefix(name, xattrOptsPrefix)
+		if value := strings.TrimRight(attrs[name], "\x00\n"); value != "" {
+			opt += "=" + value
+		}
+		if err := fo.parse(opt); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return fo, nil
+}
@@ -31,9 +31,23 @@
 //
 // Usage:
 //
-//    mtar [-h|--help] [FILE|OPTION]
+//    mtar [c] [-h|--help] [FILE|OPTION]...
+//    mtar --version
+//    mtar bench [-h|--help] [OPTIONS] DIR
+//    mtar test-filter [-h|--help] [FILTER|PATH]...
+//    mtar x [-h|--help] [EXTRACT OPTION]... [--] [MEMBER[:DEST]]...
+//    mtar t[v] [-h|--help] [-f PATH] [FILTER]...
+//    mtar cat [-h|--help] ARCHIVE MEMBER
+//    mtar diff [-h|--help] [--format=FORMAT] ARCHIVE [DIR]
+//    mtar diff-layer [-h|--help] OLDDIR NEWDIR [OPTION|FILE]...
+//    mtar oci-append [-h|--help] DIR [OPTION|FILE]...
+//    mtar release [-h|--help] [RELEASE OPTION]... [--] [OPTION|FILE]...
+//    mtar repack [-h|--help] IN OUT [REPACK OPTION]... [--] [OPTION]...
+//    mtar shard [-h|--help] -n N [SHARD OPTION]... [--] [OPTION|FILE]...
 //
-//    Writes a tar file to standard output.
+//    Writes a tar file to standard output (or the file given by -f). The c
+//    command is optional: 'mtar c FILE...' is the same as 'mtar FILE...',
+//    except that no FILE is taken to be one of the commands below.
 //
 //    FILE may be a filepath for a file, symlink, or directory. If FILE
 //    contains a ':', the text after the colon is the path to write to the tar
@@ -46,6 +60,12 @@
 //      SRC:DEST
 //          Add file SRC as DEST to the tar file.
 //
+//    On Windows, a leading drive letter (e.g., C:) in SRC does not start a
+//    mapping. Since Windows has no equivalent of file permissions, modes are
+//    derived from the read-only attribute and file extension (.exe, .com,
+//    .bat, .cmd, and .ps1 files are executable), and no uid or gid is
+//    recorded unless set by options.
+//
 //    To read a file from standard input, you can set '-' as the SRC. If no
 //    DEST is given for this, it will default to dev/stdin (relative). File
 //    permissions and ownership are taken from fd 1, so overriding them may be
@@ -67,6 +87,14 @@
 //        Force file to become a symlink pointing to LINK.
 //      ref=LINK
 //        Force file to become a hard link pointing to LINK.
+//      wh
+//        Instead of adding the file, add an overlay whiteout (.wh.NAME) that
+//        deletes it from lower layers of a container image. SRC need not
+//        exist. Implies norec.
+//      opaque
+//        Instead of adding the file, add an opaque whiteout (.wh..wh..opq)
+//        inside it that hides the contents of the directory in lower layers.
+//        SRC need not exist. Implies norec.
 //      nouser
 //        Strip user information from the file.
 //      uid=UID | owner=USERNAME
@@ -76,20 +104,472 @@
 //      mode=MODE
 //        Set the file mode to MODE (may be hex, octal, or an integer -- octal
 //        must begin with a 0, hex with 0x).
+//      mode-from=PATH
+//        Set the file mode to the mode of the file at PATH, following
+//        symlinks. PATH is relative to the current directory (see -C).
 //      mtime=TIME | atime=TIME | ctime=TIME
 //        Sets the mod time, access time, or changed time to TIME. May be an
-//        RFC3339 timestamp or an integer timestamp (since the Unix epoch) in
-//        seconds, milliseconds (>=12 digits), or microseconds (>=15 digits).
+//        RFC3339 timestamp, a date and time without a zone ('2006-01-02
+//        15:04:05', '2006-01-02T15:04', '2006-01-02', and so on) interpreted
+//        in the --timezone zone, or an integer timestamp (since the Unix
+//        epoch) in seconds, milliseconds (>=12 digits), or microseconds (>=15
+//        digits).
+//      offset=SIZE | length=SIZE
+//        Add only part of a regular file's content, starting SIZE bytes into
+//        the file and/or limited to SIZE bytes. SIZE may have a K, M, G, or T
+//        suffix. It is an error for the range to extend past the end of the
+//        file.
 //
 //    Any whitespace preceding an option is trimmed. Whitespace is not trimmed
 //    before or after the '=' symbol for options that take values. Commas are
 //    not currently permitted inside options.
 //
+//    The following global options apply to the entire run and must precede
+//    all files and other options. A '--' ends global options:
+//
+//      -f PATH | --file=PATH
+//        Write the archive to the file at PATH instead of standard output. If
+//        PATH is '-', write to standard output. PATH may also be one of the
+//        following URLs to stream the archive to a listening receiver:
+//          * 'tcp://HOST:PORT'
+//          * 'tls://HOST:PORT'
+//            Connect over TLS, verifying the receiver's certificate.
+//          * 'unix:///PATH'
+//            Connect to the Unix socket at /PATH.
+//        Failed connections are retried as set by --retries and --retry-delay.
+//        The archive is written to a temporary file next to PATH and renamed
+//        to PATH once it's complete, unless --state is used or PATH exists and
+//        isn't a regular file. Unless a compression option is given, the
+//        archive is compressed according to PATH's extension:
+//          * .tar.gz, .tgz            gzip
+//          * .tar.zst, .tzst          zstd
+//          * .tar.xz, .txz            xz
+//          * .tar.bz2, .tbz2, .tbz    bzip2
+//          * .tar.lz4                 lz4
+//          * .tar.br                  brotli
+//      -z | --gzip
+//        Compress the archive with gzip. If the output is encrypted, it's
+//        compressed before it's encrypted. Compression may not be used with
+//        --remote, --state, image output, or the release or shard commands.
+//      -Z | --zstd
+//        Compress the archive with zstd.
+//      -J | --xz
+//        Compress the archive with xz.
+//      -j | --bzip2
+//        Compress the archive with bzip2.
+//      --lz4
+//        Compress the archive with lz4, which is faster than the others but
+//        compresses less.
+//      --brotli
+//        Compress the archive with brotli, such as to serve it to browsers
+//        with Content-Encoding: br.
+//      --compress-level=N | --compress-level N
+//        Compress the archive at level N, where lower levels are faster and
+//        higher levels compress more. The levels and defaults of each
+//        compression option are:
+//          * gzip      1 to 9   (default: 6)
+//          * zstd      1 to 22  (default: 3)
+//          * xz        0 to 9   (default: 6)
+//          * bzip2     1 to 9   (default: 6)
+//          * lz4       0 to 9   (default: 0, lz4's fast mode)
+//          * brotli    0 to 11  (default: 6)
+//      --threads=N | --threads N
+//        Compress the archive on N goroutines, or one per CPU if N is 0. Only
+//        gzip and zstd can be compressed in parallel. gzip compresses 1 MiB
+//        blocks separately and still writes a standard gzip stream.
+//        (default: 1)
+//      --rsyncable | --gzip-rsyncable
+//        Reset the gzip compressor at points chosen by the archive's content,
+//        as gzip --rsyncable does, so that rsync and other delta transfers of
+//        successive archives only send the regions that changed. This makes
+//        the output slightly larger. May not be used with --threads.
+//      --zstd-long[=WINDOW_LOG]
+//        Compress zstd with a window of 2^WINDOW_LOG bytes, from 10 to 29, so
+//        that content can be matched against content much further back in the
+//        archive, such as files duplicated across directories. To decompress
+//        archives with a window log over 27, zstd needs --long=WINDOW_LOG or
+//        --memory. (default: 27)
+//      --zstd-dict=FILE
+//        Compress zstd with the trained dictionary FILE, such as from zstd
+//        --train, which shrinks small archives of similar files considerably.
+//        Each frame records the dictionary's ID, and the archive can only be
+//        decompressed with the same dictionary (zstd -D FILE).
+//      --seekable
+//        Compress zstd in the seekable format, as independent frames of up to
+//        1 MiB of the archive each, followed by a seek table in a skippable
+//        frame. Tools that read the format can decompress any part of the
+//        archive without decompressing everything before it. Other tools
+//        decompress it as ordinary zstd.
+//      --remote=ssh://[USER@]HOST[:PORT]/DEST
+//        Extract the archive to the directory DEST on HOST instead of writing
+//        it out, by streaming it over ssh to tar on HOST. DEST is created if
+//        it doesn't exist. DEST is absolute unless it starts with /~/, in
+//        which case it's relative to the remote user's home directory. If
+//        the remote tar fails, mtar exits with an error. May not be used with
+//        -f.
+//      --tls-ca=PATH
+//        Verify a tls:// receiver using the PEM CA certificates in PATH
+//        instead of the system's.
+//      --tls-cert=PATH, --tls-key=PATH
+//        Present the PEM client certificate and key in the given files to a
+//        tls:// receiver.
+//      --encrypt-age=RECIPIENT[,RECIPIENT...]
+//        Encrypt the archive with age to each RECIPIENT before writing it.
+//        Recipients may be age public keys (age1...) or SSH public keys
+//        (ssh-ed25519 or ssh-rsa). May be given more than once to add more
+//        recipients. Encrypted output cannot be resumed with --state.
+//      --encrypt-gpg=KEYID[,KEYID...]
+//        Encrypt the archive with OpenPGP to each KEYID before writing it,
+//        using gpg and the keys in its keyring. If gpg fails, mtar exits with
+//        an error. May not be used with --encrypt-age.
+//      --encrypt-pass[=ENVVAR]
+//        Encrypt the archive with a passphrase before writing it, using age's
+//        scrypt-based passphrase encryption (decrypt with 'age -d'). The
+//        passphrase is read from the environment variable ENVVAR if given, or
+//        else prompted for on the terminal. May not be used with the other
+//        encryption options.
+//      --layer-base=PATH
+//        Write the archive as an OCI image layer on top of the base at PATH.
+//        PATH is either a tar archive of the lower layers or a manifest
+//        listing one path per line, with directories ending in '/'. Once all
+//        files are added, paths in the base that weren't written are deleted
+//        with .wh. whiteout entries. A deleted directory gets one whiteout,
+//        and a directory whose base contents are all deleted gets an opaque
+//        .wh..wh..opq whiteout instead.
+//      --image[=NAME:TAG]
+//        Write a container image that can be loaded with 'docker load' or
+//        read as an OCI image layout, instead of a plain tar file. The files
+//        added become the image's top layer, which is written to a temporary
+//        file before the image is written to the output. NAME:TAG is the
+//        image name, and may be repeated to give it several names. Without
+//        it, the image is unnamed. May not be used with --state.
+//      --oci-layout DIR | --oci-layout=DIR
+//        Add the image to the OCI image layout directory DIR, creating it if
+//        needed, instead of writing anything to the output. The layer is
+//        written straight into DIR, with its digest computed as it's written.
+//        Image names given by --image are added to DIR's index.json, replacing
+//        images that had the same tag. Implies --image, and may not be used
+//        with -f, --remote, or encryption.
+//      --image-config=PATH
+//        Start from the image config (e.g., from a base image) at PATH. The
+//        config's layers are replaced by those written, and its history is
+//        kept only if it matches the layers given by --image-layer.
+//      --image-layer=PATH
+//        Add the uncompressed tar file at PATH as a layer below the files
+//        added. May be repeated, bottom layer first.
+//      --image-platform=OS[/ARCH[/VARIANT]]
+//        Set the image's platform. Defaults to the platform from
+//        --image-config, or else linux and the architecture mtar was built
+//        for.
+//      --image-env=KEY=VALUE | --image-label=KEY=VALUE
+//        Set an environment variable or label in the image config. May be
+//        repeated.
+//      --image-entrypoint=CMD | --image-cmd=CMD
+//        Set the image's entrypoint or command. CMD may be a JSON array of
+//        arguments, or else it is run with /bin/sh -c. Setting the
+//        entrypoint clears the command from --image-config.
+//      --image-workdir=DIR | --image-user=USER
+//        Set the image's working directory or user.
+//      --squashfs-opt=OPT
+//        Pass OPT to sqfstar as an argument when writing a SquashFS image
+//        with -F squashfs (e.g., --squashfs-opt=-comp --squashfs-opt=zstd).
+//        May be repeated.
+//      --go-embed[=NAME]
+//        Write Go source embedding the archive instead of the archive itself,
+//        for use with go generate. The archive is written as the string
+//        constant NAMEData, along with a function NAME (default: archive) that
+//        returns a *tar.Reader for it. May not be used with encryption,
+//        --state, or image output.
+//      --go-package=PKG
+//        Set the package of the Go source written by --go-embed. Defaults to
+//        $GOPACKAGE, which go generate sets.
+//      --fsync
+//        Sync the output to disk, along with the directory containing it if
+//        written with -f, before exiting successfully. With --state, the
+//        output and state file are also synced each time the state is saved.
+//      --reproducible
+//        Write the same archive for identical trees, byte for byte. Every
+//        entry is written as PAX with a uid and gid of 0, no owner names, no
+//        atime or ctime, and an mtime of $SOURCE_DATE_EPOCH (default: 0, the
+//        Unix epoch). Directories are always walked in lexical order, so
+//        entries are sorted by name within each directory. May not be used
+//        with --provenance.
+//      --verify
+//        Once the archive is complete, read it back from the output file and
+//        check that every header is intact and that the content of each entry
+//        matches a digest taken while it was written (see --digest-algo). Each
+//        difference is logged, and if any are found, mtar exits with status 2
+//        without replacing the output. Requires -f, and may not be used with
+//        -F, --state, --go-embed, image output, or encryption.
+//      --digest-algo=ALGO
+//        Set the digest algorithm used by --verify, for a release's checksum
+//        file, and for the MTAR.build record of --provenance: sha256 (the
+//        default), sha512, or blake3. blake3 is the fastest for large trees.
+//        The diff command takes the same option.
+//      --sign-sigstore[=BUNDLE]
+//        Once the archive is complete, sign it with cosign's keyless sigstore
+//        flow and write the sigstore bundle to BUNDLE (default: the output
+//        path with .sigstore.json appended). In CI, cosign uses the ambient
+//        OIDC token as the signing identity; otherwise it opens a browser to
+//        authenticate. Requires -f and cosign on PATH. If signing fails, mtar
+//        exits with an error, leaving the archive in place.
+//      --provenance
+//        Begin the archive with a PAX global header recording what produced
+//        it: the host name (MTAR.hostname), command line (MTAR.command), mtar
+//        and Go versions (MTAR.version, MTAR.go), and a digest of the module
+//        versions and build settings mtar was built with (MTAR.build, prefixed
+//        with the algorithm set by --digest-algo).
+//        With --zstd-dict, it also records the dictionary's ID
+//        (MTAR.zstd.dict). Only supported for tar output.
+//      --state=PATH
+//        Record progress in the state file at PATH while writing the archive,
+//        so that an interrupted run can be resumed. Requires -f. If PATH
+//        exists when mtar starts, entries already written by the interrupted
+//        run are skipped without reading their content, the output is
+//        truncated to the end of the last one, and writing continues from
+//        there. The run must be resumed with the same arguments and working
+//        directory, and files must not have changed in the meantime. The state
+//        file is removed once the archive is complete.
+//      -q
+//        Only log errors. Warnings (e.g., skipped files) and other messages are
+//        not logged, but still affect the exit status.
+//      -v
+//        List the name of each entry written on stderr. With --log-format=json,
+//        each is logged as an "added" record with the entry's type (file, dir,
+//        symlink, link, fifo, char, or block) and size as well.
+//      -vv
+//        List each entry written in long format (like 'tar -tv') and log debug
+//        messages, including why files were filtered and the header fields of
+//        each entry written.
+//      --log-json=FILE
+//        Write a JSON event for each thing that happens while writing the
+//        archive to FILE, or with fd:N, to the inherited file descriptor N,
+//        one object per line. Each has time and event fields, where event is
+//        one of the following:
+//
+//          entry-added
+//            An entry was written. Has path, type, and size fields.
+//          entry-skipped
+//            A path was skipped. Has path and reason fields (failed,
+//            filtered, duplicate, unsupported, limit, loop, or walk), and
+//            msg or error fields with details.
+//          warning, error
+//            A warning or error was logged. Has msg, and if available, path
+//            and error fields. These are written regardless of -q and
+//            --log-level.
+//          totals
+//            The archive is complete. Has a totals field with the number of
+//            entries, bytes of content, out_bytes written, skipped and failed
+//            paths, and the status mtar exits with.
+//      --log-level=LEVEL
+//        Only log messages at LEVEL or more severe: debug, info, warn, or
+//        error. This overrides the levels set by -q and -vv, but not the
+//        entries listed by -v and -vv. At debug, filter decisions, the header
+//        fields of each entry, and other details useful for troubleshooting
+//        are logged.
+//      --config=PATH
+//        Read profiles from the config file at PATH. Must precede --profile.
+//        (default: $MTAR_CONFIG or $XDG_CONFIG_HOME/mtar/config)
+//      --profile=NAME
+//        Use the arguments of the profile NAME from the config file. Its
+//        global options take effect as if given in place of --profile, and
+//        all of its other arguments are inserted before the first argument
+//        after the global options. In the config file, each profile starts
+//        with its name in brackets, followed by its arguments, separated by
+//        whitespace. Arguments may be quoted with single or double quotes,
+//        and lines starting with '#' are ignored. For example:
+//
+//          [release]
+//          --log-format=json
+//          -U -F ustar
+//          -O '\.debug$'
+//      --log-format=FORMAT
+//        Set the format of messages written to stderr. FORMAT may be 'text'
+//        (default) or 'json'. JSON messages are written one per line with
+//        time, level (info, warning, or error), and msg fields, as well as
+//        op, path, error, and errno fields when available.
+//      --precompute
+//        Before writing anything, run through all arguments once to count
+//        the entries and bytes that will be written. Content of concatenated
+//        tar streams and of files that must be buffered is not counted.
+//      --progress
+//        Show the current entry, number of entries and bytes written, and
+//        throughput on stderr. If --precompute is also set, percent complete
+//        and an ETA are shown as well. If the output is compressed, the number
+//        of bytes written after compression is shown too. Ignored if stderr is
+//        not a terminal.
+//      --checkpoint[=N]
+//        Run checkpoint actions every N records (of 10240 bytes, as with GNU
+//        tar) written. N defaults to 10.
+//      --checkpoint-action=ACTION
+//        Add an action to run at each checkpoint. Implies --checkpoint if not
+//        set. If no action is given, echo is used. ACTION may be one of:
+//          * 'echo'
+//            Log the checkpoint number to stderr.
+//          * 'dot'
+//            Print a single '.' to stderr.
+//          * 'exec=CMD'
+//            Run CMD using /bin/sh. The checkpoint number, blocking factor,
+//            and tar format are passed in the TAR_CHECKPOINT,
+//            TAR_BLOCKING_FACTOR, and TAR_FORMAT environment variables.
+//      --on-start=CMD
+//        Run CMD using /bin/sh before the output is opened. The output path
+//        (or URL, or '-' for standard output) is passed in MTAR_OUTPUT. If CMD
+//        fails, mtar exits with an error without writing the archive.
+//      --on-complete=CMD
+//        Run CMD using /bin/sh once the archive is complete, such as to upload
+//        it or send a notification. In addition to MTAR_OUTPUT, the number of
+//        entries, content bytes, output bytes, skipped paths, and unreadable
+//        paths are passed in MTAR_ENTRIES, MTAR_BYTES, MTAR_OUTPUT_BYTES,
+//        MTAR_SKIPPED, and MTAR_FAILED, and the status mtar will exit with in
+//        MTAR_EXIT_STATUS. CMD is not run if mtar exits with an error before
+//        the archive is complete. If CMD fails, mtar exits with an error.
+//      --pre-add=PATTERN:CMD | --post-add=PATTERN:CMD
+//        Run CMD using /bin/sh before or after adding each entry whose name
+//        matches the regexp PATTERN (which may not contain a ':'). Pre-add
+//        hooks run before a file is opened, so they can flush or quiesce it,
+//        and the file's size is taken again once they finish; post-add hooks
+//        run once the entry and its content have been written.
+//        The hook event (pre-add or post-add), source path, entry name, tar
+//        type flag, and size are passed in the MTAR_HOOK, MTAR_SOURCE,
+//        MTAR_NAME, MTAR_TYPE, and MTAR_SIZE environment variables. If a hook
+//        fails, mtar exits with an error. May be given more than once.
+//      --size-change=POLICY
+//        Set what to do when a file's size changes while it is being copied.
+//        Since the entry's header has already been written by then, the entry
+//        is always filled out to its original size unless mtar exits, so a
+//        file can't be skipped once its size changes. POLICY may be one of:
+//          * 'fail' (default)
+//            Exit with an error.
+//          * 'pad'
+//            Pad a file that shrank with zeroes, or truncate a file that grew,
+//            to the size in its header and log a warning.
+//          * 'retry'
+//            As with pad, then add the file again once. The new entry replaces
+//            the padded entry when extracted. If the file changes again, the
+//            new entry is padded as well.
+//      --retries=N
+//        Retry opening or reading a file up to N times after a transient error
+//        (EIO, ESTALE, or EAGAIN), such as those from flaky network mounts.
+//        Reads resume from where they failed. (default: 0)
+//      --retry-delay=DURATION
+//        Wait DURATION (e.g., 500ms, 2s) between retries. (default: 1s)
+//      --keep-going
+//        Skip any file that cannot be added because of an error, such as one
+//        that cannot be read or whose options or owner cannot be applied,
+//        logging the error, instead of exiting. This also applies to -A
+//        streams that cannot be opened. Errors writing the output still end
+//        the run. Skipped files are listed once the archive is complete and
+//        mtar exits with status 1.
+//      -k | --ignore-failed-read
+//        Skip files that cannot be read for any reason, logging the error,
+//        instead of exiting. If a read fails after a file's entry was started,
+//        the rest of the entry is filled with zeroes. Skipped files are
+//        listed once the archive is complete and mtar exits with status 1.
+//      --skip-unreadable
+//        Skip files that cannot be opened because of their permissions or
+//        because they are busy, instead of exiting with an error. Skipped
+//        files are listed once the archive is complete and mtar exits with
+//        status 1.
+//      --remove-files
+//        Remove each source file and directory once the archive is complete
+//        and the output has been closed, renamed into place, and synced with
+//        --fsync. Nothing is removed if mtar exits with an error. Directories
+//        that still contain files (e.g., ones that were filtered out) are left
+//        in place with a warning. Files added with
+//        offset= or length=, or that changed size while being copied, are not
+//        removed. May not be used with --state.
+//      --spool-empty
+//        Read each regular file that reports a size of 0 into memory before
+//        writing its entry, so that its size is that of its content. This is
+//        always done for files on Linux virtual filesystems, such as /proc and
+//        /sys, which report a size of 0 for files that have content.
+//      --order=ORDER
+//        Set the order that directories and their contents are added in when
+//        adding a directory recursively. Entries in each directory are added in
+//        lexical order. ORDER may be one of:
+//          * 'dirs-first' (default)
+//            Add each directory before its contents.
+//          * 'files-first'
+//            Add each directory, then the files in it, then its subdirectories.
+//            Keeps the files of a directory together in the archive.
+//          * 'depth-first'
+//            Add each directory after its contents.
+//      --walk-errors=POLICY
+//        Set what happens when a directory or file can't be read while adding
+//        a directory recursively. A directory that can't be read is still
+//        added, without its contents. POLICY may be one of:
+//          * 'warn' (default)
+//            Log a warning, skip the path, and exit with status 1.
+//          * 'continue'
+//            Skip the path without logging a warning. It is still counted in
+//            the summary of skipped paths and written to the skip report.
+//          * 'fail'
+//            Exit with an error. The output is incomplete.
+//      --warn-size=SIZE
+//        Log a warning for each file larger than SIZE as it is added. SIZE may
+//        have a K, M, G, or T suffix (e.g., 512M).
+//      --copy-buffer=SIZE
+//        Copy file content through a buffer of SIZE bytes (default: 32K).
+//        SIZE may have a K, M, or G suffix. Run 'mtar bench' to compare sizes.
+//      --limit-entries=N
+//        Do not write more than N entries.
+//      --limit-size=SIZE
+//        Do not write more than SIZE bytes of output. SIZE may have a K, M, G,
+//        or T suffix (e.g., 10G). Each entry is checked against the limit
+//        before it is written, so output stays within SIZE apart from the end
+//        of the archive and extended headers.
+//      --limit-policy=POLICY
+//        Set what happens when adding an entry would exceed a limit. POLICY
+//        may be one of:
+//          * 'abort' (default)
+//            Exit with an error. The output is incomplete.
+//          * 'stop'
+//            Stop adding entries, log a warning, and finish the archive. All
+//            remaining entries are skipped.
+//      --skip-report=PATH
+//        Once the archive is complete, write every path that was skipped to
+//        PATH, one per line, as tab-separated reason, path, and detail fields.
+//        Reasons are 'failed', 'filtered', 'duplicate', 'unsupported', 'limit',
+//        'loop', and 'walk'. A summary of skipped paths is always logged.
+//      --lock-files
+//        Take a shared advisory lock (flock) on each regular file while it is
+//        copied. Writers that take an exclusive lock before modifying a file
+//        will not change it while it is being archived.
+//      --xattr-opts
+//        Read per-file options from the user.mtar.* extended attributes of
+//        regular files and directories. An attribute user.mtar.NAME with the
+//        value VALUE is applied as the option NAME=VALUE (or NAME, if VALUE is
+//        empty) after any options given with the file, and only to the file
+//        it's set on, not a directory's contents. For example, 'setfattr -n
+//        user.mtar.mode -v 0755 FILE' sets FILE's mode in the archive.
+//        Attributes are only read on Linux.
+//      --xattrs
+//        Record the extended attributes of regular files and directories as
+//        PAX SCHILY.xattr records. Attributes are only read on Linux and are
+//        not recorded when the tar format is not PAX.
+//      --transform-links EXPR | --transform-links=EXPR
+//        Rewrite the targets of symlinks and hard links, including those set
+//        by link= and ref=, with the sed-style substitution EXPR, of the form
+//        s/REGEXP/REPLACEMENT/ or s/REGEXP/REPLACEMENT/g to replace every
+//        match. Any character may be used in place of '/'. In REPLACEMENT, \1
+//        through \9 are replaced by submatches and & by the whole match. May
+//        be given more than once; substitutions are applied in order.
+//      --timezone=ZONE
+//        Interpret timestamps without a zone in mtime=, atime=, and ctime=
+//        options, and display times in -vv listings, in ZONE. ZONE may be
+//        'UTC', 'Local', or an IANA time zone name such as 'America/Chicago'.
+//        Defaults to the local time zone ('Local').
+//
 //    In addition, options may be passed in the middle of file arguments to
 //    control archive creation:
 //
 //      -h | --help
 //        When passed as the first argument, print this usage text.
+//      --version
+//        When passed as the first argument, print the version of mtar, the
+//        VCS revision it was built from (if known), and the Go version used to
+//        build it.
 //      -D
 //        Prevent duplicate entries with the same name. (default)
 //      -d
@@ -98,6 +578,21 @@
 //        Do not assign user information to files.
 //      -u
 //        Assign user information to files. (default)
+//      --owner-names
+//        Record the owner and group names of files, but with a uid and gid of
+//        0, so that extraction resolves owners by name rather than trusting
+//        the ids of the host the archive was created on.
+//      --owner-ids
+//        Record the owner and group ids of files along with their names.
+//        (default)
+//      -L
+//        Follow symlinks, adding the files and directories they point to in
+//        place of the links. Directories reached through a link are added
+//        recursively. A link to a directory that is already being added is a
+//        loop and is skipped with a warning. Links that can't be followed are
+//        added as links.
+//      -P
+//        Add symlinks as symlinks. (default)
 //      -Fformat | -F format
 //        Set the tar header format to use. May be one of the following
 //        formats:
@@ -109,6 +604,22 @@
 //          * 'gnu'
 //            A format specific to GNU tar archives.
 //            Should not be chosen unless absolutely required.
+//          * 'ar'
+//            Write a common ar archive (e.g., for .deb packages) instead of
+//            a tar file. Only regular files are added, with their paths as
+//            member names; other entries are skipped with a warning. Names
+//            over 16 bytes or with spaces use the BSD #1/LEN extension. Must
+//            be given with the global options, before all files, and may not
+//            be used with image output.
+//          * 'squashfs'
+//            Build a SquashFS image instead of a tar file, using sqfstar
+//            from squashfs-tools 4.6 or later. Requires -f, and the image
+//            replaces the output file once complete. Must be given with the
+//            global options, and may not be used with encryption, --state,
+//            or image output.
+//      --whiteout PATH | --whiteout=PATH
+//        Add an overlay whiteout that deletes PATH from lower layers of a
+//        container image. Equivalent to -:PATH:wh.
 //      -Cdir | -C dir
 //        Change to directory (relative to PWD at all times; -C. will reset
 //        the current directory) for subsequent file additions.
@@ -125,7 +636,79 @@
 //        Reset input, output, or all filters, respectively.
 //      -A
 //        Read one or more tar streams from standard input and concatenate them
-//        to the output.
+//        to the output. The streams may be compressed with gzip, zstd, xz,
+//        bzip2, or lz4.
+//
+//    The bench command adds DIR to a discarded tar stream using a range of
+//    copy buffer sizes (see --copy-buffer), reporting files/sec and MB/sec
+//    for each. Run 'mtar bench -h' for its options. To add a
+//    file named bench, pass it as ./bench.
+//
+//    The test-filter command takes filter options and sample paths and
+//    reports which filters match each path and whether it would be added.
+//    Run 'mtar test-filter -h' for details. To add a file named test-filter,
+//    pass it as ./test-filter.
+//
+//    The x command (or -x) extracts an archive, refusing entries that would
+//    be written outside of the directory they're extracted into. Run
+//    'mtar x -h' for details. To add a file named x, pass it as ./x.
+//
+//    The t command (or -t) lists the names of the entries in an archive, or
+//    as tv (or -tv), lists them in long format. Run 'mtar t -h' for details.
+//    To add a file named t or tv, pass it as ./t or ./tv.
+//
+//    The cat command writes the contents of a single entry of an archive to
+//    standard output. Run 'mtar cat -h' for details. To add a file named
+//    cat, pass it as ./cat.
+//
+//    The diff command compares the entries of an archive to the files on
+//    disk, reporting their differences. Run 'mtar diff -h' for details. To
+//    add a file named diff, pass it as ./diff.
+//
+//    The diff-layer command writes a container image layer holding the
+//    files in NEWDIR that differ from OLDDIR, plus whiteouts for files
+//    removed from it. It takes the same options and files as writing an
+//    archive, with files relative to NEWDIR. Run 'mtar diff-layer -h' for
+//    details. To add a file named diff-layer, pass it as ./diff-layer.
+//
+//    The oci-append command adds a layer of the files given to an image in
+//    an OCI image layout directory, updating its config, manifest, and
+//    index entry in place. Run 'mtar oci-append -h' for details. To add a
+//    file named oci-append, pass it as ./oci-append.
+//
+//    The release command writes an archive, a gzip-compressed copy, and a
+//    SHA256SUMS file (see --digest-algo) listing both, optionally signed,
+//    named by a template such as {name}-{version}-{os}-{arch}. Run
+//    'mtar release -h' for details. To add a file named release, pass it
+//    as ./release.
+//
+//    The repack command rewrites an existing archive canonically, sorting
+//    its entries and normalizing their header format, ownership, and times.
+//    Run 'mtar repack -h' for details. To add a file named repack, pass it
+//    as ./repack.
+//
+//    The shard command splits the files given across N archives, balanced
+//    by the size of their content, each a complete archive on its own. Run
+//    'mtar shard -h' for details. To add a file named shard, pass it as
+//    ./shard.
+//
+//    While writing an archive, mtar logs the entry being written and the
+//    number of entries and bytes written so far each time it receives
+//    SIGUSR1, or on BSD and macOS, SIGINFO (usually sent by typing ^T).
+//
+//    mtar exits with one of the following statuses:
+//
+//      0
+//        The archive was written.
+//      1
+//        The archive was written, but some files were skipped or warnings were
+//        logged. For commands that compare or extract archives, such as diff
+//        and x, some entries differed or could not be extracted.
+//      2
+//        A fatal error occurred, or arguments or options were invalid. No
+//        archive was written, or if writing to standard output, it's
+//        incomplete. Since arguments are processed in order, output may have
+//        been written before an invalid argument was found.
 //
 package main // import "go.spiff.io/mtar"
 
@@ -144,12 +727,21 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
 type Args struct{ args []string }
 
+// sizeChangePolicy controls what happens when a file's size changes while it's being copied.
+type sizeChangePolicy int
+
+const (
+	sizeChangeFail  sizeChangePolicy = iota // Exit with an error
+	sizeChangePad                           // Pad or truncate the entry to its header size
+	sizeChangeRetry                         // Pad, then add the file again once
+)
+
 type Matcher struct {
 	rx   *regexp.Regexp
 	want bool
@@ -159,6 +751,13 @@ func (m Matcher) matches(s string) bool {
 	return m.rx.MatchString(s) == m.want
 }
 
+func (m Matcher) String() string {
+	if m.want {
+		return "select /" + m.rx.String() + "/"
+	}
+	return "reject /" + m.rx.String() + "/"
+}
+
 var (
 	startupTime = time.Now()
 
@@ -166,8 +765,31 @@ var (
 	skipSrcGlobs  []Matcher
 	skipDestGlobs []Matcher
 	skipUserInfo  bool
+	spoolEmpty    bool // Whether to read empty files to find their size
+	ownerNames    bool // Whether to record owner names with a uid and gid of 0
 	skipWritten   = true
 	written       = map[string]struct{}{} // Already-written paths
+
+	precompute   bool // Whether to run through all arguments once to collect totals
+	precomputing bool // Whether the current run is only collecting totals
+	showProgress bool // Whether to display progress on stderr (only if it's a terminal)
+
+	lockFiles bool  // Whether to take a shared lock on regular files while copying them
+	warnSize  int64 // Size above which a warning is logged for a file (0 to disable)
+
+	copyBufferSize = 32 << 10 // Size of the buffer file content is copied through
+	copyBuffer     []byte
+
+	sizeChange         = sizeChangeFail
+	sizeChangeRetrying bool // Whether a file is being added again after its size changed
+
+	// totals holds the number of entries and content bytes the run is expected to write. It is
+	// only known if precompute is set.
+	totals struct {
+		entries int64
+		bytes   int64
+		known   bool
+	}
 )
 
 func (p *Args) Shift() (s string, ok bool) {
@@ -179,9 +801,23 @@ func (p *Args) Shift() (s string, ok bool) {
 
 func usage() {
 	_, _ = io.WriteString(os.Stderr,
-		`Usage: mtar [-h|--help] [FILE|OPTION]
-
-Writes a tar file to standard output.
+		`Usage: mtar [c] [-h|--help] [FILE|OPTION]...
+       mtar --version
+       mtar bench [-h|--help] [OPTIONS] DIR
+       mtar test-filter [-h|--help] [FILTER|PATH]...
+       mtar x [-h|--help] [EXTRACT OPTION]... [--] [MEMBER[:DEST]]...
+       mtar t[v] [-h|--help] [-f PATH] [FILTER]...
+       mtar cat [-h|--help] ARCHIVE MEMBER
+       mtar diff [-h|--help] [--format=FORMAT] ARCHIVE [DIR]
+       mtar diff-layer [-h|--help] OLDDIR NEWDIR [OPTION|FILE]...
+       mtar oci-append [-h|--help] DIR [OPTION|FILE]...
+       mtar release [-h|--help] [RELEASE OPTION]... [--] [OPTION|FILE]...
+       mtar repack [-h|--help] IN OUT [REPACK OPTION]... [--] [OPTION]...
+       mtar shard [-h|--help] -n N [SHARD OPTION]... [--] [OPTION|FILE]...
+
+Writes a tar file to standard output (or the file given by -f). The c
+command is optional: 'mtar c FILE...' is the same as 'mtar FILE...',
+except that no FILE is taken to be one of the commands below.
 
 FILE may be a filepath for a file, symlink, or directory. If FILE
 contains a ':', the text after the colon is the path to write to the tar
@@ -194,6 +830,12 @@ file. For example, the following paths behave differently:
   SRC:DEST
       Add file SRC as DEST to the tar file.
 
+On Windows, a leading drive letter (e.g., C:) in SRC does not start a
+mapping. Since Windows has no equivalent of file permissions, modes are
+derived from the read-only attribute and file extension (.exe, .com,
+.bat, .cmd, and .ps1 files are executable), and no uid or gid is
+recorded unless set by options.
+
 To read a file from standard input, you can set '-' as the SRC. If no
 DEST is given for this, it will default to dev/stdin (relative). File
 permissions and ownership are taken from fd 1, so overriding them may be
@@ -215,6 +857,14 @@ available (all option names are case-sensitive):
     Force file to become a symlink pointing to LINK.
   ref=LINK
     Force file to become a hard link pointing to LINK.
+  wh
+    Instead of adding the file, add an overlay whiteout (.wh.NAME) that
+    deletes it from lower layers of a container image. SRC need not
+    exist. Implies norec.
+  opaque
+    Instead of adding the file, add an opaque whiteout (.wh..wh..opq)
+    inside it that hides the contents of the directory in lower layers.
+    SRC need not exist. Implies norec.
   uid=UID | owner=USERNAME
     Set the owner's uid and/or username for the file entry.
   gid=GID | group=GROUPNAME
@@ -222,20 +872,472 @@ available (all option names are case-sensitive):
   mode=MODE
     Set the file mode to MODE (may be hex, octal, or an integer -- octal
     must begin with a 0, hex with 0x).
+  mode-from=PATH
+    Set the file mode to the mode of the file at PATH, following
+    symlinks. PATH is relative to the current directory (see -C).
   mtime=TIME | atime=TIME | ctime=TIME
     Sets the mod time, access time, or changed time to TIME. May be an
-    RFC3339 timestamp or an integer timestamp (since the Unix epoch) in
-    seconds, milliseconds (>=12 digits), or microseconds (>=15 digits).
+    RFC3339 timestamp, a date and time without a zone ('2006-01-02
+    15:04:05', '2006-01-02T15:04', '2006-01-02', and so on) interpreted
+    in the --timezone zone, or an integer timestamp (since the Unix
+    epoch) in seconds, milliseconds (>=12 digits), or microseconds (>=15
+    digits).
+  offset=SIZE | length=SIZE
+    Add only part of a regular file's content, starting SIZE bytes into
+    the file and/or limited to SIZE bytes. SIZE may have a K, M, G, or T
+    suffix. It is an error for the range to extend past the end of the
+    file.
 
 Any whitespace preceding an option is trimmed. Whitespace is not trimmed
 before or after the '=' symbol for options that take values. Commas are
 not currently permitted inside options.
 
+The following global options apply to the entire run and must precede
+all files and other options. A '--' ends global options:
+
+  -f PATH | --file=PATH
+    Write the archive to the file at PATH instead of standard output. If
+    PATH is '-', write to standard output. PATH may also be one of the
+    following URLs to stream the archive to a listening receiver:
+      * 'tcp://HOST:PORT'
+      * 'tls://HOST:PORT'
+        Connect over TLS, verifying the receiver's certificate.
+      * 'unix:///PATH'
+        Connect to the Unix socket at /PATH.
+    Failed connections are retried as set by --retries and --retry-delay.
+    The archive is written to a temporary file next to PATH and renamed
+    to PATH once it's complete, unless --state is used or PATH exists and
+    isn't a regular file. Unless a compression option is given, the
+    archive is compressed according to PATH's extension:
+      * .tar.gz, .tgz            gzip
+      * .tar.zst, .tzst          zstd
+      * .tar.xz, .txz            xz
+      * .tar.bz2, .tbz2, .tbz    bzip2
+      * .tar.lz4                 lz4
+      * .tar.br                  brotli
+  -z | --gzip
+    Compress the archive with gzip. If the output is encrypted, it's
+    compressed before it's encrypted. Compression may not be used with
+    --remote, --state, image output, or the release or shard commands.
+  -Z | --zstd
+    Compress the archive with zstd.
+  -J | --xz
+    Compress the archive with xz.
+  -j | --bzip2
+    Compress the archive with bzip2.
+  --lz4
+    Compress the archive with lz4, which is faster than the others but
+    compresses less.
+  --brotli
+    Compress the archive with brotli, such as to serve it to browsers
+    with Content-Encoding: br.
+  --compress-level=N | --compress-level N
+    Compress the archive at level N, where lower levels are faster and
+    higher levels compress more. The levels and defaults of each
+    compression option are:
+      * gzip      1 to 9   (default: 6)
+      * zstd      1 to 22  (default: 3)
+      * xz        0 to 9   (default: 6)
+      * bzip2     1 to 9   (default: 6)
+      * lz4       0 to 9   (default: 0, lz4's fast mode)
+      * brotli    0 to 11  (default: 6)
+  --threads=N | --threads N
+    Compress the archive on N goroutines, or one per CPU if N is 0. Only
+    gzip and zstd can be compressed in parallel. gzip compresses 1 MiB
+    blocks separately and still writes a standard gzip stream.
+    (default: 1)
+  --rsyncable | --gzip-rsyncable
+    Reset the gzip compressor at points chosen by the archive's content,
+    as gzip --rsyncable does, so that rsync and other delta transfers of
+    successive archives only send the regions that changed. This makes
+    the output slightly larger. May not be used with --threads.
+  --zstd-long[=WINDOW_LOG]
+    Compress zstd with a window of 2^WINDOW_LOG bytes, from 10 to 29, so
+    that content can be matched against content much further back in the
+    archive, such as files duplicated across directories. To decompress
+    archives with a window log over 27, zstd needs --long=WINDOW_LOG or
+    --memory. (default: 27)
+  --zstd-dict=FILE
+    Compress zstd with the trained dictionary FILE, such as from zstd
+    --train, which shrinks small archives of similar files considerably.
+    Each frame records the dictionary's ID, and the archive can only be
+    decompressed with the same dictionary (zstd -D FILE).
+  --seekable
+    Compress zstd in the seekable format, as independent frames of up to
+    1 MiB of the archive each, followed by a seek table in a skippable
+    frame. Tools that read the format can decompress any part of the
+    archive without decompressing everything before it. Other tools
+    decompress it as ordinary zstd.
+  --remote=ssh://[USER@]HOST[:PORT]/DEST
+    Extract the archive to the directory DEST on HOST instead of writing
+    it out, by streaming it over ssh to tar on HOST. DEST is created if
+    it doesn't exist. DEST is absolute unless it starts with /~/, in
+    which case it's relative to the remote user's home directory. If
+    the remote tar fails, mtar exits with an error. May not be used with
+    -f.
+  --tls-ca=PATH
+    Verify a tls:// receiver using the PEM CA certificates in PATH
+    instead of the system's.
+  --tls-cert=PATH, --tls-key=PATH
+    Present the PEM client certificate and key in the given files to a
+    tls:// receiver.
+  --encrypt-age=RECIPIENT[,RECIPIENT...]
+    Encrypt the archive with age to each RECIPIENT before writing it.
+    Recipients may be age public keys (age1...) or SSH public keys
+    (ssh-ed25519 or ssh-rsa). May be given more than once to add more
+    recipients. Encrypted output cannot be resumed with --state.
+  --encrypt-gpg=KEYID[,KEYID...]
+    Encrypt the archive with OpenPGP to each KEYID before writing it,
+    using gpg and the keys in its keyring. If gpg fails, mtar exits with
+    an error. May not be used with --encrypt-age.
+  --encrypt-pass[=ENVVAR]
+    Encrypt the archive with a passphrase before writing it, using age's
+    scrypt-based passphrase encryption (decrypt with 'age -d'). The
+    passphrase is read from the environment variable ENVVAR if given, or
+    else prompted for on the terminal. May not be used with the other
+    encryption options.
+  --layer-base=PATH
+    Write the archive as an OCI image layer on top of the base at PATH.
+    PATH is either a tar archive of the lower layers or a manifest
+    listing one path per line, with directories ending in '/'. Once all
+    files are added, paths in the base that weren't written are deleted
+    with .wh. whiteout entries. A deleted directory gets one whiteout,
+    and a directory whose base contents are all deleted gets an opaque
+    .wh..wh..opq whiteout instead.
+  --image[=NAME:TAG]
+    Write a container image that can be loaded with 'docker load' or
+    read as an OCI image layout, instead of a plain tar file. The files
+    added become the image's top layer, which is written to a temporary
+    file before the image is written to the output. NAME:TAG is the
+    image name, and may be repeated to give it several names. Without
+    it, the image is unnamed. May not be used with --state.
+  --oci-layout DIR | --oci-layout=DIR
+    Add the image to the OCI image layout directory DIR, creating it if
+    needed, instead of writing anything to the output. The layer is
+    written straight into DIR, with its digest computed as it's written.
+    Image names given by --image are added to DIR's index.json, replacing
+    images that had the same tag. Implies --image, and may not be used
+    with -f, --remote, or encryption.
+  --image-config=PATH
+    Start from the image config (e.g., from a base image) at PATH. The
+    config's layers are replaced by those written, and its history is
+    kept only if it matches the layers given by --image-layer.
+  --image-layer=PATH
+    Add the uncompressed tar file at PATH as a layer below the files
+    added. May be repeated, bottom layer first.
+  --image-platform=OS[/ARCH[/VARIANT]]
+    Set the image's platform. Defaults to the platform from
+    --image-config, or else linux and the architecture mtar was built
+    for.
+  --image-env=KEY=VALUE | --image-label=KEY=VALUE
+    Set an environment variable or label in the image config. May be
+    repeated.
+  --image-entrypoint=CMD | --image-cmd=CMD
+    Set the image's entrypoint or command. CMD may be a JSON array of
+    arguments, or else it is run with /bin/sh -c. Setting the
+    entrypoint clears the command from --image-config.
+  --image-workdir=DIR | --image-user=USER
+    Set the image's working directory or user.
+  --squashfs-opt=OPT
+    Pass OPT to sqfstar as an argument when writing a SquashFS image
+    with -F squashfs (e.g., --squashfs-opt=-comp --squashfs-opt=zstd).
+    May be repeated.
+  --go-embed[=NAME]
+    Write Go source embedding the archive instead of the archive itself,
+    for use with go generate. The archive is written as the string
+    constant NAMEData, along with a function NAME (default: archive) that
+    returns a *tar.Reader for it. May not be used with encryption,
+    --state, or image output.
+  --go-package=PKG
+    Set the package of the Go source written by --go-embed. Defaults to
+    $GOPACKAGE, which go generate sets.
+  --fsync
+    Sync the output to disk, along with the directory containing it if
+    written with -f, before exiting successfully. With --state, the
+    output and state file are also synced each time the state is saved.
+  --reproducible
+    Write the same archive for identical trees, byte for byte. Every
+    entry is written as PAX with a uid and gid of 0, no owner names, no
+    atime or ctime, and an mtime of $SOURCE_DATE_EPOCH (default: 0, the
+    Unix epoch). Directories are always walked in lexical order, so
+    entries are sorted by name within each directory. May not be used
+    with --provenance.
+  --verify
+    Once the archive is complete, read it back from the output file and
+    check that every header is intact and that the content of each entry
+    matches a digest taken while it was written (see --digest-algo). Each
+    difference is logged, and if any are found, mtar exits with status 2
+    without replacing the output. Requires -f, and may not be used with
+    -F, --state, --go-embed, image output, or encryption.
+  --digest-algo=ALGO
+    Set the digest algorithm used by --verify, for a release's checksum
+    file, and for the MTAR.build record of --provenance: sha256 (the
+    default), sha512, or blake3. blake3 is the fastest for large trees.
+    The diff command takes the same option.
+  --sign-sigstore[=BUNDLE]
+    Once the archive is complete, sign it with cosign's keyless sigstore
+    flow and write the sigstore bundle to BUNDLE (default: the output
+    path with .sigstore.json appended). In CI, cosign uses the ambient
+    OIDC token as the signing identity; otherwise it opens a browser to
+    authenticate. Requires -f and cosign on PATH. If signing fails, mtar
+    exits with an error, leaving the archive in place.
+  --provenance
+    Begin the archive with a PAX global header recording what produced
+    it: the host name (MTAR.hostname), command line (MTAR.command), mtar
+    and Go versions (MTAR.version, MTAR.go), and a digest of the module
+    versions and build settings mtar was built with (MTAR.build, prefixed
+    with the algorithm set by --digest-algo).
+    With --zstd-dict, it also records the dictionary's ID
+    (MTAR.zstd.dict). Only supported for tar output.
+  --state=PATH
+    Record progress in the state file at PATH while writing the archive,
+    so that an interrupted run can be resumed. Requires -f. If PATH
+    exists when mtar starts, entries already written by the interrupted
+    run are skipped without reading their content, the output is
+    truncated to the end of the last one, and writing continues from
+    there. The run must be resumed with the same arguments and working
+    directory, and files must not have changed in the meantime. The state
+    file is removed once the archive is complete.
+  -q
+    Only log errors. Warnings (e.g., skipped files) and other messages are
+    not logged, but still affect the exit status.
+  -v
+    List the name of each entry written on stderr. With --log-format=json,
+    each is logged as an "added" record with the entry's type (file, dir,
+    symlink, link, fifo, char, or block) and size as well.
+  -vv
+    List each entry written in long format (like 'tar -tv') and log debug
+    messages, including why files were filtered and the header fields of
+    each entry written.
+  --log-json=FILE
+    Write a JSON event for each thing that happens while writing the
+    archive to FILE, or with fd:N, to the inherited file descriptor N,
+    one object per line. Each has time and event fields, where event is
+    one of the following:
+
+      entry-added
+        An entry was written. Has path, type, and size fields.
+      entry-skipped
+        A path was skipped. Has path and reason fields (failed,
+        filtered, duplicate, unsupported, limit, loop, or walk), and
+        msg or error fields with details.
+      warning, error
+        A warning or error was logged. Has msg, and if available, path
+        and error fields. These are written regardless of -q and
+        --log-level.
+      totals
+        The archive is complete. Has a totals field with the number of
+        entries, bytes of content, out_bytes written, skipped and failed
+        paths, and the status mtar exits with.
+  --log-level=LEVEL
+    Only log messages at LEVEL or more severe: debug, info, warn, or
+    error. This overrides the levels set by -q and -vv, but not the
+    entries listed by -v and -vv. At debug, filter decisions, the header
+    fields of each entry, and other details useful for troubleshooting
+    are logged.
+  --config=PATH
+    Read profiles from the config file at PATH. Must precede --profile.
+    (default: $MTAR_CONFIG or $XDG_CONFIG_HOME/mtar/config)
+  --profile=NAME
+    Use the arguments of the profile NAME from the config file. Its
+    global options take effect as if given in place of --profile, and
+    all of its other arguments are inserted before the first argument
+    after the global options. In the config file, each profile starts
+    with its name in brackets, followed by its arguments, separated by
+    whitespace. Arguments may be quoted with single or double quotes,
+    and lines starting with '#' are ignored. For example:
+
+      [release]
+      --log-format=json
+      -U -F ustar
+      -O '\.debug$'
+  --log-format=FORMAT
+    Set the format of messages written to stderr. FORMAT may be 'text'
+    (default) or 'json'. JSON messages are written one per line with
+    time, level (info, warning, or error), and msg fields, as well as
+    op, path, error, and errno fields when available.
+  --precompute
+    Before writing anything, run through all arguments once to count
+    the entries and bytes that will be written. Content of concatenated
+    tar streams and of files that must be buffered is not counted.
+  --progress
+    Show the current entry, number of entries and bytes written, and
+    throughput on stderr. If --precompute is also set, percent complete
+    and an ETA are shown as well. If the output is compressed, the number
+    of bytes written after compression is shown too. Ignored if stderr is
+    not a terminal.
+  --checkpoint[=N]
+    Run checkpoint actions every N records (of 10240 bytes, as with GNU
+    tar) written. N defaults to 10.
+  --checkpoint-action=ACTION
+    Add an action to run at each checkpoint. Implies --checkpoint if not
+    set. If no action is given, echo is used. ACTION may be one of:
+      * 'echo'
+        Log the checkpoint number to stderr.
+      * 'dot'
+        Print a single '.' to stderr.
+      * 'exec=CMD'
+        Run CMD using /bin/sh. The checkpoint number, blocking factor,
+        and tar format are passed in the TAR_CHECKPOINT,
+        TAR_BLOCKING_FACTOR, and TAR_FORMAT environment variables.
+  --on-start=CMD
+    Run CMD using /bin/sh before the output is opened. The output path
+    (or URL, or '-' for standard output) is passed in MTAR_OUTPUT. If CMD
+    fails, mtar exits with an error without writing the archive.
+  --on-complete=CMD
+    Run CMD using /bin/sh once the archive is complete, such as to upload
+    it or send a notification. In addition to MTAR_OUTPUT, the number of
+    entries, content bytes, output bytes, skipped paths, and unreadable
+    paths are passed in MTAR_ENTRIES, MTAR_BYTES, MTAR_OUTPUT_BYTES,
+    MTAR_SKIPPED, and MTAR_FAILED, and the status mtar will exit with in
+    MTAR_EXIT_STATUS. CMD is not run if mtar exits with an error before
+    the archive is complete. If CMD fails, mtar exits with an error.
+  --pre-add=PATTERN:CMD | --post-add=PATTERN:CMD
+    Run CMD using /bin/sh before or after adding each entry whose name
+    matches the regexp PATTERN (which may not contain a ':'). Pre-add
+    hooks run before a file is opened, so they can flush or quiesce it,
+    and the file's size is taken again once they finish; post-add hooks
+    run once the entry and its content have been written.
+    The hook event (pre-add or post-add), source path, entry name, tar
+    type flag, and size are passed in the MTAR_HOOK, MTAR_SOURCE,
+    MTAR_NAME, MTAR_TYPE, and MTAR_SIZE environment variables. If a hook
+    fails, mtar exits with an error. May be given more than once.
+  --size-change=POLICY
+    Set what to do when a file's size changes while it is being copied.
+    Since the entry's header has already been written by then, the entry
+    is always filled out to its original size unless mtar exits, so a
+    file can't be skipped once its size changes. POLICY may be one of:
+      * 'fail' (default)
+        Exit with an error.
+      * 'pad'
+        Pad a file that shrank with zeroes, or truncate a file that grew,
+        to the size in its header and log a warning.
+      * 'retry'
+        As with pad, then add the file again once. The new entry replaces
+        the padded entry when extracted. If the file changes again, the
+        new entry is padded as well.
+  --retries=N
+    Retry opening or reading a file up to N times after a transient error
+    (EIO, ESTALE, or EAGAIN), such as those from flaky network mounts.
+    Reads resume from where they failed. (default: 0)
+  --retry-delay=DURATION
+    Wait DURATION (e.g., 500ms, 2s) between retries. (default: 1s)
+  --keep-going
+    Skip any file that cannot be added because of an error, such as one
+    that cannot be read or whose options or owner cannot be applied,
+    logging the error, instead of exiting. This also applies to -A
+    streams that cannot be opened. Errors writing the output still end
+    the run. Skipped files are listed once the archive is complete and
+    mtar exits with status 1.
+  -k | --ignore-failed-read
+    Skip files that cannot be read for any reason, logging the error,
+    instead of exiting. If a read fails after a file's entry was started,
+    the rest of the entry is filled with zeroes. Skipped files are
+    listed once the archive is complete and mtar exits with status 1.
+  --skip-unreadable
+    Skip files that cannot be opened because of their permissions or
+    because they are busy, instead of exiting with an error. Skipped
+    files are listed once the archive is complete and mtar exits with
+    status 1.
+  --remove-files
+    Remove each source file and directory once the archive is complete
+    and the output has been closed, renamed into place, and synced with
+    --fsync. Nothing is removed if mtar exits with an error. Directories
+    that still contain files (e.g., ones that were filtered out) are left
+    in place with a warning. Files added with
+    offset= or length=, or that changed size while being copied, are not
+    removed. May not be used with --state.
+  --spool-empty
+    Read each regular file that reports a size of 0 into memory before
+    writing its entry, so that its size is that of its content. This is
+    always done for files on Linux virtual filesystems, such as /proc and
+    /sys, which report a size of 0 for files that have content.
+  --order=ORDER
+    Set the order that directories and their contents are added in when
+    adding a directory recursively. Entries in each directory are added in
+    lexical order. ORDER may be one of:
+      * 'dirs-first' (default)
+        Add each directory before its contents.
+      * 'files-first'
+        Add each directory, then the files in it, then its subdirectories.
+        Keeps the files of a directory together in the archive.
+      * 'depth-first'
+        Add each directory after its contents.
+  --walk-errors=POLICY
+    Set what happens when a directory or file can't be read while adding
+    a directory recursively. A directory that can't be read is still
+    added, without its contents. POLICY may be one of:
+      * 'warn' (default)
+        Log a warning, skip the path, and exit with status 1.
+      * 'continue'
+        Skip the path without logging a warning. It is still counted in
+        the summary of skipped paths and written to the skip report.
+      * 'fail'
+        Exit with an error. The output is incomplete.
+  --warn-size=SIZE
+    Log a warning for each file larger than SIZE as it is added. SIZE may
+    have a K, M, G, or T suffix (e.g., 512M).
+  --copy-buffer=SIZE
+    Copy file content through a buffer of SIZE bytes (default: 32K).
+    SIZE may have a K, M, or G suffix. Run 'mtar bench' to compare sizes.
+  --limit-entries=N
+    Do not write more than N entries.
+  --limit-size=SIZE
+    Do not write more than SIZE bytes of output. SIZE may have a K, M, G,
+    or T suffix (e.g., 10G). Each entry is checked against the limit
+    before it is written, so output stays within SIZE apart from the end
+    of the archive and extended headers.
+  --limit-policy=POLICY
+    Set what happens when adding an entry would exceed a limit. POLICY
+    may be one of:
+      * 'abort' (default)
+        Exit with an error. The output is incomplete.
+      * 'stop'
+        Stop adding entries, log a warning, and finish the archive. All
+        remaining entries are skipped.
+  --skip-report=PATH
+    Once the archive is complete, write every path that was skipped to
+    PATH, one per line, as tab-separated reason, path, and detail fields.
+    Reasons are 'failed', 'filtered', 'duplicate', 'unsupported', 'limit',
+    'loop', and 'walk'. A summary of skipped paths is always logged.
+  --lock-files
+    Take a shared advisory lock (flock) on each regular file while it is
+    copied. Writers that take an exclusive lock before modifying a file
+    will not change it while it is being archived.
+  --xattr-opts
+    Read per-file options from the user.mtar.* extended attributes of
+    regular files and directories. An attribute user.mtar.NAME with the
+    value VALUE is applied as the option NAME=VALUE (or NAME, if VALUE is
+    empty) after any options given with the file, and only to the file
+    it's set on, not a directory's contents. For example, 'setfattr -n
+    user.mtar.mode -v 0755 FILE' sets FILE's mode in the archive.
+    Attributes are only read on Linux.
+  --xattrs
+    Record the extended attributes of regular files and directories as
+    PAX SCHILY.xattr records. Attributes are only read on Linux and are
+    not recorded when the tar format is not PAX.
+  --transform-links EXPR | --transform-links=EXPR
+    Rewrite the targets of symlinks and hard links, including those set
+    by link= and ref=, with the sed-style substitution EXPR, of the form
+    s/REGEXP/REPLACEMENT/ or s/REGEXP/REPLACEMENT/g to replace every
+    match. Any character may be used in place of '/'. In REPLACEMENT, \1
+    through \9 are replaced by submatches and & by the whole match. May
+    be given more than once; substitutions are applied in order.
+  --timezone=ZONE
+    Interpret timestamps without a zone in mtime=, atime=, and ctime=
+    options, and display times in -vv listings, in ZONE. ZONE may be
+    'UTC', 'Local', or an IANA time zone name such as 'America/Chicago'.
+    Defaults to the local time zone ('Local').
+
 In addition, options may be passed in the middle of file arguments to
 control archive creation:
 
   -h | --help
     When passed as the first argument, print this usage text.
+  --version
+    When passed as the first argument, print the version of mtar, the
+    VCS revision it was built from (if known), and the Go version used to
+    build it.
   -D
     Prevent duplicate entries with the same name. (default)
   -d
@@ -244,6 +1346,21 @@ control archive creation:
     Do not assign user information to files.
   -u
     Assign user information to files. (default)
+  --owner-names
+    Record the owner and group names of files, but with a uid and gid of
+    0, so that extraction resolves owners by name rather than trusting
+    the ids of the host the archive was created on.
+  --owner-ids
+    Record the owner and group ids of files along with their names.
+    (default)
+  -L
+    Follow symlinks, adding the files and directories they point to in
+    place of the links. Directories reached through a link are added
+    recursively. A link to a directory that is already being added is a
+    loop and is skipped with a warning. Links that can't be followed are
+    added as links.
+  -P
+    Add symlinks as symlinks. (default)
   -Fformat | -F format
     Set the tar header format to use. May be one of the following
     formats:
@@ -255,6 +1372,22 @@ control archive creation:
       * 'gnu'
         A format specific to GNU tar archives.
         Should not be chosen unless absolutely required.
+      * 'ar'
+        Write a common ar archive (e.g., for .deb packages) instead of
+        a tar file. Only regular files are added, with their paths as
+        member names; other entries are skipped with a warning. Names
+        over 16 bytes or with spaces use the BSD #1/LEN extension. Must
+        be given with the global options, before all files, and may not
+        be used with image output.
+      * 'squashfs'
+        Build a SquashFS image instead of a tar file, using sqfstar
+        from squashfs-tools 4.6 or later. Requires -f, and the image
+        replaces the output file once complete. Must be given with the
+        global options, and may not be used with encryption, --state,
+        or image output.
+  --whiteout PATH | --whiteout=PATH
+    Add an overlay whiteout that deletes PATH from lower layers of a
+    container image. Equivalent to -:PATH:wh.
   -Cdir | -C dir
     Change to directory (relative to PWD at all times; -C. will reset
     the current directory) for subsequent file additions.
@@ -271,27 +1404,580 @@ control archive creation:
     Reset input, output, or all filters, respectively.
   -A
     Read one or more tar streams from standard input and concatenate them
-    to the output.`+"\n")
+    to the output. The streams may be compressed with gzip, zstd, xz,
+    bzip2, or lz4.
+
+The bench command adds DIR to a discarded tar stream using a range of
+copy buffer sizes (see --copy-buffer), reporting files/sec and MB/sec
+for each. Run 'mtar bench -h' for its options. To add a
+file named bench, pass it as ./bench.
+
+The test-filter command takes filter options and sample paths and
+reports which filters match each path and whether it would be added.
+Run 'mtar test-filter -h' for details. To add a file named test-filter,
+pass it as ./test-filter.
+
+The x command (or -x) extracts an archive, refusing entries that would
+be written outside of the directory they're extracted into. Run
+'mtar x -h' for details. To add a file named x, pass it as ./x.
+
+The t command (or -t) lists the names of the entries in an archive, or
+as tv (or -tv), lists them in long format. Run 'mtar t -h' for details.
+To add a file named t or tv, pass it as ./t or ./tv.
+
+The cat command writes the contents of a single entry of an archive to
+standard output. Run 'mtar cat -h' for details. To add a file named
+cat, pass it as ./cat.
+
+The diff command compares the entries of an archive to the files on
+disk, reporting their differences. Run 'mtar diff -h' for details. To
+add a file named diff, pass it as ./diff.
+
+The diff-layer command writes a container image layer holding the
+files in NEWDIR that differ from OLDDIR, plus whiteouts for files
+removed from it. It takes the same options and files as writing an
+archive, with files relative to NEWDIR. Run 'mtar diff-layer -h' for
+details. To add a file named diff-layer, pass it as ./diff-layer.
+
+The oci-append command adds a layer of the files given to an image in
+an OCI image layout directory, updating its config, manifest, and
+index entry in place. Run 'mtar oci-append -h' for details. To add a
+file named oci-append, pass it as ./oci-append.
+
+The release command writes an archive, a gzip-compressed copy, and a
+SHA256SUMS file (see --digest-algo) listing both, optionally signed,
+named by a template such as {name}-{version}-{os}-{arch}. Run
+'mtar release -h' for details. To add a file named release, pass it
+as ./release.
+
+The repack command rewrites an existing archive canonically, sorting
+its entries and normalizing their header format, ownership, and times.
+Run 'mtar repack -h' for details. To add a file named repack, pass it
+as ./repack.
+
+The shard command splits the files given across N archives, balanced
+by the size of their content, each a complete archive on its own. Run
+'mtar shard -h' for details. To add a file named shard, pass it as
+./shard.
+
+While writing an archive, mtar logs the entry being written and the
+number of entries and bytes written so far each time it receives
+SIGUSR1, or on BSD and macOS, SIGINFO (usually sent by typing ^T).
+
+mtar exits with one of the following statuses:
+
+  0
+    The archive was written.
+  1
+    The archive was written, but some files were skipped or warnings were
+    logged. For commands that compare or extract archives, such as diff
+    and x, some entries differed or could not be extracted.
+  2
+    A fatal error occurred, or arguments or options were invalid. No
+    archive was written, or if writing to standard output, it's
+    incomplete. Since arguments are processed in order, output may have
+    been written before an invalid argument was found.`+"\n")
 }
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("mtar: ")
+	log.SetOutput(logWriter{})
 
 	// Using some pretty weird CLI arguments here so incoming weird as hell arg loop ahead
 	if len(os.Args) <= 1 || os.Args[1] == "-h" || os.Args[1] == "--help" {
 		usage()
-		os.Exit(2)
+		exit(exitUsage)
 	}
 
-	w := tar.NewWriter(os.Stdout)
-	defer func() { failOnError("error writing output", w.Close()) }()
+	if os.Args[1] == "--version" {
+		printVersion()
+		return
+	}
+
+	if run, ok := commands[os.Args[1]]; ok {
+		run(Args{args: os.Args[2:]})
+		return
+	}
 	argv := Args{args: os.Args[1:]}
+	if args, ok := createCommands[os.Args[1]]; ok {
+		argv = args(Args{args: os.Args[2:]})
+	}
+	create(argv)
+}
+
+// commands maps the names of commands, given as mtar's first argument, to the functions that run
+// them with the remaining arguments. If the first argument isn't a command, the arguments are
+// passed to create, so that 'mtar FILE...' writes an archive.
+var commands = map[string]func(Args){
+	"c":           create,
+	"x":           extract,
+	"-x":          extract,
+	"t":           listArchive,
+	"-t":          listArchive,
+	"tv":          listLongArchive,
+	"-tv":         listLongArchive,
+	"cat":         catMember,
+	"diff":        diffArchive,
+	"bench":       bench,
+	"test-filter": testFilter,
+}
+
+// createCommands maps the names of commands that write an archive to the functions that
+// translate their arguments into create's.
+var createCommands = map[string]func(Args) Args{
+	"diff-layer": diffLayerArgs,
+	"oci-append": ociAppendArgs,
+	"release":    releaseArgs,
+	"repack":     repackArgs,
+	"shard":      shardArgs,
+}
+
+// create writes an archive of the files and options in argv.
+func create(argv Args) {
+	if len(argv.args) > 0 && (argv.args[0] == "-h" || argv.args[0] == "--help") {
+		usage()
+		exit(exitUsage)
+	}
+	parseGlobalOptions(&argv)
+	if diffOld != "" {
+		if layerBase != "" {
+			usageErrorf("diff-layer: may not be used with --layer-base")
+		}
+		argv.args = diffFileArgs(argv.args)
+	}
+	checkRepack(argv)
+	argv.args = append(profileArgs, argv.args...)
+
+	checkRelease()
+	if statePath != "" {
+		loadState()
+	}
+	if layerBase != "" {
+		loadLayerBase()
+	}
+
+	checkSigning()
+	checkImage()
+	checkProvenance()
+	checkReproducible()
+	checkShard()
+	detectCompression()
+	checkCompression()
+	checkVerify()
+	runOnStart()
+
+	// Open the output first, since encrypting it may prompt for a passphrase.
+	out := goSourceOutput(compressOutput(filterOutput(openOutput())))
+
+	watchStatusSignals()
+	if precompute {
+		precomputeTotals(argv)
+	}
+
+	var progress *progressDisplay
+	if showProgress && isTerminal(os.Stderr) {
+		progress = startProgress()
+	}
+
+	// An image's layer is spooled so that its digest is known before the image is written.
+	archive := out
+	if imageMode {
+		archive = createImageLayer()
+	}
 
-	if argv.args[0] == "--" {
+	var w ArchiveWriter
+	if shardCount > 0 {
+		w = newShardWriter()
+	} else {
+		w = newVerifyWriter(newArchiveWriter(newCheckpointWriter(&countingWriter{w: newOutputSink(archive), n: &stats.outBytes})))
+	}
+	writeProvenance(w)
+	writeRepacked(w)
+	addArgs(w, argv)
+	writeWhiteouts(w)
+	finishState(w)
+	failOnError("error writing output", w.Close())
+	writeImage(out)
+	failOnError("error closing output", closeOutput())
+	removeState()
+	signOutput()
+	finishRelease()
+	removeSources()
+	if progress != nil {
+		progress.stop()
+	}
+
+	reportSkips()
+	runOnComplete()
+	totalsEvent(exitStatus())
+	exit(exitStatus())
+}
+
+// parseGlobalOptions consumes options that apply to the entire run. These must precede all files
+// and per-file options, since they may need to take effect before the first entry is written.
+// A "--" ends global options.
+func parseGlobalOptions(argv *Args) {
+	for len(argv.args) > 0 {
+		switch s := argv.args[0]; {
+		case s == "--":
+			argv.Shift()
+			return
+		case strings.HasPrefix(s, "-F") && isArchiveFormat(s[2:]),
+			s == "-F" && len(argv.args) > 1 && isArchiveFormat(argv.args[1]):
+			if s == "-F" {
+				argv.Shift()
+				s += argv.args[0]
+			}
+			outputFormat = strings.TrimPrefix(s, "-F")
+		case s == "-z", s == "--gzip":
+			compression = "gzip"
+		case s == "-Z", s == "--zstd":
+			compression = "zstd"
+		case s == "-J", s == "--xz":
+			compression = "xz"
+		case s == "-j", s == "--bzip2":
+			compression = "bzip2"
+		case s == "--lz4":
+			compression = "lz4"
+		case s == "--brotli":
+			compression = "brotli"
+		case strings.HasPrefix(s, "--compress-level="),
+			s == "--compress-level" && len(argv.args) > 1:
+			if s == "--compress-level" {
+				argv.Shift()
+				s += "=" + argv.args[0]
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(s, "--compress-level="))
+			if err == nil && n < 0 {
+				err = errors.New("may not be negative")
+			}
+			failOnUsageError("--compress-level", err)
+			compressionLevel = n
+		case strings.HasPrefix(s, "--threads="),
+			s == "--threads" && len(argv.args) > 1:
+			if s == "--threads" {
+				argv.Shift()
+				s += "=" + argv.args[0]
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(s, "--threads="))
+			if err == nil && n < 0 {
+				err = errors.New("may not be negative")
+			}
+			failOnUsageError("--threads", err)
+			compressionThreads = n
+		case s == "--rsyncable", s == "--gzip-rsyncable":
+			rsyncable = true
+		case s == "--zstd-long":
+			zstdWindowLog = defaultZstdWindowLog
+		case strings.HasPrefix(s, "--zstd-long="):
+			n, err := strconv.Atoi(strings.TrimPrefix(s, "--zstd-long="))
+			if err == nil && (n < 10 || n > 29) {
+				err = errors.New("window log must be from 10 to 29")
+			}
+			failOnUsageError("--zstd-long", err)
+			zstdWindowLog = n
+		case strings.HasPrefix(s, "--zstd-dict="):
+			zstdDictPath = strings.TrimPrefix(s, "--zstd-dict=")
+		case s == "--seekable":
+			seekable = true
+		case s == "--go-embed":
+			goEmbedName = "archive"
+		case strings.HasPrefix(s, "--go-embed="):
+			goEmbedName = strings.TrimPrefix(s, "--go-embed=")
+		case strings.HasPrefix(s, "--go-package="):
+			goPackage = strings.TrimPrefix(s, "--go-package=")
+		case strings.HasPrefix(s, "--squashfs-opt="):
+			squashfsOpts = append(squashfsOpts, strings.TrimPrefix(s, "--squashfs-opt="))
+		case s == "-f":
+			argv.Shift()
+			if len(argv.args) == 0 {
+				usageErrorf("-f: missing path")
+			}
+			outputPath = argv.args[0]
+		case strings.HasPrefix(s, "--file="):
+			outputPath = strings.TrimPrefix(s, "--file=")
+		case strings.HasPrefix(s, "--remote="):
+			remoteURL = strings.TrimPrefix(s, "--remote=")
+		case strings.HasPrefix(s, "--tls-ca="):
+			tlsCAPath = strings.TrimPrefix(s, "--tls-ca=")
+		case strings.HasPrefix(s, "--tls-cert="):
+			tlsCertPath = strings.TrimPrefix(s, "--tls-cert=")
+		case strings.HasPrefix(s, "--tls-key="):
+			tlsKeyPath = strings.TrimPrefix(s, "--tls-key=")
+		case strings.HasPrefix(s, "--encrypt-age="):
+			r, err := parseAgeRecipients(strings.TrimPrefix(s, "--encrypt-age="))
+			failOnUsageError("--encrypt-age", err)
+			ageRecipients = append(ageRecipients, r...)
+		case strings.HasPrefix(s, "--encrypt-gpg="):
+			for _, r := range strings.Split(strings.TrimPrefix(s, "--encrypt-gpg="), ",") {
+				if r = strings.TrimSpace(r); r != "" {
+					gpgRecipients = append(gpgRecipients, r)
+				}
+			}
+			if len(gpgRecipients) == 0 {
+				usageErrorf("--encrypt-gpg: no key IDs given")
+			}
+		case s == "--encrypt-pass":
+			encryptPass = true
+		case strings.HasPrefix(s, "--encrypt-pass="):
+			encryptPass = true
+			passphraseEnv = strings.TrimPrefix(s, "--encrypt-pass=")
+		case s == "--sign-sigstore":
+			signSigstore = true
+		case strings.HasPrefix(s, "--sign-sigstore="):
+			signSigstore = true
+			sigstoreBundle = strings.TrimPrefix(s, "--sign-sigstore=")
+		case s == "--image":
+			imageMode = true
+		case strings.HasPrefix(s, "--image="):
+			imageMode = true
+			imageTags = append(imageTags, strings.TrimPrefix(s, "--image="))
+		case strings.HasPrefix(s, "--image-config="):
+			imageConfig = strings.TrimPrefix(s, "--image-config=")
+		case strings.HasPrefix(s, "--image-layer="):
+			imageLayers = append(imageLayers, strings.TrimPrefix(s, "--image-layer="))
+		case strings.HasPrefix(s, "--image-platform="):
+			imagePlatform = strings.TrimPrefix(s, "--image-platform=")
+		case strings.HasPrefix(s, "--image-env="):
+			imageEnv = append(imageEnv, strings.TrimPrefix(s, "--image-env="))
+		case strings.HasPrefix(s, "--image-label="):
+			imageLabels = append(imageLabels, strings.TrimPrefix(s, "--image-label="))
+		case strings.HasPrefix(s, "--image-entrypoint="):
+			imageEntry = strings.TrimPrefix(s, "--image-entrypoint=")
+		case strings.HasPrefix(s, "--image-cmd="):
+			imageCmd = strings.TrimPrefix(s, "--image-cmd=")
+		case strings.HasPrefix(s, "--image-workdir="):
+			imageWorkdir = strings.TrimPrefix(s, "--image-workdir=")
+		case strings.HasPrefix(s, "--image-user="):
+			imageUser = strings.TrimPrefix(s, "--image-user=")
+		case s == "--oci-layout":
+			argv.Shift()
+			if len(argv.args) == 0 {
+				usageErrorf("--oci-layout: missing directory")
+			}
+			ociLayout = argv.args[0]
+		case strings.HasPrefix(s, "--oci-layout="):
+			ociLayout = strings.TrimPrefix(s, "--oci-layout=")
+		case strings.HasPrefix(s, "--layer-base="):
+			layerBase = strings.TrimPrefix(s, "--layer-base=")
+		case s == "--fsync":
+			fsyncOutput = true
+		case s == "--provenance":
+			provenance = true
+		case s == "--verify":
+			verifyOutput = true
+		case strings.HasPrefix(s, "--digest-algo="):
+			setDigestAlgo(strings.TrimPrefix(s, "--digest-algo="))
+		case s == "--reproducible":
+			reproducible = true
+		case strings.HasPrefix(s, "--on-start="):
+			onStart = strings.TrimPrefix(s, "--on-start=")
+		case strings.HasPrefix(s, "--on-complete="):
+			onComplete = strings.TrimPrefix(s, "--on-complete=")
+		case strings.HasPrefix(s, "--pre-add="):
+			preAddHooks = append(preAddHooks, parseEntryHook("--pre-add", strings.TrimPrefix(s, "--pre-add=")))
+		case strings.HasPrefix(s, "--post-add="):
+			postAddHooks = append(postAddHooks, parseEntryHook("--post-add", strings.TrimPrefix(s, "--post-add=")))
+		case s == "--transform-links":
+			argv.Shift()
+			if len(argv.args) == 0 {
+				usageErrorf("--transform-links: missing expression")
+			}
+			t, err := parseLinkTransform(argv.args[0])
+			failOnUsageError("--transform-links", err)
+			linkTransforms = append(linkTransforms, t)
+		case strings.HasPrefix(s, "--transform-links="):
+			t, err := parseLinkTransform(strings.TrimPrefix(s, "--transform-links="))
+			failOnUsageError("--transform-links", err)
+			linkTransforms = append(linkTransforms, t)
+		case strings.HasPrefix(s, "--timezone="):
+			loc, err := time.LoadLocation(strings.TrimPrefix(s, "--timezone="))
+			failOnUsageError("--timezone", err)
+			timeZone = loc
+		case strings.HasPrefix(s, "--state="):
+			statePath = strings.TrimPrefix(s, "--state=")
+		case strings.HasPrefix(s, "--config="):
+			configPath = strings.TrimPrefix(s, "--config=")
+		case strings.HasPrefix(s, "--profile="):
+			argv.Shift()
+			applyProfile(strings.TrimPrefix(s, "--profile="))
+			continue
+		case strings.HasPrefix(s, "--log-format="):
+			switch format := strings.TrimPrefix(s, "--log-format="); format {
+			case "text":
+				logJSON = false
+			case "json":
+				logJSON = true
+			default:
+				usageErrorf("--log-format: unrecognized format %q", format)
+			}
+		case strings.HasPrefix(s, "--log-json="):
+			openEventLog(strings.TrimPrefix(s, "--log-json="))
+		case s == "-q":
+			verbosity = -1
+		case strings.HasPrefix(s, "--log-level="):
+			setLogLevel(strings.TrimPrefix(s, "--log-level="))
+		case s == "-v":
+			verbosity = 1
+		case s == "-vv":
+			verbosity = 2
+		case s == "--precompute":
+			precompute = true
+		case s == "--progress":
+			showProgress = true
+		case strings.HasPrefix(s, "--size-change="):
+			switch policy := strings.TrimPrefix(s, "--size-change="); policy {
+			case "fail":
+				sizeChange = sizeChangeFail
+			case "pad":
+				sizeChange = sizeChangePad
+			case "retry":
+				sizeChange = sizeChangeRetry
+			default:
+				usageErrorf("--size-change: unrecognized policy %q", policy)
+			}
+		case strings.HasPrefix(s, "--retries="):
+			n, err := strconv.Atoi(strings.TrimPrefix(s, "--retries="))
+			if err == nil && n < 0 {
+				err = errors.New("may not be negative")
+			}
+			failOnUsageError("--retries", err)
+			ioRetries = n
+		case strings.HasPrefix(s, "--retry-delay="):
+			d, err := time.ParseDuration(strings.TrimPrefix(s, "--retry-delay="))
+			if err == nil && d < 0 {
+				err = errors.New("may not be negative")
+			}
+			failOnUsageError("--retry-delay", err)
+			ioRetryDelay = d
+		case s == "--keep-going":
+			keepGoing = true
+		case s == "-k", s == "--ignore-failed-read":
+			ignoreFailedRead = true
+		case s == "--skip-unreadable":
+			skipUnreadable = true
+		case s == "--remove-files":
+			removeFiles = true
+		case s == "--spool-empty":
+			spoolEmpty = true
+		case strings.HasPrefix(s, "--warn-size="):
+			n, err := parseSize(strings.TrimPrefix(s, "--warn-size="))
+			failOnUsageError("--warn-size", err)
+			warnSize = n
+		case strings.HasPrefix(s, "--copy-buffer="):
+			n, err := parseSize(strings.TrimPrefix(s, "--copy-buffer="))
+			if err == nil && n < 1 {
+				err = errors.New("must be at least 1")
+			}
+			failOnUsageError("--copy-buffer", err)
+			copyBufferSize = int(n)
+		case strings.HasPrefix(s, "--limit-entries="):
+			n, err := strconv.ParseInt(strings.TrimPrefix(s, "--limit-entries="), 10, 64)
+			if err == nil && n < 1 {
+				err = errors.New("must be at least 1")
+			}
+			failOnUsageError("--limit-entries", err)
+			limitEntries = n
+		case strings.HasPrefix(s, "--limit-size="):
+			n, err := parseSize(strings.TrimPrefix(s, "--limit-size="))
+			if err == nil && n < 1 {
+				err = errors.New("must be at least 1")
+			}
+			failOnUsageError("--limit-size", err)
+			limitSize = n
+		case strings.HasPrefix(s, "--limit-policy="):
+			switch policy := strings.TrimPrefix(s, "--limit-policy="); policy {
+			case "abort":
+				limitAction = limitAbort
+			case "stop":
+				limitAction = limitStop
+			default:
+				usageErrorf("--limit-policy: unrecognized policy %q", policy)
+			}
+		case strings.HasPrefix(s, "--order="):
+			switch o := strings.TrimPrefix(s, "--order="); o {
+			case "dirs-first":
+				order = orderDirsFirst
+			case "files-first":
+				order = orderFilesFirst
+			case "depth-first":
+				order = orderDepthFirst
+			default:
+				usageErrorf("--order: unrecognized order %q", o)
+			}
+		case strings.HasPrefix(s, "--walk-errors="):
+			switch policy := strings.TrimPrefix(s, "--walk-errors="); policy {
+			case "warn":
+				walkErrors = walkWarn
+			case "continue":
+				walkErrors = walkContinue
+			case "fail":
+				walkErrors = walkFail
+			default:
+				usageErrorf("--walk-errors: unrecognized policy %q", policy)
+			}
+		case strings.HasPrefix(s, "--skip-report="):
+			skipReportPath = strings.TrimPrefix(s, "--skip-report=")
+		case s == "--lock-files":
+			lockFiles = true
+		case s == "--xattr-opts":
+			readXattrOpts = true
+		case s == "--xattrs":
+			recordXattrs = true
+		case s == "--checkpoint":
+			checkpointEvery = 10
+		case strings.HasPrefix(s, "--checkpoint="):
+			n, err := strconv.ParseInt(strings.TrimPrefix(s, "--checkpoint="), 10, 64)
+			if err == nil && n < 1 {
+				err = errors.New("must be at least 1")
+			}
+			failOnUsageError("--checkpoint", err)
+			checkpointEvery = n
+		case strings.HasPrefix(s, "--checkpoint-action="):
+			action, err := parseCheckpointAction(strings.TrimPrefix(s, "--checkpoint-action="))
+			failOnUsageError("--checkpoint-action", err)
+			checkpointActions = append(checkpointActions, action)
+			if checkpointEvery == 0 {
+				checkpointEvery = 10
+			}
+		default:
+			return
+		}
 		argv.Shift()
 	}
+}
 
+// precomputeTotals runs through argv without writing anything to determine the number of entries
+// and bytes of file content that will be written. Concatenated tar streams are not counted, nor
+// is the content of files that must be buffered to determine their size (e.g., pipes).
+func precomputeTotals(argv Args) {
+	wd, err := os.Getwd()
+	failOnError("precompute: cannot get working directory", err)
+
+	precomputing = true
+	addArgs(nil, argv)
+	precomputing = false
+
+	failOnError("precompute: cd", os.Chdir(wd))
+	resetArgState()
+	assignShards()
+	totals.known = true
+	log.Printf("precomputed %d entries, %d bytes", totals.entries, totals.bytes)
+}
+
+// resetArgState restores all state changed by per-file options to its initial values.
+func resetArgState() {
+	hdrFormat = tar.FormatPAX
+	skipSrcGlobs, skipDestGlobs = nil, nil
+	skipUserInfo = false
+	ownerNames = false
+	skipWritten = true
+	followLinks = false
+	written = map[string]struct{}{}
+}
+
+func addArgs(w ArchiveWriter, argv Args) {
 	for s, ok := argv.Shift(); ok; s, ok = argv.Shift() {
 		switch {
 		// Concatenate
@@ -300,21 +1986,16 @@ func main() {
 			if s, ok = argv.Shift(); ok {
 				catPath = s
 			}
-			if err := concatenateTarFile(w, catPath); err != nil {
-				log.Fatal("-A: error concatenating tar stream: ", err)
-			}
+			concatenate(w, catPath)
 		case strings.HasPrefix(s, "-A"):
-			catPath := strings.TrimPrefix(s, "-A")
-			if err := concatenateTarFile(w, catPath); err != nil {
-				log.Fatal("-A: error concatenating tar stream: ", err)
-			}
+			concatenate(w, strings.TrimPrefix(s, "-A"))
 
 		// Set format
 		case strings.HasPrefix(s, "-F"):
 			fstr := strings.TrimPrefix(s, "-F")
 			if fstr == "" {
 				if fstr, ok = argv.Shift(); !ok {
-					log.Fatal("-F: missing format (ustar, pax, gnu)")
+					usageErrorf("-F: missing format (ustar, pax, gnu)")
 				}
 			}
 
@@ -327,38 +2008,19 @@ func main() {
 			case "gnu":
 				hdrFormat = tar.FormatGNU
 			default:
-				log.Fatalf("-F: unrecognized format %q", fstr)
+				if isArchiveFormat(fstr) {
+					usageErrorf("-F %s: must precede all files and options, as a global option", fstr)
+				}
+				usageErrorf("-F: unrecognized format %q", fstr)
 			}
 
 			if pred != hdrFormat && len(written) > 0 {
-				log.Printf("Warning: tar format changing mid-stream (%v -> %v)", pred, hdrFormat)
+				warnf("Warning: tar format changing mid-stream (%v -> %v)", pred, hdrFormat)
 			}
 
 		// Filter flags
-		case s == "-Ro": // reset output filters
-			skipSrcGlobs = nil
-		case s == "-Ri": // reset input filters
-			skipSrcGlobs = nil
-		case s == "-R": // reset all filters
-			skipSrcGlobs, skipDestGlobs = nil, nil
-		case s == "-i" || s == "-I": // filter input by regexp
-			want := s[1] == 'i'
-			if s, ok = argv.Shift(); !ok {
-				log.Fatal("-i: missing regexp")
-			}
-			skipSrcGlobs = append(skipSrcGlobs, Matcher{rx: regexp.MustCompile(s), want: want})
-		case strings.HasPrefix(s, "-I") || strings.HasPrefix(s, "-i"):
-			want := s[1] == 'i'
-			skipSrcGlobs = append(skipSrcGlobs, Matcher{rx: regexp.MustCompile(s[2:]), want: want})
-		case s == "-o" || s == "-O": // filter output by regexp (after mapping)
-			want := s[1] == 'o'
-			if s, ok = argv.Shift(); !ok {
-				log.Fatal("-O: missing regexp")
-			}
-			skipDestGlobs = append(skipDestGlobs, Matcher{rx: regexp.MustCompile(s), want: want})
-		case strings.HasPrefix(s, "-O") || strings.HasPrefix(s, "-o"):
-			want := s[1] == 'o'
-			skipDestGlobs = append(skipDestGlobs, Matcher{rx: regexp.MustCompile(s[2:]), want: want})
+		case isFilterOption(s):
+			addFilter(s, &argv)
 
 		// -D  Skip duplicate header entries.
 		// -d  Allow duplicate header entries.
@@ -370,10 +2032,30 @@ func main() {
 		case s == "-U", s == "-u":
 			skipUserInfo = s == "-U"
 
+		// --owner-names  Record only the names of owners, with a uid and gid of 0.
+		// --owner-ids    Record both names and numeric ids.
+		case s == "--owner-names", s == "--owner-ids":
+			ownerNames = s == "--owner-names"
+
+		// -L  Follow symlinks, adding the files they point to.
+		// -P  Add symlinks as symlinks.
+		case s == "-L", s == "-P":
+			followLinks = s == "-L"
+
+		// Whiteouts
+		case s == "--whiteout":
+			if s, ok = argv.Shift(); !ok {
+				usageErrorf("--whiteout: missing path")
+			}
+			addWhiteout(w, "", s, &FileOpts{wh: true})
+
+		case strings.HasPrefix(s, "--whiteout="):
+			addWhiteout(w, "", strings.TrimPrefix(s, "--whiteout="), &FileOpts{wh: true})
+
 		// Change dir
 		case s == "-C": // cd
 			if s, ok = argv.Shift(); !ok {
-				log.Fatal("-C: missing directory")
+				usageErrorf("-C: missing directory")
 			}
 			failOnError("cd", os.Chdir(s))
 			continue
@@ -383,32 +2065,68 @@ func main() {
 
 		// Add files
 		default:
-			src, dest := s, ""
-			switch idx := strings.IndexByte(src, ':'); idx {
-			case -1: // no mapping -- use src as path
-			case 0: // no src
-				log.Fatalf("no source: %q", s)
-			case len(src) - 1: // no dest -- use src path
-				src = s[:idx]
-			default: // path given
-				src, dest = s[:idx], s[idx+1:]
-			}
-
+			src, dest := splitMapping(s)
 			opts := newFileOpts()
 			if idx := strings.IndexByte(dest, ':'); idx > -1 {
 				err := opts.parse(dest[idx+1:])
-				failOnError("cannot parse options for "+src, err)
+				failOnUsageError("cannot parse options for "+src, err)
 				dest = dest[:idx]
 			}
 
-			addFile(w, src, dest, opts, true)
+			if opts.wh || opts.opaque {
+				addWhiteout(w, src, dest, opts)
+			} else {
+				checkAddError(src, addFile(w, src, dest, opts, true))
+			}
 		}
 	}
 }
 
-func addFile(w *tar.Writer, src, dest string, opts *FileOpts, allowRecursive bool) {
-	if shouldSkip(skipSrcGlobs, src) {
-		return
+// splitMapping splits a file argument into its source path and destination (which may be
+// followed by options). dest is empty if s has no mapping.
+func splitMapping(s string) (src, dest string) {
+	src = s
+	// Skip any volume name (e.g., C: on Windows) when looking for the mapping.
+	vol := len(filepath.VolumeName(s))
+	idx := strings.IndexByte(s[vol:], ':')
+	if idx > -1 {
+		idx += vol
+	}
+	switch idx {
+	case -1: // no mapping -- use src as path
+	case 0: // no src
+		usageErrorf("no source: %q", s)
+	case len(src) - 1: // no dest -- use src path
+		src = s[:idx]
+	default: // path given
+		src, dest = s[:idx], s[idx+1:]
+	}
+	return src, dest
+}
+
+// entryName returns the name of the entry for src, given a destination path from its mapping. If
+// dest is empty, the name is src made relative.
+func entryName(src, dest string) string {
+	if dest == "" {
+		dest = filepath.ToSlash(src[len(filepath.VolumeName(src)):])
+		if strings.HasPrefix(dest, "/") {
+			dest = path.Clean("." + dest)
+		}
+	}
+	dest = path.Clean(filepath.ToSlash(dest))
+
+	if dest == ".." || strings.HasPrefix(dest, "../") {
+		usageErrorf("add file: destination may not contain .. (%s)", dest)
+	}
+	return dest
+}
+
+// addFile adds src to w as dest, along with its contents if it's a directory and allowRecursive
+// is set. Errors adding src are returned, but errors writing to w are fatal, since the archive
+// can't be continued after one.
+func addFile(w ArchiveWriter, src, dest string, opts *FileOpts, allowRecursive bool) error {
+	if shouldSkip(skipSrcGlobs, filepath.ToSlash(src)) {
+		return nil
 	}
 
 	var r io.Reader
@@ -422,47 +2140,70 @@ func addFile(w *tar.Writer, src, dest string, opts *FileOpts, allowRecursive boo
 		}
 		st, err = os.Stdin.Stat()
 		needBuffer = true
+	} else if followLinks {
+		st, err = os.Stat(src)
+		if err != nil {
+			// Add dangling links as-is
+			if lst, lerr := os.Lstat(src); lerr == nil {
+				debugf("%s: cannot follow symlink: %v", src, err)
+				st, err = lst, nil
+			}
+		}
 	} else {
 		st, err = os.Lstat(src)
 	}
 
-	failOnError("add file: stat error", err)
-	if dest == "" {
-		dest = filepath.ToSlash(src)
-		if strings.HasPrefix(dest, "/") {
-			dest = path.Clean("." + dest)
+	if skipOnError(src, err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("stat error: %w", err)
+	}
+	dest = entryName(src, dest)
+
+	// Options read from xattrs only apply to the file they're set on, not a directory's contents.
+	dirOpts := opts
+	if readXattrOpts && src != "-" && (st.Mode().IsRegular() || st.IsDir()) {
+		opts, err = xattrFileOpts(src, opts)
+		if err != nil {
+			return fmt.Errorf("cannot read options: %w", err)
 		}
 	}
-	dest = path.Clean(filepath.ToSlash(dest))
 
-	if dest == ".." || strings.HasPrefix(dest, "../") {
-		log.Fatal("add file: destination may not contain .. (", dest, ")")
+	if followLinks && st.IsDir() && isDirLoop(src, st) {
+		return nil
 	}
 
 	hdr := &tar.Header{
 		Name:     dest,
 		Typeflag: tar.TypeReg,
 		ModTime:  st.ModTime(),
-		Mode:     int64(st.Mode().Perm()),
+		Mode:     platform.Mode(st),
 		Format:   hdrFormat,
 	}
 
 	if uid, gid, ok := opts.getUidGid(st); ok {
-		hdr.Uid, err = strconv.Atoi(uid.Uid)
+		hdr.Uid, err = numericID(uid.Uid)
 		hdr.Uname = uid.Username
 		if err != nil {
-			log.Fatalf("cannot parse uid (%q) for %s: %v", uid.Uid, src, err)
+			return fmt.Errorf("cannot parse uid (%q): %w", uid.Uid, err)
 		}
-		hdr.Gid, err = strconv.Atoi(gid.Gid)
+		hdr.Gid, err = numericID(gid.Gid)
 		hdr.Gname = gid.Name
 		if err != nil {
-			log.Fatalf("cannot parse gid (%q) for %s: %v", gid.Gid, src, err)
+			return fmt.Errorf("cannot parse gid (%q): %w", gid.Gid, err)
 		}
 	}
 
 	switch {
 	case st.Mode().IsRegular():
-		hdr.Size = st.Size()
+		// Files on virtual filesystems report a size of 0, so their size is only known once read.
+		if st.Size() == 0 && (spoolEmpty || isVirtualFile(src)) {
+			needBuffer = true
+			break
+		}
+		if hdr.Size, err = opts.contentSize(st.Size()); err != nil {
+			return err
+		}
 	case st.Mode()&(os.ModeCharDevice|os.ModeDevice|os.ModeNamedPipe) != 0:
 		needBuffer = true
 	case st.IsDir():
@@ -471,7 +2212,11 @@ func addFile(w *tar.Writer, src, dest string, opts *FileOpts, allowRecursive boo
 	case st.Mode()&os.ModeSymlink == os.ModeSymlink:
 		hdr.Name = dest
 		link, err := os.Readlink(src)
-		failOnError("cannot resolve symlink", err)
+		if skipOnError(src, err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot resolve symlink: %w", err)
+		}
 		if strings.HasPrefix(src, "/proc/self/fd/") && strings.HasPrefix(link, "pipe:[") && strings.HasSuffix(link, "]") { // Special case: <(proc) pipe
 			needBuffer = true
 			break
@@ -479,22 +2224,74 @@ func addFile(w *tar.Writer, src, dest string, opts *FileOpts, allowRecursive boo
 		hdr.Typeflag = tar.TypeSymlink
 		hdr.Linkname = link
 	default:
-		log.Print("skipping file: ", src, ": cannot add file")
-		return
+		warnf("skipping file: %s: cannot add file", src)
+		recordSkip(src, skipUnsupported, "cannot add file of type "+(st.Mode()&os.ModeType).String(), nil)
+		return nil
 	}
 
 	if shouldSkip(skipDestGlobs, hdr.Name) {
-		return
+		return nil
+	}
+
+	// diff-layer only writes changed entries, and only writes unchanged directories that contain
+	// them.
+	isPending := false
+	if isUnchanged(src, dest, st) {
+		debugf("%s: unchanged", hdr.Name)
+		unchanged[hdr.Name] = struct{}{}
+		if !st.IsDir() {
+			return nil
+		}
+		isPending = order != orderDepthFirst
+	}
+
+	if hdr.Typeflag == tar.TypeReg && !needBuffer || hdr.Typeflag == tar.TypeDir {
+		setXattrs(hdr, src)
 	}
 
 	opts.setHeaderFields(hdr)
+	transformLink(hdr)
+	hooked := !isPending && hooksApply()
+
+	// Under depth-first ordering, a directory's contents are added before its own entry.
+	recurse := st.Mode().IsDir() && allowRecursive && opts.allowRecursive()
+	if recurse && order == orderDepthFirst {
+		addRecursive(w, src, dest, dirOpts)
+		recurse = false
+	}
 
 	switch path.Clean(hdr.Name) {
 	case "./", ".", "..", "/":
 		if hdr.Typeflag == tar.TypeDir {
 			goto addDirOnly
 		}
-		return
+		return nil
+	}
+
+	if precomputing {
+		written[hdr.Name] = struct{}{}
+		recordShardEntry(hdr)
+		totals.entries++
+		if hdr.Typeflag == tar.TypeReg && !needBuffer {
+			totals.bytes += hdr.Size
+		}
+		goto addDirOnly
+	}
+
+	// A pre-add hook may flush or otherwise change a file, so its size is taken again afterward.
+	if hooked && runEntryHooks("pre-add", preAddHooks, src, hdr) && hdr.Typeflag == tar.TypeReg && !needBuffer {
+		stat := os.Lstat
+		if followLinks {
+			stat = os.Stat
+		}
+		if st, err = stat(src); skipOnError(src, err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("stat error: %w", err)
+		}
+		if hdr.Size, err = opts.contentSize(st.Size()); err != nil {
+			return err
+		}
 	}
 
 	// Buffer input file if it's not a regular file
@@ -503,52 +2300,206 @@ func addFile(w *tar.Writer, src, dest string, opts *FileOpts, allowRecursive boo
 		if src == "-" {
 			file = os.Stdin
 		} else {
-			file, err = os.Open(src)
-			failOnError("open error: "+src, err)
+			file, err = openFile(src)
+			if skipOnError(src, err) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("open error: %w", err)
+			}
 		}
 
 		var buf bytes.Buffer
 		_, err := io.Copy(&buf, file)
-		failOnError("unable to buffer "+src, err)
-		hdr.Size = int64(buf.Len())
-		r = &buf
+		if skipOnError(src, err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to buffer: %w", err)
+		}
+		data := buf.Bytes()
+		if hdr.Size, err = opts.contentSize(int64(len(data))); err != nil {
+			return err
+		}
+		r = bytes.NewReader(data[opts.contentOffset():][:hdr.Size])
 
 		if src != "-" {
-			failOnError("unable to close "+src, file.Close())
+			if err := file.Close(); err != nil {
+				return fmt.Errorf("unable to close: %w", err)
+			}
 		}
 	}
 
-	failOnError("write header: "+hdr.Name, w.WriteHeader(hdr))
-	written[hdr.Name] = struct{}{}
+	// Open regular files before writing their header, so that a lock (if taken) covers the size
+	// recorded in the header.
+	if r == nil && hdr.Typeflag == tar.TypeReg {
+		file, err := openFile(src)
+		if skipOnError(src, err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read error: %w", err)
+		}
+		rr := newRetryReader(file)
+		defer rr.Close()
+		if lockFiles {
+			if err := lockShared(file); err != nil {
+				return fmt.Errorf("lock error: %w", err)
+			}
+			lst, err := file.Stat()
+			if err != nil {
+				return fmt.Errorf("stat error: %w", err)
+			}
+			if hdr.Size, err = opts.contentSize(lst.Size()); err != nil {
+				return err
+			}
+		}
+		if off := opts.contentOffset(); off > 0 {
+			if _, err := file.Seek(off, io.SeekStart); err != nil {
+				return fmt.Errorf("seek error: %w", err)
+			}
+			rr.off = off
+		}
+		r = rr
+	}
+
+	if isPending {
+		deferDir(hdr)
+		goto addDirOnly
+	}
+
+	if !withinLimits(hdr) {
+		return nil
+	}
+
+	failOnError("write header: "+hdr.Name, writeHeader(w, hdr))
+	if hdr.Typeflag != tar.TypeReg {
+		removeSource(src, hdr, opts)
+	}
+	if hooked {
+		// Post-add hooks run once the entry's content has been written.
+		defer runEntryHooks("post-add", postAddHooks, src, hdr)
+	}
 
 addDirOnly:
 	if st.Mode().IsDir() {
-		if allowRecursive && opts.allowRecursive() {
-			addRecursive(w, src, dest, opts)
+		if recurse {
+			addRecursive(w, src, dest, dirOpts)
 		}
-		return
+		return nil
 	}
 
-	if hdr.Typeflag != tar.TypeReg {
-		return
+	if precomputing || hdr.Typeflag != tar.TypeReg {
+		return nil
 	}
 
-	if r == nil {
-		file, err := os.Open(src)
-		failOnError("read error: "+src, err)
-		defer file.Close()
-		r = file
+	if resuming {
+		// The entry is already in the output, so its content doesn't need to be read.
+		failOnError("copy error: "+src, skipContent(w, hdr.Size))
+		failOnError("flush error: "+src, flushArchive(w))
+		return nil
+	}
+
+	var n int64
+	rr, _ := r.(*retryReader)
+	if rr != nil {
+		n, err = copyFile(w, rr, hdr.Size)
+	} else {
+		n, err = copyContent(w, io.LimitReader(r, hdr.Size))
+	}
+	if err != nil && rr != nil && err == rr.err && (ignoreFailedRead || keepGoing) {
+		// Only read errors can be ignored -- the header has already been written, so pad out the
+		// rest of the entry to keep the archive intact.
+		padEntry(w, src, hdr, n)
+		err = fmt.Errorf("%w (entry padded after %d of %d bytes)", err, n, hdr.Size)
+		if skipOnError(src, err) {
+			return nil
+		}
+		return err
 	}
-	n, err := io.Copy(w, r)
 	failOnError("copy error: "+src, err)
-	if n != hdr.Size {
-		log.Fatalf("copy error: size mismatch for %s: wrote %d, want %d", src, n, hdr.Size)
+	// Content past the end of a range is expected, so only a short read is a size change.
+	if n != hdr.Size || !opts.hasRange() && hasMore(r) {
+		return handleSizeChange(w, src, dest, opts, hdr, n)
 	}
 
-	failOnError("flush error: "+src, w.Flush())
+	failOnError("flush error: "+src, flushArchive(w))
+	removeSource(src, hdr, opts)
+	return nil
 }
 
-func concatenateTarFile(w *tar.Writer, src string) error {
+// handleSizeChange applies the size change policy to src, whose size no longer matches the size
+// recorded in its header after n bytes of its content were written. If src is added again, the
+// error adding it is returned.
+func handleSizeChange(w ArchiveWriter, src, dest string, opts *FileOpts, hdr *tar.Header, n int64) error {
+	// Growth is only noticed once the entry's full size has been written, so its new size isn't
+	// known.
+	what := fmt.Sprintf("grew past %d bytes", hdr.Size)
+	if n < hdr.Size {
+		what = fmt.Sprintf("shrank to %d of %d bytes", n, hdr.Size)
+	}
+	if sizeChange == sizeChangeFail {
+		fatalf("copy error: %s %s while being copied", src, what)
+	}
+
+	// The header has already been written, so the entry has to be filled out to its recorded size
+	// regardless of policy.
+	padEntry(w, src, hdr, n)
+
+	if sizeChange == sizeChangePad || sizeChangeRetrying {
+		warnf("%s %s while being copied: entry kept at its original size", src, what)
+		return nil
+	}
+
+	// Add the file again. The new entry supersedes the padded one when extracted.
+	warnf("%s %s while being copied: adding it again", src, what)
+	delete(written, hdr.Name)
+	sizeChangeRetrying = true
+	defer func() { sizeChangeRetrying = false }()
+	return addFile(w, src, dest, opts, false)
+}
+
+// padEntry fills out the remainder of an entry with zeroes after n bytes of its content were
+// written.
+func padEntry(w ArchiveWriter, src string, hdr *tar.Header, n int64) {
+	if n < hdr.Size {
+		_, err := copyContent(w, io.LimitReader(zeroReader{}, hdr.Size-n))
+		failOnError("copy error: "+src, err)
+	}
+	failOnError("flush error: "+src, flushArchive(w))
+}
+
+// hasMore returns whether r has at least one more byte to read.
+func hasMore(r io.Reader) bool {
+	var b [1]byte
+	n, _ := io.ReadFull(r, b[:])
+	return n > 0
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// concatenate concatenates the tar streams read from src, or standard input if src is empty or
+// "-", to w. With --keep-going, src is skipped if it can't be read before any of its entries were
+// written, since the archive can't be continued once part of a stream has been copied.
+func concatenate(w ArchiveWriter, src string) {
+	entries := atomic.LoadInt64(&stats.entries)
+	err := concatenateTarFile(w, src)
+	if err != nil && atomic.LoadInt64(&stats.entries) == entries {
+		checkAddError(src, fmt.Errorf("-A: %w", err))
+		return
+	}
+	failOnError("-A: error concatenating tar stream", err)
+}
+
+// concatenateTarFile copies the entries of the tar streams in src to w.
+func concatenateTarFile(w ArchiveWriter, src string) error {
+	if precomputing {
+		return nil
+	}
 	input := os.Stdin
 	if src != "" && src != "-" {
 		f, err := os.Open(src)
@@ -558,7 +2509,11 @@ func concatenateTarFile(w *tar.Writer, src string) error {
 		defer f.Close()
 		input = f
 	}
-	r := bufio.NewReader(input)
+	dr, err := decompressedReader(bufio.NewReader(input))
+	if err != nil {
+		return fmt.Errorf("cannot decompress: %w", err)
+	}
+	r := bufio.NewReader(dr)
 	for {
 		err := concatenateTarStream(w, r)
 		if errors.Is(err, io.EOF) {
@@ -569,7 +2524,7 @@ func concatenateTarFile(w *tar.Writer, src string) error {
 	}
 }
 
-func concatenateTarStream(w *tar.Writer, r *bufio.Reader) error {
+func concatenateTarStream(w ArchiveWriter, r *bufio.Reader) error {
 	_, err := r.ReadByte()
 	if err == io.EOF {
 		return err
@@ -596,52 +2551,105 @@ func concatenateTarStream(w *tar.Writer, r *bufio.Reader) error {
 			dup.Uid, dup.Uname = 0, ""
 		}
 
-		if shouldSkip(skipSrcGlobs, dup.Name) {
+		if shouldSkip(skipSrcGlobs, dup.Name) || !withinLimits(&dup) {
 			continue
 		}
 
-		if err := w.WriteHeader(&dup); err != nil {
+		if err := writeHeader(w, &dup); err != nil {
 			return fmt.Errorf("error copying %q header from tar stream: %w", hdr.Name, err)
 		}
-		written[hdr.Name] = struct{}{}
 
 		if hdr.Size > 0 {
 			f := io.LimitReader(t, hdr.Size)
-			if _, err := io.Copy(w, f); err != nil {
+			if _, err := copyContent(w, f); err != nil {
 				return fmt.Errorf("error copying %q from tar stream: %w", hdr.Name, err)
 			}
 		}
 	}
 }
 
-func addRecursive(w *tar.Writer, src, prefix string, opts *FileOpts) {
-	src = strings.TrimRight(src, "/")
-	src = filepath.Clean(src) + "/"
-	_ = filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
-		if info.IsDir() && !strings.HasSuffix(p, "/") {
-			p += "/"
+// writeHeader writes hdr to w and records it as written.
+func writeHeader(w ArchiveWriter, hdr *tar.Header) error {
+	if err := writePendingDirs(w, hdr.Name); err != nil {
+		return err
+	}
+	if err := beginEntry(w); err != nil {
+		return err
+	}
+	setCurrentEntry(hdr.Name)
+	if ownerNames {
+		hdr.Uid, hdr.Gid = 0, 0
+	}
+	normalizeReproducible(hdr)
+	debugf("header: name=%q type=%q mode=%#o size=%d uid=%d gid=%d uname=%q gname=%q mtime=%v linkname=%q",
+		hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Size, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname, hdr.ModTime, hdr.Linkname)
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	written[hdr.Name] = struct{}{}
+	atomic.AddInt64(&stats.entries, 1)
+	listEntry(hdr)
+	addedEvent(hdr)
+	if warnSize > 0 && hdr.Size > warnSize {
+		warnf("%s: large file (%s, over %s)", hdr.Name, humanBytes(hdr.Size), humanBytes(warnSize))
+	}
+	return nil
+}
+
+// copyContent copies the content of the current entry from r to w.
+func copyContent(w ArchiveWriter, r io.Reader) (int64, error) {
+	if len(copyBuffer) != copyBufferSize {
+		copyBuffer = make([]byte, copyBufferSize)
+	}
+	return io.CopyBuffer(&countingWriter{w: w, n: &stats.bytes}, r, copyBuffer)
+}
+
+func addRecursive(w ArchiveWriter, src, prefix string, opts *FileOpts) {
+	const sep = string(filepath.Separator)
+	src = filepath.Clean(src)
+	if !strings.HasSuffix(src, sep) {
+		src += sep
+	}
+	if followLinks {
+		defer enterDir(src)()
+	}
+	walkTree(src, func(p string, info os.FileInfo, err error) {
+		if err != nil {
+			walkError(p, err)
+			if info == nil {
+				return
+			}
+			// The directory couldn't be read, but its entry can still be added
 		}
-		if p == src || shouldSkip(skipSrcGlobs, p) {
-			return nil
+		if info.IsDir() && !strings.HasSuffix(p, sep) {
+			p += sep
 		}
-		dest := path.Join(prefix, strings.TrimPrefix(p, src))
-		addFile(w, p, dest, opts, false)
-		return nil
+		if p == src || shouldSkip(skipSrcGlobs, filepath.ToSlash(p)) {
+			return
+		}
+		dest := path.Join(prefix, filepath.ToSlash(strings.TrimPrefix(p, src)))
+		// walkTree doesn't follow symlinks, so linked directories are walked by addFile.
+		checkAddError(p, addFile(w, p, dest, opts, followLinks && info.Mode()&os.ModeSymlink != 0))
 	})
 }
 
 func failOnError(prefix string, err error) {
 	if err != nil {
-		log.Fatalf("%s: %v", prefix, err)
+		logEvent(levelError, "", prefix, err)
+		exit(exitFatal)
 	}
 }
 
 func shouldSkip(set []Matcher, s string) bool {
 	if _, seen := written[s]; seen && skipWritten {
+		debugf("filter: %s: skipped, already written", s)
+		recordSkip(s, skipDuplicate, "already written", nil)
 		return seen
 	}
 	for _, m := range set {
 		if !m.matches(s) {
+			debugf("filter: %s: skipped by %v", s, m)
+			recordSkip(s, skipFiltered, m.String(), nil)
 			return true
 		}
 	}
@@ -659,9 +2667,16 @@ type FileOpts struct {
 	dir      bool
 	link     string
 	linkType byte
+	wh       bool
+	opaque   bool
 
 	mode int64
 
+	// Byte range of the source to add as content.
+	offset    int64
+	length    int64
+	hasLength bool
+
 	mtime time.Time
 	atime time.Time
 	ctime time.Time
@@ -675,9 +2690,18 @@ func newFileOpts() *FileOpts {
 
 var timeLayouts = []string{
 	time.RFC3339Nano,
-	// TODO: add additional layouts if needed
+	// Layouts without a zone are interpreted in timeZone.
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
 }
 
+// timeZone is the location that timestamps without a zone are parsed in and that listings are
+// displayed in.
+var timeZone = time.Local
+
 func (fo *FileOpts) parse(opts string) error {
 	fields := strings.FieldsFunc(opts, isComma)
 	if len(fields) == 0 {
@@ -697,6 +2721,9 @@ func (fo *FileOpts) parse(opts string) error {
 			if fo.link != "" {
 				return fmt.Errorf("may not set dir with link=%s", fo.link)
 			}
+			if fo.wh || fo.opaque {
+				return errors.New("may not set dir with a whiteout")
+			}
 			fo.dir = true
 			fo.noRecursive = true
 		case strings.HasPrefix(f, "link="):
@@ -706,6 +2733,9 @@ func (fo *FileOpts) parse(opts string) error {
 			if fo.dir {
 				return errors.New("may not set link with dir")
 			}
+			if fo.wh || fo.opaque {
+				return errors.New("may not set link with a whiteout")
+			}
 			if fo.link = f[len("link="):]; fo.link == "" {
 				return errors.New("may not set an empty link name")
 			}
@@ -717,10 +2747,22 @@ func (fo *FileOpts) parse(opts string) error {
 			if fo.dir {
 				return errors.New("may not set link with dir")
 			}
+			if fo.wh || fo.opaque {
+				return errors.New("may not set link with a whiteout")
+			}
 			if fo.link = f[len("ref="):]; fo.link == "" {
 				return errors.New("may not set an empty link name")
 			}
 			fo.linkType = tar.TypeLink
+		case f == "wh", f == "opaque":
+			if fo.dir || fo.link != "" {
+				return fmt.Errorf("may not set %s with dir or link", f)
+			}
+			if fo.wh || fo.opaque {
+				return errors.New("whiteout already assigned to file")
+			}
+			fo.wh, fo.opaque = f == "wh", f == "opaque"
+			fo.noRecursive = true
 		case f == "nouser":
 			fo.nouser = true
 		case strings.HasPrefix(f, "uid="):
@@ -757,6 +2799,24 @@ func (fo *FileOpts) parse(opts string) error {
 			} else if fo.mode == 0 {
 				return errors.New("invalid mode: may not be 0")
 			}
+		case strings.HasPrefix(f, "mode-from="):
+			ref := f[len("mode-from="):]
+			st, err := os.Stat(ref)
+			if err != nil {
+				return fmt.Errorf("mode-from: %v", err)
+			}
+			if fo.mode = platform.Mode(st); fo.mode == 0 {
+				return fmt.Errorf("mode-from: %s has a mode of 0", ref)
+			}
+		case strings.HasPrefix(f, "offset="):
+			if fo.offset, err = parseSize(f[len("offset="):]); err != nil {
+				return fmt.Errorf("invalid offset: %v", err)
+			}
+		case strings.HasPrefix(f, "length="):
+			if fo.length, err = parseSize(f[len("length="):]); err != nil {
+				return fmt.Errorf("invalid length: %v", err)
+			}
+			fo.hasLength = true
 		case strings.HasPrefix(f, "mtime=") || strings.HasPrefix(f, "atime=") || strings.HasPrefix(f, "ctime="):
 			var tp *time.Time
 			switch f[0] {
@@ -777,7 +2837,7 @@ func (fo *FileOpts) parse(opts string) error {
 
 			for _, layout := range timeLayouts {
 				var t time.Time
-				if t, err = time.Parse(layout, ts); err == nil {
+				if t, err = time.ParseInLocation(layout, ts, timeZone); err == nil {
 					*tp = t
 					break
 				}
@@ -834,13 +2894,11 @@ func (f *FileOpts) getUidGid(fi os.FileInfo) (userent *user.User, groupent *user
 		return
 	}
 
-	stat, ok := fi.Sys().(*syscall.Stat_t)
+	uid, gid, ok := platform.Owner(fi)
 	if !ok {
 		return nil, nil, false
 	}
 
-	uid, gid := strconv.FormatUint(uint64(stat.Uid), 10), strconv.FormatUint(uint64(stat.Gid), 10)
-
 	if userent == nil {
 		u, err := user.LookupId(uid)
 		if err != nil {
@@ -860,6 +2918,37 @@ func (f *FileOpts) getUidGid(fi os.FileInfo) (userent *user.User, groupent *user
 	return
 }
 
+// hasRange returns whether only a byte range of the source is added as content.
+func (f *FileOpts) hasRange() bool {
+	return f != nil && (f.offset != 0 || f.hasLength)
+}
+
+func (f *FileOpts) contentOffset() int64 {
+	if f == nil {
+		return 0
+	}
+	return f.offset
+}
+
+// contentSize returns the size of the content added from a source of the given size, after
+// applying the offset and length options.
+func (f *FileOpts) contentSize(size int64) (int64, error) {
+	if !f.hasRange() {
+		return size, nil
+	}
+	if f.offset > size {
+		return 0, fmt.Errorf("offset %d is past the end of the file (%d bytes)", f.offset, size)
+	}
+	size -= f.offset
+	if f.hasLength {
+		if f.length > size {
+			return 0, fmt.Errorf("range %d+%d is past the end of the file (%d bytes)", f.offset, f.length, f.offset+size)
+		}
+		size = f.length
+	}
+	return size, nil
+}
+
 func (f *FileOpts) allowRecursive() bool {
 	return f == nil || !f.noRecursive
 }
@@ -902,3 +2991,41 @@ func (f *FileOpts) setHeaderFields(hdr *tar.Header) {
 func isComma(r rune) bool {
 	return r == ','
 }
+
+var sizeSuffixes = []struct {
+	suffix string
+	shift  uint
+}{
+	{"K", 10}, {"M", 20}, {"G", 30}, {"T", 40},
+}
+
+// parseSize parses a byte count with an optional binary K, M, G, or T suffix (e.g., 512, 64K, 2G).
+// A trailing B or iB after the suffix is permitted.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	var shift uint
+	for _, suf := range sizeSuffixes {
+		if strings.HasSuffix(num, suf.suffix) {
+			num, shift = strings.TrimSuffix(num, suf.suffix), suf.shift
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	} else if n < 0 || n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("size out of range: %q", s)
+	}
+	return n << shift, nil
+}
+
+// formatSize formats a byte count using the largest binary suffix that represents it exactly.
+func formatSize(n int64) string {
+	for i := len(sizeSuffixes) - 1; i >= 0; i-- {
+		suf := sizeSuffixes[i]
+		if unit := int64(1) << suf.shift; n >= unit && n%unit == 0 {
+			return strconv.FormatInt(n/unit, 10) + suf.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
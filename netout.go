@@ -0,0 +1,136 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// dialTimeout is the time allowed for each attempt to connect to a network output.
+const dialTimeout = 30 * time.Second
+
+var (
+	tlsCAPath   string // CA certificates to verify a tls:// output with, instead of the system's
+	tlsCertPath string // Client certificate for a tls:// output
+	tlsKeyPath  string // Client key for a tls:// output
+
+	// outputConn is the connection the archive is written to, if the output is a network address.
+	outputConn net.Conn
+)
+
+// networkOutput parses outputPath as a network address. It returns ok=false if outputPath is not a
+// URL. Supported URLs are tcp://HOST:PORT, tls://HOST:PORT, and unix:///PATH.
+func networkOutput() (network, addr string, useTLS, ok bool) {
+	scheme, addr, ok := strings.Cut(outputPath, "://")
+	if !ok {
+		return "", "", false, false
+	}
+	switch scheme {
+	case "tcp":
+		return "tcp", addr, false, true
+	case "tls":
+		return "tcp", addr, true, true
+	case "unix":
+		return "unix", addr, false, true
+	}
+	usageErrorf("-f: unsupported scheme %q (to write to a file, use ./%s)", scheme, outputPath)
+	return
+}
+
+// dialOutput connects to the network output. Failed connections are retried up to ioRetries
+// times.
+func dialOutput(network, addr string, useTLS bool) net.Conn {
+	var config *tls.Config
+	if useTLS {
+		config = tlsConfig(addr)
+	}
+	for attempt := 0; ; attempt++ {
+		conn, err := net.DialTimeout(network, addr, dialTimeout)
+		if err == nil && config != nil {
+			tc := tls.Client(conn, config)
+			if err = tc.Handshake(); err != nil {
+				_ = conn.Close()
+			}
+			conn = tc
+		}
+		if err == nil {
+			return conn
+		}
+		if attempt >= ioRetries {
+			failOnError("cannot connect to "+outputPath, err)
+		}
+		logEvent(levelInfo, "", fmt.Sprintf("connect error (retry %d of %d)", attempt+1, ioRetries), err)
+		time.Sleep(ioRetryDelay)
+	}
+}
+
+// tlsConfig returns the TLS configuration for connecting to addr.
+func tlsConfig(addr string) *tls.Config {
+	host, _, err := net.SplitHostPort(addr)
+	failOnUsageError("-f: invalid address", err)
+	config := &tls.Config{ServerName: host}
+
+	if tlsCAPath != "" {
+		pem, err := os.ReadFile(tlsCAPath)
+		failOnError("--tls-ca: cannot read CA certificates", err)
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			fatalf("--tls-ca: no certificates found in %s", tlsCAPath)
+		}
+	}
+
+	if tlsCertPath != "" || tlsKeyPath != "" {
+		if tlsCertPath == "" || tlsKeyPath == "" {
+			usageErrorf("--tls-cert and --tls-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
+		failOnError("cannot load client certificate", err)
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// closeConn closes the write side of the connection, so the receiver sees the end of the archive,
+// and then the connection.
+func closeConn(conn net.Conn) error {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	var err error
+	if cw, ok := conn.(closeWriter); ok {
+		err = cw.CloseWrite()
+	}
+	if cerr := conn.Close(); err == nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	return err
+}
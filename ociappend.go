@@ -0,0 +1,141 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+var (
+	// appendDir, if set, is the OCI image layout that oci-append adds a layer to.
+	appendDir string
+
+	// appendIndex is the layout's index, and appendAt the index of the image being appended to.
+	appendIndex []blob
+	appendAt    int
+
+	// appendLayers and appendDiffIDs are the layers of the image being appended to.
+	appendLayers  []blob
+	appendDiffIDs []string
+)
+
+func ociAppendUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar oci-append [-h|--help] DIR [OPTION|FILE]...
+
+Adds a layer to an image in the OCI image layout DIR. The files given are
+written as a new layer on top of the image's layers, and the image's config
+(diff_ids and history) and manifest are updated to include it. The image's
+entry in DIR's index.json is replaced by the updated image, keeping its
+annotations.
+
+Global options and per-file options are the same as when writing an archive.
+If DIR's index has more than one image, select one with --image=NAME:TAG,
+matching its io.containerd.image.name or org.opencontainers.image.ref.name
+annotation. The --image-* options change the config as they do for
+--oci-layout, except for --image-config, which may not be used. Layers given
+by --image-layer are added between the image's layers and the new one.
+`)
+}
+
+// ociAppendArgs parses the layout given to oci-append and returns the remaining arguments.
+func ociAppendArgs(argv Args) Args {
+	if len(argv.args) == 0 || argv.args[0] == "-h" || argv.args[0] == "--help" {
+		ociAppendUsage()
+		exit(exitUsage)
+	}
+	appendDir, _ = argv.Shift()
+	return argv
+}
+
+// loadAppendImage reads the image being appended to from the layout, setting the base config to
+// its config. Called by checkImage once ociLayout is set to appendDir.
+func loadAppendImage() {
+	if imageConfig != "" {
+		usageErrorf("oci-append: --image-config may not be used")
+	} else if len(imageTags) > 1 {
+		usageErrorf("oci-append: --image may only be given once")
+	}
+
+	var index struct {
+		Manifests []blob `json:"manifests"`
+	}
+	readLayoutJSON("index.json", &index)
+	appendIndex, appendAt = index.Manifests, -1
+	for i, m := range appendIndex {
+		if len(imageTags) == 0 && len(appendIndex) == 1 ||
+			len(imageTags) == 1 && (m.Annots["io.containerd.image.name"] == imageTags[0] ||
+				m.Annots["org.opencontainers.image.ref.name"] == imageTags[0]) {
+			appendAt = i
+			break
+		}
+	}
+	switch {
+	case appendAt > -1:
+	case len(imageTags) == 0:
+		usageErrorf("oci-append: %s has %d images; select one with --image", appendDir, len(appendIndex))
+	default:
+		fatalf("oci-append: no image named %s in %s", imageTags[0], appendDir)
+	}
+	if mt := appendIndex[appendAt].MediaType; mt != mediaTypeManifest && mt != mediaTypeDockerManifest {
+		fatalf("oci-append: cannot append to %s (%s)", appendIndex[appendAt].Digest, mt)
+	}
+
+	var manifest struct {
+		Config blob   `json:"config"`
+		Layers []blob `json:"layers"`
+	}
+	readLayoutJSON(appendIndex[appendAt].path(), &manifest)
+	readLayoutJSON(manifest.Config.path(), &imageBase)
+	appendLayers = manifest.Layers
+
+	// Layers in the manifest may be compressed, so their diff IDs come from the config.
+	rootfs, _ := imageBase["rootfs"].(map[string]any)
+	diffIDs, _ := rootfs["diff_ids"].([]any)
+	for _, id := range diffIDs {
+		if id, ok := id.(string); ok {
+			appendDiffIDs = append(appendDiffIDs, id)
+		}
+	}
+	if len(appendDiffIDs) != len(appendLayers) {
+		fatalf("oci-append: image config has %d diff_ids for %d layers", len(appendDiffIDs), len(appendLayers))
+	}
+}
+
+// appendedIndex returns the layout's index with the image being appended to replaced by m.
+func appendedIndex(m blob) []blob {
+	m.Annots = appendIndex[appendAt].Annots
+	index := append([]blob{}, appendIndex...)
+	index[appendAt] = m
+	return index
+}
+
+func readLayoutJSON(name string, v any) {
+	p, err := os.ReadFile(layoutPath(name))
+	failOnError("oci-append: cannot read "+name, err)
+	failOnError("oci-append: cannot parse "+name, json.Unmarshal(p, v))
+}
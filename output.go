@@ -0,0 +1,175 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// outputPath is the file the archive is written to. If empty or "-", it's written to standard
+	// output.
+	outputPath string
+
+	// outputFile is the opened output, if the output is a file.
+	outputFile *os.File
+
+	// outputTemp, if set, is the temporary file the output is written to. It's renamed to
+	// outputPath once the archive is complete, so that a partial archive never appears there.
+	outputTemp string
+
+	// fsyncOutput controls whether the output is synced to disk before mtar exits successfully.
+	fsyncOutput bool
+)
+
+// isFileOutput returns whether the archive is written to a file given by -f.
+func isFileOutput() bool {
+	return outputPath != "" && outputPath != "-" && !strings.Contains(outputPath, "://")
+}
+
+// openOutput opens the file or connection the archive is written to. When resuming a run, the
+// existing output is truncated to the end of the last entry recorded in the state file and
+// writing continues from there.
+func openOutput() io.Writer {
+	if remoteURL != "" {
+		if outputPath != "" {
+			usageErrorf("--remote: cannot be used with -f")
+		}
+		return openRemote()
+	}
+	if network, addr, useTLS, ok := networkOutput(); ok {
+		outputConn = dialOutput(network, addr, useTLS)
+		return outputConn
+	}
+	outputFile = createOutput()
+	return outputFile
+}
+
+func createOutput() *os.File {
+	if !isFileOutput() {
+		return os.Stdout
+	}
+	// The output is synced and signed by path after -C may have changed the working directory.
+	var err error
+	outputPath, err = filepath.Abs(outputPath)
+	failOnError("cannot create output", err)
+	if !resuming {
+		if !useOutputTemp() {
+			f, err := os.Create(outputPath)
+			failOnError("cannot create output", err)
+			return f
+		}
+		// The name only needs to be unique to this run, and the file is created with O_EXCL.
+		dir, base := filepath.Split(outputPath)
+		outputTemp = filepath.Join(dir, fmt.Sprintf(".%s.mtar-%d.tmp", base, os.Getpid()))
+		f, err := os.OpenFile(outputTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			outputTemp = ""
+		}
+		failOnError("cannot create output", err)
+		return f
+	}
+
+	f, err := os.OpenFile(outputPath, os.O_RDWR, 0)
+	failOnError("--state: cannot open output to resume", err)
+	st, err := f.Stat()
+	failOnError("--state: cannot stat output", err)
+	if st.Size() < resumeOffset {
+		fatalf("--state: output is %d bytes, shorter than the %d bytes recorded in %s", st.Size(), resumeOffset, statePath)
+	}
+	failOnError("--state: cannot truncate output", f.Truncate(resumeOffset))
+	_, err = f.Seek(resumeOffset, io.SeekStart)
+	failOnError("--state: cannot seek output", err)
+	return f
+}
+
+// useOutputTemp returns whether the output should be written to a temporary file and renamed once
+// complete. The output is written in place if it's resumable with --state, since the partial
+// archive is what's resumed, or if it already exists and isn't a regular file (e.g., /dev/null).
+// squashfs images are already moved into place by their writer.
+func useOutputTemp() bool {
+	if statePath != "" || outputFormat == "squashfs" {
+		return false
+	}
+	st, err := os.Stat(outputPath)
+	return err != nil || st.Mode().IsRegular()
+}
+
+// removeOutputTemp removes the temporary output, if there is one. It's called when mtar exits with
+// an error, so that the partial archive doesn't linger. Once any source has been removed by
+// --remove-files, the output is the only copy of it, so it's never removed.
+func removeOutputTemp() {
+	if outputTemp != "" && !sourcesRemoved {
+		os.Remove(outputTemp)
+		outputTemp = ""
+	}
+}
+
+// syncOutput syncs the output to disk if it's a regular file. Pipes and the like can't be synced.
+func syncOutput() error {
+	if outputFile == nil {
+		return nil
+	}
+	if st, err := outputFile.Stat(); err != nil || !st.Mode().IsRegular() {
+		return err
+	}
+	return outputFile.Sync()
+}
+
+// closeOutput closes the output, moving it into place if it was written to a temporary file. If
+// fsyncOutput is set, the output and the directory containing it are synced to disk.
+func closeOutput() error {
+	if err := closeOutputFilters(); err != nil {
+		return err
+	}
+	if remoteCmd != nil {
+		return closeRemote()
+	} else if outputConn != nil {
+		return closeConn(outputConn)
+	}
+	if fsyncOutput {
+		if err := syncOutput(); err != nil {
+			return err
+		}
+	}
+	if err := outputFile.Close(); err != nil {
+		return err
+	}
+	if outputTemp != "" {
+		verifyFile(outputTemp)
+		if err := os.Rename(outputTemp, outputPath); err != nil {
+			return err
+		}
+		outputTemp = ""
+	}
+	if fsyncOutput && isFileOutput() {
+		return syncDir(filepath.Dir(outputPath))
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// stats tracks the progress of the current run. Counters are updated atomically, since they are
+// read by the progress display while the archive is being written.
+var stats struct {
+	entries  int64 // Entries written
+	bytes    int64 // File content bytes written
+	outBytes int64 // Bytes written to the output
+	zBytes   int64 // Bytes written to the output after compression
+
+	mu      sync.Mutex
+	current string // Name of the entry being written
+}
+
+func setCurrentEntry(name string) {
+	stats.mu.Lock()
+	stats.current = name
+	stats.mu.Unlock()
+}
+
+func currentEntry() string {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return stats.current
+}
+
+// countingWriter is a writer that atomically adds the number of bytes written to n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// isTerminal returns whether f is a terminal. Other character devices, such as /dev/null, aren't.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+const progressInterval = 250 * time.Millisecond
+
+// progressDisplay redraws a single status line on stderr until stopped. While it is running, log
+// records are routed through it so that messages are not interleaved with the status line.
+type progressDisplay struct {
+	mu    sync.Mutex
+	start time.Time
+	width int
+	drawn bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startProgress() *progressDisplay {
+	p := &progressDisplay{
+		start: time.Now(),
+		width: 80,
+		done:  make(chan struct{}),
+	}
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 20 {
+		p.width = cols
+	}
+
+	setLogOutput(p)
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+func (p *progressDisplay) run() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.draw()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// stop draws the final status line and restores log output to stderr.
+func (p *progressDisplay) stop() {
+	close(p.done)
+	p.wg.Wait()
+	p.draw()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, _ = io.WriteString(os.Stderr, "\n")
+	p.drawn = false
+	setLogOutput(os.Stderr)
+}
+
+// Write clears the status line, if drawn, before writing p to stderr. The line is redrawn on the
+// next tick.
+func (p *progressDisplay) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	return os.Stderr.Write(b)
+}
+
+func (p *progressDisplay) clear() {
+	if p.drawn {
+		_, _ = io.WriteString(os.Stderr, "\r\x1b[K")
+		p.drawn = false
+	}
+}
+
+func (p *progressDisplay) draw() {
+	line := p.status()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	_, _ = io.WriteString(os.Stderr, line)
+	p.drawn = true
+}
+
+func (p *progressDisplay) status() string {
+	var b strings.Builder
+	writeCounts(&b, time.Since(p.start))
+	if cur := currentEntry(); cur != "" {
+		b.WriteString(": ")
+		// Keep the line within the terminal width, trimming the front of the path if needed.
+		if room := p.width - 1 - b.Len(); room < len(cur) {
+			if room <= 3 {
+				cur = ""
+			} else {
+				cur = "..." + cur[len(cur)-room+3:]
+			}
+		}
+		b.WriteString(cur)
+	}
+	return b.String()
+}
+
+// writeCounts writes the number of entries and bytes written so far, and the rate they were
+// written at over elapsed, to b.
+func writeCounts(b *strings.Builder, elapsed time.Duration) {
+	var (
+		entries  = atomic.LoadInt64(&stats.entries)
+		bytes    = atomic.LoadInt64(&stats.bytes)
+		outBytes = atomic.LoadInt64(&stats.outBytes)
+		rate     = float64(outBytes) / elapsed.Seconds()
+	)
+
+	if totals.known {
+		var pct float64 = 100
+		if totals.bytes > 0 {
+			pct = 100 * float64(bytes) / float64(totals.bytes)
+		} else if totals.entries > 0 {
+			pct = 100 * float64(entries) / float64(totals.entries)
+		}
+		if pct > 100 {
+			pct = 100
+		}
+		fmt.Fprintf(b, "%5.1f%% %d/%d entries, %s/%s", pct, entries, totals.entries, humanBytes(bytes), humanBytes(totals.bytes))
+		if bytes > 0 && bytes < totals.bytes {
+			eta := time.Duration(float64(elapsed) * float64(totals.bytes-bytes) / float64(bytes))
+			fmt.Fprintf(b, ", %s/s, ETA %v", humanBytes(int64(rate)), eta.Round(time.Second))
+		} else {
+			fmt.Fprintf(b, ", %s/s", humanBytes(int64(rate)))
+		}
+	} else {
+		fmt.Fprintf(b, "%d entries, %s, %s/s", entries, humanBytes(outBytes), humanBytes(int64(rate)))
+	}
+	if compression != "" {
+		fmt.Fprintf(b, " (%s %s)", humanBytes(atomic.LoadInt64(&stats.zBytes)), compression)
+	}
+}
+
+// humanBytes formats n as an approximate size with a binary unit suffix (e.g., 1.5 MiB).
+func humanBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	f, i := float64(n)/1024, 0
+	for ; f >= 1024 && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	return strconv.FormatFloat(f, 'f', 1, 64) + " " + units[i:i+1] + "iB"
+}
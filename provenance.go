@@ -0,0 +1,111 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// provenance controls whether a PAX global header describing how the archive was produced is
+// written before the first entry.
+var provenance bool
+
+// checkProvenance checks that --provenance is used with an output that can hold a PAX global
+// header.
+func checkProvenance() {
+	if provenance && outputFormat != "tar" {
+		usageErrorf("--provenance: not supported with -F %s", outputFormat)
+	}
+}
+
+// provenanceRecords returns the PAX records written by --provenance.
+func provenanceRecords() map[string]string {
+	ver, revision := buildVersion()
+	if revision != "" {
+		ver += " " + revision
+	}
+	records := map[string]string{
+		"MTAR.version": ver,
+		"MTAR.go":      runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH,
+		"MTAR.command": quoteArgs(os.Args),
+	}
+	if zstdDict != nil {
+		records["MTAR.zstd.dict"] = strconv.FormatUint(uint64(zstdDictID), 10)
+	}
+	if host, err := os.Hostname(); err == nil {
+		records["MTAR.hostname"] = host
+	} else {
+		warnf("--provenance: cannot get hostname: %v", err)
+	}
+	// The build info covers the module versions and checksums, toolchain, and build settings
+	// that went into mtar, so its digest identifies the build without recording all of it.
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		h := newDigest()
+		_, _ = io.WriteString(h, bi.String())
+		records["MTAR.build"] = digestAlgo + ":" + hex.EncodeToString(h.Sum(nil))
+	}
+	return records
+}
+
+// writeProvenance writes the --provenance global header. It counts as an entry so that it is
+// skipped like any other when resuming with --state.
+func writeProvenance(w ArchiveWriter) {
+	if !provenance || precomputing {
+		return
+	}
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		Format:     tar.FormatPAX,
+		PAXRecords: provenanceRecords(),
+	}
+	failOnError("--provenance", beginEntry(w))
+	failOnError("--provenance", w.WriteHeader(hdr))
+	atomic.AddInt64(&stats.entries, 1)
+}
+
+// quoteArgs joins args as a command line, quoting any that a shell would split or expand.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if arg == "" || strings.IndexFunc(arg, needsQuote) >= 0 {
+			quoted[i] = shellQuote(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func needsQuote(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_=+:,./@%", r))
+}
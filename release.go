@@ -0,0 +1,274 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// releaseTemplate is the default template for the names of release archives.
+const releaseTemplate = "{name}-{version}-{os}-{arch}"
+
+var (
+	// releaseVars, if not nil, are the variables for the release command's name template.
+	releaseVars map[string]string
+
+	releaseDir  string
+	releaseBase string // Path of the release archives, without extensions
+	releaseSign string // gpg, gpg:KEYID, or sigstore
+)
+
+func releaseUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar release [-h|--help] [RELEASE OPTION]... [--] [OPTION|FILE]...
+
+Writes a release: the archive (NAME.tar), a gzip-compressed copy of it
+(NAME.tar.gz), and a SHA256SUMS file listing both, optionally signed. NAME is
+given by a template. Release options come first; the rest are the same global
+options, per-file options, and files as when writing an archive, except that
+the output may not be set. With --digest-algo=sha512 or --digest-algo=blake3,
+SHA256SUMS is instead SHA512SUMS or B3SUMS, as read by sha512sum -c or
+b3sum -c.
+
+Release options:
+
+  --template=TEMPLATE
+    Set the template for NAME (default: {name}-{version}-{os}-{arch}). A
+    trailing .tar or .tar.gz is ignored. TEMPLATE may use the following
+    variables:
+      * {name}     Set by --name (default: the working directory's name).
+      * {version}  Set by --version. Required if used.
+      * {os}       Set by --os (default: the OS mtar was built for).
+      * {arch}     Set by --arch (default: the architecture mtar was built
+                   for).
+      * {KEY}      Set by --var=KEY=VALUE.
+  --name=NAME | --version=VERSION | --os=OS | --arch=ARCH
+    Set a template variable.
+  --var=KEY=VALUE
+    Set the template variable KEY. May be repeated.
+  --dir=DIR
+    Write the release files to DIR (default: the working directory).
+  --sign=gpg[:KEYID] | --sign=sigstore
+    Sign SHA256SUMS. With gpg, write an armored detached signature to
+    SHA256SUMS.asc, using the key KEYID if given or else gpg's default key.
+    With sigstore, sign it with cosign's keyless flow and write the bundle
+    to SHA256SUMS.sigstore.json.
+`)
+}
+
+// releaseArgs parses the release options and returns the remaining arguments. The archive is
+// written to the release's NAME.tar, and finishRelease writes the other files once it's done.
+func releaseArgs(argv Args) Args {
+	if len(argv.args) > 0 && (argv.args[0] == "-h" || argv.args[0] == "--help") {
+		releaseUsage()
+		exit(exitUsage)
+	}
+
+	wd, err := os.Getwd()
+	failOnError("release: cannot get working directory", err)
+	releaseVars = map[string]string{
+		"name": filepath.Base(wd),
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+	}
+	template := releaseTemplate
+	releaseDir = "."
+
+loop:
+	for len(argv.args) > 0 {
+		switch s := argv.args[0]; {
+		case s == "--":
+			argv.Shift()
+			break loop
+		case strings.HasPrefix(s, "--template="):
+			template = strings.TrimPrefix(s, "--template=")
+		case strings.HasPrefix(s, "--dir="):
+			releaseDir = strings.TrimPrefix(s, "--dir=")
+		case strings.HasPrefix(s, "--sign="):
+			releaseSign = strings.TrimPrefix(s, "--sign=")
+			if releaseSign != "sigstore" && releaseSign != "gpg" && !strings.HasPrefix(releaseSign, "gpg:") {
+				usageErrorf("release: --sign: expected gpg, gpg:KEYID, or sigstore, got %q", releaseSign)
+			}
+		case strings.HasPrefix(s, "--var="):
+			kv := strings.TrimPrefix(s, "--var=")
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" {
+				usageErrorf("release: --var: expected KEY=VALUE, got %q", kv)
+			}
+			releaseVars[k] = v
+		case strings.HasPrefix(s, "--name="), strings.HasPrefix(s, "--version="),
+			strings.HasPrefix(s, "--os="), strings.HasPrefix(s, "--arch="):
+			k, v, _ := strings.Cut(strings.TrimPrefix(s, "--"), "=")
+			releaseVars[k] = v
+		default:
+			break loop
+		}
+		argv.Shift()
+	}
+
+	name, err := expandReleaseName(template)
+	failOnUsageError("release: --template", err)
+	releaseBase = filepath.Join(releaseDir, name)
+	if releaseSign == "sigstore" {
+		_, err := exec.LookPath("cosign")
+		failOnError("release: --sign: cannot find cosign", err)
+	}
+	return argv
+}
+
+// expandReleaseName expands the variables in template. A trailing .tar or .tar.gz is removed.
+func expandReleaseName(template string) (string, error) {
+	template = strings.TrimSuffix(strings.TrimSuffix(template, ".gz"), ".tar")
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(template, '{')
+		if i == -1 {
+			sb.WriteString(template)
+			break
+		}
+		j := strings.IndexByte(template[i:], '}')
+		if j == -1 {
+			return "", fmt.Errorf("unterminated variable in %q", template)
+		}
+		key := template[i+1 : i+j]
+		v, ok := releaseVars[key]
+		if !ok {
+			return "", fmt.Errorf("{%s} is not set", key)
+		}
+		sb.WriteString(template[:i])
+		sb.WriteString(v)
+		template = template[i+j+1:]
+	}
+	name := sb.String()
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return name, nil
+}
+
+// checkRelease sets the output to the release archive. The output may not be set otherwise.
+func checkRelease() {
+	if releaseVars == nil {
+		return
+	}
+	if outputPath != "" || remoteURL != "" || imageMode || ociLayout != "" {
+		usageErrorf("release: the output may not be set (-f, --remote, --image, or --oci-layout)")
+	}
+	failOnError("release: cannot create directory", os.MkdirAll(releaseDir, 0777))
+	var err error
+	releaseBase, err = filepath.Abs(releaseBase)
+	failOnError("release: invalid directory", err)
+	outputPath = releaseBase + ".tar"
+}
+
+// finishRelease writes the compressed archive, checksum file, and signature once the archive is
+// complete.
+func finishRelease() {
+	if releaseVars == nil {
+		return
+	}
+	archive, compressed := releaseBase+".tar", releaseBase+".tar.gz"
+	failOnError("release: cannot compress archive", gzipFile(compressed, archive))
+	log.Printf("wrote %s", compressed)
+
+	sums := filepath.Join(filepath.Dir(releaseBase), digestSumsName())
+	failOnError("release: cannot write "+filepath.Base(sums), writeSums(sums, archive, compressed))
+	log.Printf("wrote %s", sums)
+
+	var cmd *exec.Cmd
+	var sig string
+	switch {
+	case releaseSign == "sigstore":
+		sig = sums + ".sigstore.json"
+		cmd = exec.Command("cosign", "sign-blob", "--yes", "--bundle", sig, sums)
+	case releaseSign != "":
+		sig = sums + ".asc"
+		args := []string{"--batch", "--yes", "--armor", "--detach-sign", "--output", sig}
+		if key := strings.TrimPrefix(releaseSign, "gpg"); key != "" {
+			args = append(args, "--local-user", key[1:])
+		}
+		cmd = exec.Command("gpg", append(args, sums)...)
+	default:
+		return
+	}
+	cmd.Stderr = os.Stderr
+	failOnError("release: cannot sign "+filepath.Base(sums), cmd.Run())
+	log.Printf("wrote %s", sig)
+}
+
+func gzipFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && fsyncOutput {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeSums writes the digests of files to dest in the format read by sha256sum -c (or sha512sum or
+// b3sum, for digestAlgo).
+func writeSums(dest string, files ...string) error {
+	sort.Strings(files)
+	var sb strings.Builder
+	for _, p := range files {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		h := newDigest()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sb, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), filepath.Base(p))
+	}
+	return writeStateFile(dest, []byte(sb.String()))
+}
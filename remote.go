@@ -0,0 +1,123 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// remoteURL, if set, is the ssh:// URL of a host and directory to extract the archive to.
+	remoteURL string
+
+	// remoteCmd is the ssh command the archive is written to, through remoteStdin.
+	remoteCmd   *exec.Cmd
+	remoteStdin io.WriteCloser
+)
+
+// remoteWriter writes to the standard input of the ssh command. If a write fails, the error
+// includes how the command exited, since that's usually the cause.
+type remoteWriter struct {
+	w io.WriteCloser
+}
+
+func (r remoteWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if err != nil {
+		if werr := remoteCmd.Wait(); werr != nil {
+			err = fmt.Errorf("%w (ssh: %v)", err, werr)
+		}
+	}
+	return n, err
+}
+
+// parseRemote parses an ssh://[USER@]HOST[:PORT]/DEST URL into arguments for ssh and the
+// directory to extract to. DEST is absolute unless it starts with /~/, in which case it's
+// relative to the remote user's home directory.
+func parseRemote(s string) (args []string, dest string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, "", fmt.Errorf("not an ssh://[USER@]HOST[:PORT]/DEST URL: %s", s)
+	}
+
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	args = append(args, "--", host)
+
+	dest = u.Path
+	switch {
+	case dest == "", dest == "/~", dest == "/~/":
+		dest = "."
+	case strings.HasPrefix(dest, "/~/"):
+		dest = dest[len("/~/"):]
+	}
+	return args, dest, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// openRemote starts ssh to extract the archive on the remote host with tar, creating the
+// destination directory if needed, and returns a writer for the archive.
+func openRemote() io.Writer {
+	args, dest, err := parseRemote(remoteURL)
+	failOnUsageError("--remote", err)
+
+	dest = shellQuote(dest)
+	args = append(args, "mkdir -p "+dest+" && exec tar -x -f - -C "+dest)
+	remoteCmd = exec.Command("ssh", args...)
+	remoteCmd.Stdout = os.Stderr
+	remoteCmd.Stderr = os.Stderr
+	remoteStdin, err = remoteCmd.StdinPipe()
+	failOnError("--remote: cannot start ssh", err)
+	failOnError("--remote: cannot start ssh", remoteCmd.Start())
+	return remoteWriter{w: remoteStdin}
+}
+
+// closeRemote ends the archive sent to the remote host and waits for it to be extracted.
+func closeRemote() error {
+	if err := remoteStdin.Close(); err != nil {
+		return err
+	}
+	if err := remoteCmd.Wait(); err != nil {
+		return fmt.Errorf("remote extraction failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	// removeFiles controls whether source files are removed once their entries are written.
+	removeFiles bool
+
+	// removePaths and removeDirs are the source files and directories to remove once the
+	// archive is complete.
+	removePaths []string
+	removeDirs  []string
+
+	// sourcesRemoved is set once removeSources has started removing sources.
+	sourcesRemoved bool
+)
+
+// removeSource queues src to be removed once the archive is complete. Sources are only removed
+// once the output has been closed (and synced, with --fsync) without error, so that they're never
+// lost with an incomplete archive. Sources added only in part (with offset= or length=) are not
+// removed.
+func removeSource(src string, hdr *tar.Header, opts *FileOpts) {
+	if !removeFiles || precomputing || src == "-" || opts.hasRange() {
+		return
+	}
+	// Sources are removed after -C may have changed the working directory.
+	abs, err := filepath.Abs(src)
+	failOnError("--remove-files", err)
+	if hdr.Typeflag == tar.TypeDir {
+		removeDirs = append(removeDirs, abs)
+	} else {
+		removePaths = append(removePaths, abs)
+	}
+}
+
+// removeSources removes the sources added with --remove-files: files first, then directories,
+// deepest first. Directories that still contain files that weren't added are left in place.
+func removeSources() {
+	sourcesRemoved = len(removePaths) > 0 || len(removeDirs) > 0
+	for _, p := range removePaths {
+		if err := os.Remove(p); err != nil {
+			warnf("--remove-files: %v", err)
+		}
+	}
+	sort.Slice(removeDirs, func(i, j int) bool {
+		return len(removeDirs[i]) > len(removeDirs[j])
+	})
+	for _, dir := range removeDirs {
+		if err := os.Remove(dir); err != nil {
+			warnf("--remove-files: %v", err)
+		}
+	}
+}
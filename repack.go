@@ -0,0 +1,240 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// repackIn and repackOut are the archive rewritten by repack and the path it's written to.
+	repackIn, repackOut string
+
+	// Normalizations applied to each entry by repack. IDs of -1 and nil names are left as-is.
+	repackFormat             = tar.FormatPAX
+	repackUid, repackGid     = -1, -1
+	repackUname, repackGname *string
+	repackMtime              time.Time
+)
+
+func repackUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar repack [-h|--help] IN OUT [REPACK OPTION]... [--] [OPTION]...
+
+Rewrites the archive IN to OUT canonically: entries are sorted by name, written
+in one header format, and stripped of access and change times, with ownership
+and modification times optionally normalized. IN may be compressed with gzip,
+zstd, xz, bzip2, or lz4, and may be '-' to read standard input. Repack options
+come first; the rest are the same global options as when writing an archive
+(such as -z to compress OUT), except that the output may not be set. Files and
+per-file options may not be given.
+
+Repack options:
+
+  --format=FORMAT
+    Set the header format to write: 'pax' (default), 'ustar', or 'gnu'. PAX
+    records that aren't header fields, such as xattrs, are dropped when
+    writing ustar or gnu headers.
+  --uid=UID | --gid=GID
+    Set the uid or gid of every entry.
+  --uname=NAME | --gname=NAME
+    Set the owner or group name of every entry. An empty NAME removes it.
+  --mtime=TIME
+    Set the modification time of every entry to TIME, given as for the
+    mtime= per-file option.
+`)
+}
+
+// repackArgs parses the arguments given to repack and returns the remaining global options.
+func repackArgs(argv Args) Args {
+	if len(argv.args) > 0 && (argv.args[0] == "-h" || argv.args[0] == "--help") || len(argv.args) < 2 {
+		repackUsage()
+		exit(exitUsage)
+	}
+	repackIn, _ = argv.Shift()
+	repackOut, _ = argv.Shift()
+	if repackIn != "-" {
+		var err error
+		repackIn, err = filepath.Abs(repackIn)
+		failOnError("repack: invalid path", err)
+	}
+
+loop:
+	for len(argv.args) > 0 {
+		switch s := argv.args[0]; {
+		case s == "--":
+			argv.Shift()
+			break loop
+		case strings.HasPrefix(s, "--format="):
+			switch format := strings.TrimPrefix(s, "--format="); strings.ToLower(format) {
+			case "pax":
+				repackFormat = tar.FormatPAX
+			case "ustar":
+				repackFormat = tar.FormatUSTAR
+			case "gnu":
+				repackFormat = tar.FormatGNU
+			default:
+				usageErrorf("repack: --format: unrecognized format %q", format)
+			}
+		case strings.HasPrefix(s, "--uid="), strings.HasPrefix(s, "--gid="):
+			opt, v, _ := strings.Cut(s, "=")
+			id, err := strconv.Atoi(v)
+			if err == nil && id < 0 {
+				err = errors.New("may not be negative")
+			}
+			failOnUsageError("repack: "+opt, err)
+			if opt == "--uid" {
+				repackUid = id
+			} else {
+				repackGid = id
+			}
+		case strings.HasPrefix(s, "--uname="):
+			name := strings.TrimPrefix(s, "--uname=")
+			repackUname = &name
+		case strings.HasPrefix(s, "--gname="):
+			name := strings.TrimPrefix(s, "--gname=")
+			repackGname = &name
+		case strings.HasPrefix(s, "--mtime="):
+			var fo FileOpts
+			failOnUsageError("repack: --mtime", fo.parse(strings.TrimPrefix(s, "--")))
+			repackMtime = fo.mtime
+		default:
+			break loop
+		}
+		argv.Shift()
+	}
+	return argv
+}
+
+// checkRepack checks that no files are given to repack, since its entries come from IN.
+func checkRepack(argv Args) {
+	if repackIn == "" {
+		return
+	}
+	if len(argv.args) > 0 {
+		usageErrorf("repack: unexpected argument %q", argv.args[0])
+	}
+	if outputPath != "" || remoteURL != "" || imageMode || ociLayout != "" {
+		usageErrorf("repack: the output may only be set by OUT")
+	}
+	outputPath = repackOut
+}
+
+// repackEntry is an entry read by repack, with its content spooled at off.
+type repackEntry struct {
+	hdr *tar.Header
+	off int64
+}
+
+// writeRepacked writes the entries of repackIn to w, sorted by name. Content is spooled to a
+// temporary file while the entries are read, since sorting requires reading the whole archive.
+func writeRepacked(w ArchiveWriter) {
+	if repackIn == "" || precomputing {
+		return
+	}
+
+	in := os.Stdin
+	if repackIn != "-" {
+		f, err := os.Open(repackIn)
+		failOnError("repack: cannot open input", err)
+		defer f.Close()
+		in = f
+	}
+	r, err := decompressedReader(bufio.NewReader(in))
+	failOnError("repack: cannot read input", err)
+
+	spool, err := os.CreateTemp("", "mtar-repack-*")
+	failOnError("repack: cannot create spool file", err)
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	var entries []repackEntry
+	var off int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		failOnError("repack: error reading tar header", err)
+		n, err := io.Copy(spool, tr)
+		failOnError("repack: error spooling "+hdr.Name, err)
+		entries = append(entries, repackEntry{hdr: hdr, off: off})
+		off += n
+	}
+
+	// The sort is stable so that duplicate entries keep their order.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].hdr.Name < entries[j].hdr.Name
+	})
+	for _, e := range entries {
+		hdr := e.hdr
+		normalizeRepacked(hdr)
+		if !withinLimits(hdr) {
+			continue
+		}
+		failOnError("write header: "+hdr.Name, writeHeader(w, hdr))
+		if hdr.Size > 0 {
+			_, err := copyContent(w, io.NewSectionReader(spool, e.off, hdr.Size))
+			failOnError("copy error: "+hdr.Name, err)
+		}
+		failOnError("flush error: "+hdr.Name, flushArchive(w))
+	}
+}
+
+// normalizeRepacked applies the repack options to hdr.
+func normalizeRepacked(hdr *tar.Header) {
+	hdr.Format = repackFormat
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if repackFormat != tar.FormatPAX {
+		hdr.PAXRecords, hdr.Xattrs = nil, nil
+	}
+	if repackUid >= 0 {
+		hdr.Uid = repackUid
+	}
+	if repackGid >= 0 {
+		hdr.Gid = repackGid
+	}
+	if repackUname != nil {
+		hdr.Uname = *repackUname
+	}
+	if repackGname != nil {
+		hdr.Gname = *repackGname
+	}
+	if !repackMtime.IsZero() {
+		hdr.ModTime = repackMtime
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	// skipUnreadable controls whether files that can't be read due to permissions or because
+	// they're busy are skipped instead of ending the run.
+	skipUnreadable bool
+
+	// ignoreFailedRead controls whether any file that can't be read is skipped instead of ending
+	// the run.
+	ignoreFailedRead bool
+
+	// keepGoing controls whether any file that can't be added because of an error is skipped
+	// instead of ending the run. Errors writing the archive still end the run.
+	keepGoing bool
+
+	// skipReportPath, if set, is the file that all skipped paths are written to once the archive
+	// is complete.
+	skipReportPath string
+
+	walkErrors = walkWarn
+)
+
+// walkErrorPolicy controls what happens when a path can't be read while walking a directory.
+type walkErrorPolicy int
+
+const (
+	walkWarn     walkErrorPolicy = iota // Log a warning and skip the path
+	walkContinue                        // Skip the path without a warning
+	walkFail                            // Exit with an error
+)
+
+// Reasons for skipping a path.
+const (
+	skipFailed      = "failed"      // The file could not be read
+	skipFiltered    = "filtered"    // The path was rejected by a filter
+	skipDuplicate   = "duplicate"   // An entry with the same name was already written
+	skipUnsupported = "unsupported" // The file's type can't be archived
+	skipLimit       = "limit"       // Adding the entry would have exceeded a limit
+	skipLoop        = "loop"        // The directory was reached again by following a symlink
+	skipWalk        = "walk"        // The path could not be read while walking a directory
+)
+
+type skipRecord struct {
+	path   string
+	reason string
+	detail string
+	err    error
+}
+
+func (s skipRecord) String() string {
+	if s.err != nil {
+		return s.err.Error()
+	}
+	return s.detail
+}
+
+var (
+	// skipped is the list of paths skipped during the run, reported once the archive is
+	// complete.
+	skipped []skipRecord
+
+	// failed is the number of skipped paths that could not be read.
+	failed int
+)
+
+// recordSkip records that path was skipped for the given reason.
+func recordSkip(path, reason, detail string, err error) {
+	if precomputing {
+		return
+	}
+	skipped = append(skipped, skipRecord{path: path, reason: reason, detail: detail, err: err})
+	ev := &event{Event: eventSkipped, Path: path, Reason: reason, Msg: detail}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	writeEvent(ev)
+	if reason == skipFailed {
+		failed++
+	}
+}
+
+// isUnreadable returns whether err indicates that a file can't be read because of its permissions
+// or because it's busy.
+func isUnreadable(err error) bool {
+	return errors.Is(err, os.ErrPermission) || isErrno(err, busyErrnos)
+}
+
+// skipOnError returns true if src should be skipped because of err, recording the skip. If it
+// returns false, err should be handled as it normally would be.
+func skipOnError(src string, err error) bool {
+	if err == nil || !(ignoreFailedRead || skipUnreadable && isUnreadable(err)) {
+		return false
+	}
+	if ignoreFailedRead && !precomputing {
+		logEvent(levelWarning, src, "skipping file: "+src, err)
+	}
+	recordSkip(src, skipFailed, "", err)
+	return true
+}
+
+// checkAddError handles an error adding src. With --keep-going, src is skipped and the error is
+// logged as a warning. Otherwise, mtar exits.
+func checkAddError(src string, err error) {
+	if err == nil {
+		return
+	} else if !keepGoing {
+		failOnError("add file: "+src, err)
+	}
+	if !precomputing {
+		logEvent(levelWarning, src, "skipping file: "+src, err)
+	}
+	recordSkip(src, skipFailed, "", err)
+}
+
+// walkError handles an error reading path while walking a directory according to the walk error
+// policy.
+func walkError(path string, err error) {
+	if walkErrors == walkFail {
+		failOnError("walk error", err)
+	}
+	if precomputing {
+		return
+	}
+	if walkErrors == walkWarn {
+		warned = true
+		logEvent(levelWarning, path, "skipping path: "+path, err)
+	} else {
+		debugf("walk: %s: skipped: %v", path, err)
+	}
+	recordSkip(path, skipWalk, "", err)
+}
+
+// reportSkips logs a summary of paths skipped during the run, followed by every file that could
+// not be read. If skipReportPath is set, all skipped paths are written to it.
+func reportSkips() {
+	if skipReportPath != "" {
+		failOnError("cannot write skip report", writeSkipReport(skipReportPath))
+	}
+	if len(skipped) == 0 {
+		return
+	}
+
+	counts := map[string]int{}
+	for _, s := range skipped {
+		counts[s.reason]++
+	}
+	reasons := make([]string, 0, len(counts))
+	for reason, n := range counts {
+		reasons = append(reasons, fmt.Sprintf("%d %s", n, reason))
+	}
+	sort.Strings(reasons)
+	logEvent(levelInfo, "", fmt.Sprintf("skipped %d path(s): %s", len(skipped), strings.Join(reasons, ", ")), nil)
+
+	if failed == 0 {
+		return
+	} else if logJSON {
+		for _, s := range skipped {
+			if s.reason == skipFailed {
+				logEvent(levelWarning, s.path, "skipped", s.err)
+			}
+		}
+		return
+	}
+	log.Printf("skipped %d file(s) that could not be read:", failed)
+	for _, s := range skipped {
+		if s.reason == skipFailed {
+			log.Printf("  %s: %v", s.path, s.err)
+		}
+	}
+}
+
+// writeSkipReport writes every skipped path to the file at p, one per line, as tab-separated
+// reason, path, and detail fields.
+func writeSkipReport(p string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, s := range skipped {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", s.reason, s.path, s)
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// reproducible controls whether entries are normalized so that archives of identical trees
+	// are identical.
+	reproducible bool
+
+	// reproducibleTime is the time every entry's mtime is set to with --reproducible. It's taken
+	// from $SOURCE_DATE_EPOCH if set.
+	reproducibleTime = time.Unix(0, 0)
+)
+
+// checkReproducible reads $SOURCE_DATE_EPOCH for --reproducible and checks that nothing that
+// varies between runs is written.
+func checkReproducible() {
+	if !reproducible {
+		return
+	}
+	if provenance {
+		usageErrorf("--reproducible: may not be used with --provenance, which records the host and command line")
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		failOnUsageError("--reproducible: invalid $SOURCE_DATE_EPOCH", err)
+		reproducibleTime = time.Unix(sec, 0)
+	}
+}
+
+// normalizeReproducible clears the fields of hdr that vary between identical trees, as selected
+// by --reproducible.
+func normalizeReproducible(hdr *tar.Header) {
+	if !reproducible {
+		return
+	}
+	hdr.Format = tar.FormatPAX
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.ModTime = reproducibleTime
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	for _, key := range []string{"mtime", "atime", "ctime", "uid", "gid", "uname", "gname"} {
+		delete(hdr.PAXRecords, key)
+	}
+}
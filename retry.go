@@ -0,0 +1,129 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ioRetries    int // Number of times to retry transient I/O errors
+	ioRetryDelay = time.Second
+)
+
+// isTransient returns whether err is an I/O error that may go away if the operation is retried,
+// such as those returned by flaky network filesystems.
+func isTransient(err error) bool {
+	return isErrno(err, transientErrnos)
+}
+
+// isErrno returns whether err is any of errnos.
+func isErrno(err error, errnos []error) bool {
+	for _, errno := range errnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// openFile opens the named file for reading, retrying transient errors up to ioRetries times.
+func openFile(name string) (f *os.File, err error) {
+	for attempt := 0; ; attempt++ {
+		f, err = os.Open(name)
+		if err == nil || !isTransient(err) || attempt >= ioRetries {
+			return f, err
+		}
+		logEvent(levelInfo, "", fmt.Sprintf("open error (retry %d of %d)", attempt+1, ioRetries), err)
+		time.Sleep(ioRetryDelay)
+	}
+}
+
+// retryReader reads a regular file, retrying transient read errors up to ioRetries times. Before
+// each retry the file is reopened and reading resumes from the same offset.
+type retryReader struct {
+	name string
+	f    *os.File // nil if the file could not be reopened
+	off  int64
+	err  error // The last error returned by Read, other than io.EOF
+}
+
+func newRetryReader(f *os.File) *retryReader {
+	return &retryReader{name: f.Name(), f: f}
+}
+
+func (r *retryReader) Read(p []byte) (n int, err error) {
+	for attempt := 0; ; attempt++ {
+		if r.f == nil {
+			err = r.reopen()
+		}
+		if r.f != nil {
+			n, err = r.f.Read(p)
+			r.off += int64(n)
+		}
+		if n > 0 || err == nil || err == io.EOF {
+			return n, err
+		} else if !isTransient(err) || attempt >= ioRetries {
+			r.err = err
+			return n, err
+		}
+		logEvent(levelInfo, "", fmt.Sprintf("read error (retry %d of %d)", attempt+1, ioRetries), err)
+		time.Sleep(ioRetryDelay)
+		if r.f != nil {
+			_ = r.f.Close()
+			r.f = nil
+		}
+	}
+}
+
+func (r *retryReader) reopen() error {
+	f, err := os.Open(r.name)
+	if err != nil {
+		return err
+	}
+	if lockFiles {
+		if err = lockShared(f); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if _, err = f.Seek(r.off, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f = f
+	return nil
+}
+
+func (r *retryReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// rsyncable is set by --rsyncable to reset the gzip compressor wherever the content matches
+// rsyncWindow, as gzip --rsyncable does. Since the content after a reset doesn't depend on the
+// content before it, a change to the archive only changes the compressed output up to the next
+// reset, which lets rsync and other delta transfers skip the rest.
+var rsyncable bool
+
+// rsyncWindow is the size of the window that the rolling sum is taken over. The compressor is
+// reset after any byte where the sum of the last rsyncWindow bytes is a multiple of rsyncWindow,
+// as long as at least rsyncWindow bytes were written since the last reset. Otherwise, runs of
+// zeroes, like tar's padding, would reset it at every byte.
+const rsyncWindow = 4096
+
+// rsyncableGzipWriter writes a gzip stream whose deflate compressor is reset at content-defined
+// points. compress/gzip has no way to reset the compressor in the middle of a stream, so this
+// writes the gzip header and trailer itself around a flate.Writer.
+type rsyncableGzipWriter struct {
+	w    io.Writer
+	fw   *flate.Writer
+	crc  uint32
+	size uint32
+
+	window [rsyncWindow]byte
+	pos    int
+	sum    uint32
+	since  int
+}
+
+func newRsyncableGzipWriter(w io.Writer, level int) (*rsyncableGzipWriter, error) {
+	// Header with no modification time, no extra flags, and an unknown OS, as compress/gzip
+	// writes by default.
+	header := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &rsyncableGzipWriter{w: w, fw: fw}, nil
+}
+
+func (g *rsyncableGzipWriter) Write(p []byte) (int, error) {
+	g.crc = crc32.Update(g.crc, crc32.IEEETable, p)
+	g.size += uint32(len(p))
+
+	n, start := 0, 0
+	for i, b := range p {
+		g.sum += uint32(b) - uint32(g.window[g.pos])
+		g.window[g.pos] = b
+		g.pos = (g.pos + 1) % rsyncWindow
+		g.since++
+		if g.since < rsyncWindow || g.sum%rsyncWindow != 0 {
+			continue
+		}
+		m, err := g.fw.Write(p[start : i+1])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if err := g.reset(); err != nil {
+			return n, err
+		}
+		start = i + 1
+	}
+	m, err := g.fw.Write(p[start:])
+	return n + m, err
+}
+
+// reset flushes the compressor to a byte boundary and starts a new one, continuing the same
+// deflate stream without the previous content as its dictionary.
+func (g *rsyncableGzipWriter) reset() error {
+	if err := g.fw.Flush(); err != nil {
+		return err
+	}
+	g.fw.Reset(g.w)
+	g.since = 0
+	return nil
+}
+
+func (g *rsyncableGzipWriter) Close() error {
+	if err := g.fw.Close(); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], g.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], g.size)
+	_, err := g.w.Write(trailer[:])
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// seekable is set by --seekable to write zstd in the seekable format: the archive is compressed
+// in independent frames of up to seekableFrameSize bytes, followed by a seek table in a skippable
+// frame, so that readers can decompress any part of the archive without decompressing all of it.
+// Readers that don't know the format decompress it as ordinary zstd.
+var seekable bool
+
+const (
+	// seekableFrameSize is the most uncompressed content compressed into each frame.
+	seekableFrameSize = 1 << 20
+
+	skippableFrameMagic = 0x184D2A5E
+	seekableMagic       = 0x8F92EAB1
+)
+
+// seekableZstdWriter compresses to a new zstd frame every seekableFrameSize bytes, recording the
+// compressed and decompressed size of each frame for the seek table.
+type seekableZstdWriter struct {
+	w   *countingWriter
+	enc *zstd.Encoder
+
+	n      int64 // Uncompressed bytes written to the current frame.
+	start  int64 // Offset of the current frame in the output.
+	frames [][2]uint32
+}
+
+func newSeekableZstdWriter(w io.Writer, opts ...zstd.EOption) (*seekableZstdWriter, error) {
+	cw := &countingWriter{w: w, n: new(int64)}
+	enc, err := zstd.NewWriter(cw, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &seekableZstdWriter{w: cw, enc: enc}, nil
+}
+
+func (s *seekableZstdWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if rem := seekableFrameSize - s.n; int64(len(chunk)) > rem {
+			chunk = chunk[:rem]
+		}
+		n, err := s.enc.Write(chunk)
+		written += n
+		s.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if s.n == seekableFrameSize {
+			if err := s.endFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// endFrame finishes the current frame and records it in the seek table.
+func (s *seekableZstdWriter) endFrame() error {
+	if err := s.enc.Close(); err != nil {
+		return err
+	}
+	end := *s.w.n
+	s.frames = append(s.frames, [2]uint32{uint32(end - s.start), uint32(s.n)})
+	s.start, s.n = end, 0
+	s.enc.Reset(s.w)
+	return nil
+}
+
+// Close finishes the last frame, if it has any content, and writes the seek table. Frame
+// checksums aren't recorded in the table, since zstd already checks each frame's content.
+func (s *seekableZstdWriter) Close() error {
+	if s.n > 0 || len(s.frames) == 0 {
+		if err := s.endFrame(); err != nil {
+			return err
+		}
+	}
+
+	const footerSize = 9
+	table := make([]byte, 8, 8+8*len(s.frames)+footerSize)
+	binary.LittleEndian.PutUint32(table[0:], skippableFrameMagic)
+	binary.LittleEndian.PutUint32(table[4:], uint32(8*len(s.frames)+footerSize))
+	for _, f := range s.frames {
+		table = binary.LittleEndian.AppendUint32(table, f[0])
+		table = binary.LittleEndian.AppendUint32(table, f[1])
+	}
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(s.frames)))
+	table = append(table, 0) // Seek table descriptor: no checksums.
+	table = binary.LittleEndian.AppendUint32(table, seekableMagic)
+	_, err := s.w.Write(table)
+	return err
+}
@@ -0,0 +1,276 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// shardTemplate is the default template for the names of shards.
+const shardTemplate = "shard-{n}.tar"
+
+var (
+	// shardCount is the number of archives that shard splits entries across, or 0 when not
+	// sharding.
+	shardCount int
+	shardNames string
+
+	// shardSizes are the entries found while precomputing, used to assign them to shards.
+	shardSizes []shardEntry
+
+	// shardOf maps entry names to the index of the shard they're written to.
+	shardOf map[string]int
+)
+
+type shardEntry struct {
+	name string
+	size int64
+}
+
+func shardUsage() {
+	_, _ = io.WriteString(os.Stderr,
+		`Usage: mtar shard [-h|--help] -n N [SHARD OPTION]... [--] [OPTION|FILE]...
+
+Splits the entries of an archive across N archives, balanced by the total size
+of their content. Each shard is a complete archive, and each entry is written
+to exactly one shard (hard links are written to the shard holding their
+target). Shard options come first; the rest are the same global options,
+per-file options, and files as when writing an archive, except that the output
+may not be set. Files are walked twice: once to find the size of each entry,
+and again to write it.
+
+Shard options:
+
+  -n N
+    Write N shards. Required.
+  --template=TEMPLATE
+    Set the path of each shard (default: shard-{n}.tar). {n} is replaced by
+    the number of the shard, from 1 to N, padded with zeroes to the width of
+    N, and {count} by N.
+`)
+}
+
+// shardArgs parses the shard options and returns the remaining arguments.
+func shardArgs(argv Args) Args {
+	if len(argv.args) > 0 && (argv.args[0] == "-h" || argv.args[0] == "--help") {
+		shardUsage()
+		exit(exitUsage)
+	}
+
+	shardNames = shardTemplate
+loop:
+	for len(argv.args) > 0 {
+		switch s := argv.args[0]; {
+		case s == "--":
+			argv.Shift()
+			break loop
+		case strings.HasPrefix(s, "-n"):
+			n := strings.TrimPrefix(s, "-n")
+			if n == "" {
+				argv.Shift()
+				if len(argv.args) == 0 {
+					usageErrorf("shard: -n: missing count")
+				}
+				n = argv.args[0]
+			}
+			count, err := strconv.Atoi(n)
+			if err == nil && count < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+			failOnUsageError("shard: -n", err)
+			shardCount = count
+		case strings.HasPrefix(s, "--template="):
+			shardNames = strings.TrimPrefix(s, "--template=")
+			if !strings.Contains(shardNames, "{n}") {
+				usageErrorf("shard: --template: must contain {n}")
+			}
+		default:
+			break loop
+		}
+		argv.Shift()
+	}
+
+	if shardCount == 0 {
+		usageErrorf("shard: -n is required")
+	}
+	// Shards are balanced using the sizes found while precomputing.
+	precompute = true
+	return argv
+}
+
+// checkShard checks that the output isn't set elsewhere when sharding.
+func checkShard() {
+	if shardCount == 0 {
+		return
+	}
+	switch {
+	case outputPath != "" || remoteURL != "" || imageMode || ociLayout != "" || releaseBase != "":
+		usageErrorf("shard: the output may not be set (-f, --remote, --image, --oci-layout, or release)")
+	case outputFormat != "tar":
+		usageErrorf("shard: -F %s is not supported", outputFormat)
+	case statePath != "" || goEmbedName != "" || signSigstore ||
+		len(ageRecipients) > 0 || len(gpgRecipients) > 0 || encryptPass:
+		usageErrorf("shard: may not be used with --state, --go-embed, --sign-sigstore, or encryption")
+	}
+}
+
+// recordShardEntry records an entry found while precomputing.
+func recordShardEntry(hdr *tar.Header) {
+	if shardCount > 0 {
+		shardSizes = append(shardSizes, shardEntry{name: hdr.Name, size: hdr.Size})
+	}
+}
+
+// assignShards assigns each entry found while precomputing to a shard, largest first, each to the
+// shard with the least content (and then the fewest entries) so far.
+func assignShards() {
+	if shardCount == 0 {
+		return
+	}
+	sort.SliceStable(shardSizes, func(i, j int) bool {
+		return shardSizes[i].size > shardSizes[j].size
+	})
+	shardOf = make(map[string]int, len(shardSizes))
+	sizes := make([]int64, shardCount)
+	counts := make([]int, shardCount)
+	for _, e := range shardSizes {
+		if _, ok := shardOf[e.name]; ok {
+			continue
+		}
+		i := lightestShard(sizes, counts)
+		shardOf[e.name] = i
+		sizes[i] += e.size
+		counts[i]++
+	}
+	shardSizes = nil
+}
+
+func lightestShard(sizes []int64, counts []int) int {
+	min := 0
+	for i := range sizes {
+		if sizes[i] < sizes[min] || sizes[i] == sizes[min] && counts[i] < counts[min] {
+			min = i
+		}
+	}
+	return min
+}
+
+// shardName returns the path of shard i (from 0).
+func shardName(i int) string {
+	width := len(strconv.Itoa(shardCount))
+	return strings.NewReplacer(
+		"{n}", fmt.Sprintf("%0*d", width, i+1),
+		"{count}", strconv.Itoa(shardCount),
+	).Replace(shardNames)
+}
+
+// shardWriter writes each entry to the shard it was assigned. Entries that weren't seen while
+// precomputing, such as those concatenated with -A, are written to the shard with the least content
+// so far.
+type shardWriter struct {
+	paths  []string
+	files  []*os.File
+	shards []ArchiveWriter
+	sizes  []int64
+	counts []int
+	cur    int
+}
+
+func newShardWriter() *shardWriter {
+	sw := &shardWriter{
+		paths:  make([]string, shardCount),
+		files:  make([]*os.File, shardCount),
+		shards: make([]ArchiveWriter, shardCount),
+		sizes:  make([]int64, shardCount),
+		counts: make([]int, shardCount),
+	}
+	for i := range sw.shards {
+		sw.paths[i] = shardName(i)
+		f, err := os.Create(sw.paths[i])
+		failOnError("shard: cannot create output", err)
+		sw.files[i] = f
+		sw.shards[i] = newArchiveWriter(&countingWriter{w: f, n: &stats.outBytes})
+	}
+	return sw
+}
+
+func (sw *shardWriter) WriteHeader(hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		// Global headers apply to every shard.
+		for _, w := range sw.shards {
+			if err := w.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	i, ok := shardOf[hdr.Name]
+	if hdr.Typeflag == tar.TypeLink {
+		// A hard link is only valid in the same archive as its target.
+		i, ok = shardOf[hdr.Linkname]
+	}
+	if !ok {
+		i = lightestShard(sw.sizes, sw.counts)
+		shardOf[hdr.Name] = i
+	}
+	sw.cur = i
+	sw.sizes[i] += hdr.Size
+	sw.counts[i]++
+	return sw.shards[i].WriteHeader(hdr)
+}
+
+func (sw *shardWriter) Write(p []byte) (int, error) {
+	return sw.shards[sw.cur].Write(p)
+}
+
+func (sw *shardWriter) Flush() error {
+	return flushArchive(sw.shards[sw.cur])
+}
+
+func (sw *shardWriter) Close() error {
+	for i, w := range sw.shards {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if fsyncOutput {
+			if err := sw.files[i].Sync(); err != nil {
+				return err
+			}
+		}
+		if err := sw.files[i].Close(); err != nil {
+			return err
+		}
+		log.Printf("%s: %d entries, %s", sw.paths[i], sw.counts[i], humanBytes(sw.sizes[i]))
+	}
+	return nil
+}
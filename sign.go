@@ -0,0 +1,73 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var (
+	// signSigstore controls whether the output is signed with sigstore once it's complete.
+	signSigstore bool
+
+	// sigstoreBundle is the path the sigstore bundle is written to. If empty, it's the output path
+	// with .sigstore.json appended.
+	sigstoreBundle string
+)
+
+// checkSigning checks that the output can be signed before anything is written, so that a long
+// run doesn't end with an archive that can't be signed.
+func checkSigning() {
+	if !signSigstore {
+		return
+	}
+	if !isFileOutput() {
+		usageErrorf("--sign-sigstore: requires an output file (-f)")
+	}
+	_, err := exec.LookPath("cosign")
+	failOnError("--sign-sigstore: cannot find cosign", err)
+	if sigstoreBundle == "" {
+		sigstoreBundle = outputPath + ".sigstore.json"
+	}
+	// Signing happens after -C may have changed the working directory.
+	sigstoreBundle, err = filepath.Abs(sigstoreBundle)
+	failOnError("--sign-sigstore: invalid bundle path", err)
+}
+
+// signOutput signs the complete output with cosign's keyless flow and writes the resulting bundle,
+// containing the signature, certificate, and transparency log entry, to sigstoreBundle. In CI,
+// cosign uses the ambient OIDC token for the signing identity.
+func signOutput() {
+	if !signSigstore {
+		return
+	}
+	cmd := exec.Command("cosign", "sign-blob", "--yes", "--bundle", sigstoreBundle, outputPath)
+	cmd.Stderr = os.Stderr
+	failOnError("--sign-sigstore: cannot sign output", cmd.Run())
+	log.Printf("wrote sigstore bundle to %s", sigstoreBundle)
+}
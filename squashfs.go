@@ -0,0 +1,90 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// squashfsOpts are extra options passed to sqfstar (e.g., -comp zstd).
+var squashfsOpts []string
+
+func init() {
+	registerFormat("squashfs", newSquashfsWriter)
+}
+
+// squashfsWriter builds a SquashFS image by writing a tar stream to sqfstar, from squashfs-tools
+// 4.6 or later. sqfstar writes the image to a temporary file next to the output, which replaces
+// the output once the image is complete, since SquashFS images can't be streamed.
+type squashfsWriter struct {
+	*tar.Writer
+	cmd  *commandFilter
+	tmp  string
+	dest string
+}
+
+func newSquashfsWriter(io.Writer) ArchiveWriter {
+	if !isFileOutput() {
+		usageErrorf("-F squashfs: requires an output file (-f)")
+	} else if len(outputFilters) > 0 || statePath != "" {
+		usageErrorf("-F squashfs: may not be used with encryption or --state")
+	}
+
+	// Paths are made absolute, since -C may change the working directory before the image is done.
+	dest, err := filepath.Abs(outputPath)
+	failOnError("-F squashfs: invalid output", err)
+	f, err := os.CreateTemp(filepath.Dir(dest), ".mtar-squashfs-*.tmp")
+	failOnError("-F squashfs: cannot create image", err)
+	tmp := f.Name()
+	f.Close()
+	// sqfstar won't write over an existing file without -force, which would also let it write to
+	// devices, so only reserve the name.
+	failOnError("-F squashfs: cannot create image", os.Remove(tmp))
+
+	args := append([]string{"-quiet", "-no-progress"}, squashfsOpts...)
+	cmd := startCommandFilter(os.Stderr, "sqfstar", append(args, tmp)...)
+	return &squashfsWriter{Writer: tar.NewWriter(cmd), cmd: cmd, tmp: tmp, dest: dest}
+}
+
+// Close ends the tar stream, waits for sqfstar to finish the image, and moves it to the output.
+func (s *squashfsWriter) Close() error {
+	err := s.Writer.Close()
+	if cerr := s.cmd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && fsyncOutput {
+		err = syncPath(s.tmp)
+	}
+	if err == nil {
+		err = os.Rename(s.tmp, s.dest)
+	}
+	if err != nil {
+		os.Remove(s.tmp)
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stateInterval is the minimum time between saves of the state file.
+const stateInterval = time.Second
+
+var (
+	// statePath, if set, is the file that progress is recorded in so that an interrupted run can
+	// be resumed.
+	statePath string
+
+	stateSaved time.Time // When the state file was last saved
+
+	// resumeEntries and resumeOffset are the number of entries and bytes already written to the
+	// output by an interrupted run.
+	resumeEntries int64
+	resumeOffset  int64
+
+	// resuming is set while entries already written by an interrupted run are being skipped.
+	resuming bool
+
+	// stateFingerprint is the run's fingerprint. It's computed at startup, since the state is
+	// saved after -C may have changed the working directory.
+	stateFingerprint = runFingerprint()
+)
+
+// runFingerprint identifies the arguments and working directory of the run, so that a state file
+// is only used to resume the same run.
+func runFingerprint() string {
+	h := sha256.New()
+	wd, _ := os.Getwd()
+	_, _ = fmt.Fprintf(h, "%s\x00", wd)
+	for _, arg := range os.Args[1:] {
+		_, _ = fmt.Fprintf(h, "%s\x00", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadState reads the state file, if it exists, to resume an interrupted run.
+func loadState() {
+	if !isFileOutput() {
+		usageErrorf("--state: requires an output file (-f)")
+	}
+	if removeFiles {
+		// Entries written by an interrupted run are skipped by reading their sources again.
+		usageErrorf("--state: may not be used with --remove-files")
+	}
+
+	// The state is saved while files are added, after -C may have changed the working directory.
+	var err error
+	statePath, err = filepath.Abs(statePath)
+	failOnError("--state: invalid path", err)
+
+	f, err := os.Open(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	failOnError("--state: cannot read state", err)
+	defer f.Close()
+
+	fields := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if k, v, ok := strings.Cut(sc.Text(), " "); ok {
+			fields[k] = v
+		}
+	}
+	failOnError("--state: cannot read state", sc.Err())
+
+	if fields["mtar-state"] != "1" {
+		fatalf("--state: %s is not an mtar state file", statePath)
+	}
+	if fields["run"] != stateFingerprint {
+		usageErrorf("--state: %s was saved by a run with different arguments or working directory; remove it to start over", statePath)
+	}
+	resumeEntries, err = strconv.ParseInt(fields["entries"], 10, 64)
+	failOnError("--state: invalid entry count", err)
+	resumeOffset, err = strconv.ParseInt(fields["offset"], 10, 64)
+	failOnError("--state: invalid offset", err)
+	resuming = resumeEntries > 0
+}
+
+// saveState records the number of entries written and the size of the output in the state file.
+func saveState(w ArchiveWriter) error {
+	// Flush padding so that the offset is at the end of the last entry.
+	if err := flushArchive(w); err != nil {
+		return err
+	}
+	// With --fsync, the output must be on disk before the state claims it is.
+	if fsyncOutput {
+		if err := syncOutput(); err != nil {
+			return err
+		}
+	}
+	stateSaved = time.Now()
+	tmp := statePath + ".tmp"
+	data := fmt.Sprintf("mtar-state 1\nrun %s\nentries %d\noffset %d\n",
+		stateFingerprint, atomic.LoadInt64(&stats.entries), atomic.LoadInt64(&stats.outBytes))
+	if err := writeStateFile(tmp, []byte(data)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, statePath); err != nil {
+		return err
+	}
+	if fsyncOutput {
+		return syncDir(filepath.Dir(statePath))
+	}
+	return nil
+}
+
+// writeStateFile writes data to the file p, syncing it to disk if fsyncOutput is set.
+func writeStateFile(p string, data []byte) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil && fsyncOutput {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// beginEntry is called before each entry's header is written. While resuming, it discards
+// entries that were written by the interrupted run. Otherwise, it periodically saves the state.
+func beginEntry(w ArchiveWriter) error {
+	switch {
+	case statePath == "":
+		return nil
+	case resuming && atomic.LoadInt64(&stats.entries) < resumeEntries:
+		output.discard = true
+		return nil
+	case resuming:
+		return endResume(w)
+	case time.Since(stateSaved) < stateInterval:
+		return nil
+	}
+	return saveState(w)
+}
+
+// endResume stops discarding entries once all entries written by the interrupted run have been
+// skipped, checking that they add up to the recorded size of the output.
+func endResume(w ArchiveWriter) error {
+	if err := flushArchive(w); err != nil {
+		return err
+	}
+	output.discard = false
+	resuming = false
+	if off := atomic.LoadInt64(&stats.outBytes); off != resumeOffset {
+		fatalf("--state: skipped entries add up to %d bytes, not the %d bytes recorded in %s; the inputs have changed", off, resumeOffset, statePath)
+	}
+	log.Printf("resuming after %d entries (%d bytes)", resumeEntries, resumeOffset)
+	return nil
+}
+
+// finishState is called once all entries have been added, before the archive is closed.
+func finishState(w ArchiveWriter) {
+	if resuming {
+		failOnError("--state: cannot resume", endResume(w))
+	}
+}
+
+// removeState removes the state file once the archive is complete.
+func removeState() {
+	if statePath != "" {
+		failOnError("--state: cannot remove state", os.Remove(statePath))
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// watchStatusSignals prints the status of the run each time one of statusSignals is received, so
+// that a long-running mtar can be checked on without interrupting it.
+func watchStatusSignals() {
+	if len(statusSignals) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, statusSignals...)
+	go func() {
+		for range c {
+			printStatus()
+		}
+	}()
+}
+
+// printStatus logs the entry being written and the number of entries and bytes written so far.
+// It's logged regardless of -q or --log-level, since it was asked for.
+func printStatus() {
+	var b strings.Builder
+	writeCounts(&b, time.Since(startupTime))
+	fmt.Fprintf(&b, ", %v elapsed", time.Since(startupTime).Round(time.Second))
+	cur := currentEntry()
+	if logJSON {
+		writeLogRecord(&logRecord{Level: levelInfo, Msg: "status: " + b.String(), Path: cur})
+		return
+	}
+	if cur != "" {
+		b.WriteString(": ")
+		b.WriteString(cur)
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	_, _ = fmt.Fprintf(logOutput, "%sstatus: %s\n", log.Prefix(), b.String())
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+var (
+	// transientErrnos are errors that may go away if the operation is retried. Plan 9 errors are
+	// strings, so none are treated as transient.
+	transientErrnos []error
+
+	// busyErrnos are errors indicating that a file is in use.
+	busyErrnos []error
+)
+
+// sysMeta reads file metadata from a file's Dir.
+type sysMeta struct{}
+
+// Mode returns the permission bits of fi.
+func (sysMeta) Mode(fi os.FileInfo) int64 {
+	return int64(fi.Mode().Perm())
+}
+
+// Owner returns false, since Plan 9 files are owned by user and group names, not ids.
+func (sysMeta) Owner(fi os.FileInfo) (uid, gid string, ok bool) {
+	return "", "", false
+}
+
+// FileID returns the device and qid path of fi, if available.
+func (sysMeta) FileID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	dir, ok := fi.Sys().(*syscall.Dir)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(dir.Type)<<32 | uint64(dir.Dev), dir.Qid.Path, true
+}
+
+// Xattrs returns no attributes, since Plan 9 has no extended attributes.
+func (sysMeta) Xattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattr returns an error, since Plan 9 has no extended attributes.
+func writeXattr(path, name, value string) error {
+	return errors.New("extended attributes are not supported on Plan 9")
+}
+
+// numericID parses a uid or gid from os/user.
+func numericID(id string) (int, error) {
+	return strconv.Atoi(id)
+}
+
+// shellCommand returns a command to run command using the system shell.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/rc", "-c", command)
+}
+
+// syncDir does nothing, since Plan 9 has no equivalent of fsync for directories.
+func syncDir(dir string) error {
+	return nil
+}
+
+// openTTY opens the console for reading.
+func openTTY() (*os.File, error) {
+	return os.Open("/dev/cons")
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build unix || js || wasip1
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+var (
+	// transientErrnos are errors that may go away if the operation is retried.
+	transientErrnos = []error{syscall.EIO, syscall.ESTALE, syscall.EAGAIN}
+
+	// busyErrnos are errors indicating that a file is in use.
+	busyErrnos = []error{syscall.EBUSY}
+)
+
+// sysMeta reads file metadata from a file's Stat_t.
+type sysMeta struct{}
+
+// Mode returns the permission bits of fi.
+func (sysMeta) Mode(fi os.FileInfo) int64 {
+	return int64(fi.Mode().Perm())
+}
+
+// Owner returns the uid and gid of fi, if available.
+func (sysMeta) Owner(fi os.FileInfo) (uid, gid string, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", false
+	}
+	return strconv.FormatUint(uint64(stat.Uid), 10), strconv.FormatUint(uint64(stat.Gid), 10), true
+}
+
+// FileID returns the device and inode numbers of fi, if available.
+func (sysMeta) FileID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
+
+// Xattrs returns the extended attributes of path. Platforms without xattr support return none.
+func (sysMeta) Xattrs(path string) (map[string]string, error) {
+	return readXattrs(path)
+}
+
+// numericID parses a uid or gid from os/user.
+func numericID(id string) (int, error) {
+	return strconv.Atoi(id)
+}
+
+// shellCommand returns a command to run command using the system shell.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// syncDir syncs the directory dir to disk, so that entries created or renamed in it persist.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openTTY opens the controlling terminal for reading.
+func openTTY() (*os.File, error) {
+	return os.Open("/dev/tty")
+}
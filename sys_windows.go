@@ -0,0 +1,129 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	// transientErrnos are errors that may go away if the operation is retried. These are mostly
+	// errors from network shares.
+	transientErrnos = []error{
+		syscall.Errno(54),  // ERROR_NETWORK_BUSY
+		syscall.Errno(59),  // ERROR_UNEXP_NET_ERR
+		syscall.Errno(64),  // ERROR_NETNAME_DELETED
+		syscall.Errno(121), // ERROR_SEM_TIMEOUT
+	}
+
+	// busyErrnos are errors indicating that a file is in use.
+	busyErrnos = []error{
+		syscall.Errno(32), // ERROR_SHARING_VIOLATION
+		syscall.Errno(33), // ERROR_LOCK_VIOLATION
+	}
+)
+
+// executableExts are extensions of files that are given execute permissions, since Windows has no
+// equivalent permission.
+var executableExts = map[string]bool{
+	".exe": true,
+	".com": true,
+	".bat": true,
+	".cmd": true,
+	".ps1": true,
+}
+
+// sysMeta synthesizes file metadata from Windows file attributes.
+type sysMeta struct{}
+
+// Mode returns the permission bits to record for the file described by fi. Windows only has
+// a read-only attribute, so directories are given 0755 and files 0644 (or 0444 if read-only),
+// plus execute permissions for executable extensions.
+func (sysMeta) Mode(fi os.FileInfo) int64 {
+	if fi.IsDir() {
+		return 0755
+	}
+	mode := int64(0644)
+	if fi.Mode().Perm()&0200 == 0 {
+		mode = 0444
+	}
+	if executableExts[strings.ToLower(filepath.Ext(fi.Name()))] {
+		mode |= 0111
+	}
+	return mode
+}
+
+// Owner returns false, since Windows files have no uid or gid.
+func (sysMeta) Owner(fi os.FileInfo) (uid, gid string, ok bool) {
+	return "", "", false
+}
+
+// FileID returns false, since os.FileInfo doesn't carry Windows file indexes.
+func (sysMeta) FileID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+// Xattrs returns no attributes. Alternate data streams are not recorded.
+func (sysMeta) Xattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattr returns an error. Alternate data streams are not written.
+func writeXattr(path, name, value string) error {
+	return errors.New("extended attributes are not supported on Windows")
+}
+
+// numericID parses a uid or gid from os/user. On Windows these are SIDs, which have no numeric
+// equivalent, so they're recorded as 0 (leaving only the user or group name).
+func numericID(id string) (int, error) {
+	if n, err := strconv.Atoi(id); err == nil {
+		return n, nil
+	}
+	return 0, nil
+}
+
+// shellCommand returns a command to run command using the system shell.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// syncDir does nothing. Directories can't be synced on Windows, and NTFS journals changes to
+// them.
+func syncDir(dir string) error {
+	return nil
+}
+
+// openTTY opens the console for reading.
+func openTTY() (*os.File, error) {
+	return os.OpenFile("CONIN$", os.O_RDWR, 0)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// linkTransform is a sed-style substitution applied to link targets.
+type linkTransform struct {
+	rx     *regexp.Regexp
+	repl   string // In regexp.Expand syntax
+	global bool
+}
+
+// linkTransforms are applied, in order, to the targets of symlinks and hard links.
+var linkTransforms []linkTransform
+
+// parseLinkTransform parses a substitution of the form s/REGEXP/REPLACEMENT/[g]. Any character may
+// be used in place of '/'. As with sed, \1 through \9 in REPLACEMENT are replaced by submatches
+// and & by the whole match.
+func parseLinkTransform(expr string) (linkTransform, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return linkTransform{}, fmt.Errorf("expected s/REGEXP/REPLACEMENT/, got %q", expr)
+	}
+	delim := expr[1:2]
+	parts := strings.Split(expr[2:], delim)
+	if len(parts) != 3 {
+		return linkTransform{}, fmt.Errorf("expected s%sREGEXP%sREPLACEMENT%s, got %q", delim, delim, delim, expr)
+	}
+	var t linkTransform
+	switch parts[2] {
+	case "":
+	case "g":
+		t.global = true
+	default:
+		return linkTransform{}, fmt.Errorf("unrecognized flags %q", parts[2])
+	}
+	rx, err := regexp.Compile(parts[0])
+	if err != nil {
+		return linkTransform{}, fmt.Errorf("invalid regexp %q: %v", parts[0], err)
+	}
+	t.rx, t.repl = rx, sedReplacement(parts[1])
+	return t, nil
+}
+
+// sedReplacement converts a sed replacement to regexp.Expand syntax.
+func sedReplacement(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			b.WriteString("$$")
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '\\' && i+1 < len(s):
+			i++
+			if d := s[i]; d >= '0' && d <= '9' {
+				fmt.Fprintf(&b, "${%c}", d)
+			} else if d == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte(d)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (t linkTransform) apply(s string) string {
+	var out []byte
+	last := 0
+	for _, m := range t.rx.FindAllStringSubmatchIndex(s, -1) {
+		out = append(out, s[last:m[0]]...)
+		out = t.rx.ExpandString(out, t.repl, s, m)
+		last = m[1]
+		if !t.global {
+			break
+		}
+	}
+	if out == nil {
+		return s
+	}
+	return string(append(out, s[last:]...))
+}
+
+// transformLink applies linkTransforms to the target of hdr, if it's a link.
+func transformLink(hdr *tar.Header) {
+	if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+		return
+	}
+	for _, t := range linkTransforms {
+		hdr.Linkname = t.apply(hdr.Linkname)
+	}
+	if len(linkTransforms) > 0 {
+		debugf("%s: link target %q", hdr.Name, hdr.Linkname)
+	}
+}
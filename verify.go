@@ -0,0 +1,206 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// verifyOutput controls whether the output is read back and checked against what was written
+// once the archive is complete.
+var verifyOutput bool
+
+// verifiedEntry is an entry as it was written, recorded for --verify.
+type verifiedEntry struct {
+	name     string
+	typeflag byte
+	size     int64
+	sum      []byte
+}
+
+// verifyWriter is an ArchiveWriter that records each entry written to it, along with a digest of
+// its content, so that the output can be checked once it's complete.
+type verifyWriter struct {
+	ArchiveWriter
+	entries []verifiedEntry
+	h       hash.Hash
+}
+
+// outputVerifier is the verifyWriter for the archive, if --verify is set.
+var outputVerifier *verifyWriter
+
+// checkVerify checks that --verify can read back the output.
+func checkVerify() {
+	if !verifyOutput {
+		return
+	}
+	switch {
+	case !isFileOutput():
+		usageErrorf("--verify: requires -f FILE")
+	case outputFormat != "tar":
+		usageErrorf("--verify: -F %s is not supported", outputFormat)
+	case statePath != "" || goEmbedName != "" || imageMode || shardCount > 0 ||
+		len(ageRecipients) > 0 || len(gpgRecipients) > 0 || encryptPass:
+		usageErrorf("--verify: may not be used with --state, --go-embed, image output, shard, or encryption")
+	case !useOutputTemp():
+		usageErrorf("--verify: output %s is not a regular file", outputPath)
+	}
+}
+
+// newVerifyWriter returns w, recording its entries for --verify if it's set.
+func newVerifyWriter(w ArchiveWriter) ArchiveWriter {
+	if !verifyOutput {
+		return w
+	}
+	outputVerifier = &verifyWriter{ArchiveWriter: w, h: newDigest()}
+	return outputVerifier
+}
+
+func (v *verifyWriter) WriteHeader(hdr *tar.Header) error {
+	v.finishEntry()
+	v.entries = append(v.entries, verifiedEntry{name: hdr.Name, typeflag: hdr.Typeflag, size: hdr.Size})
+	return v.ArchiveWriter.WriteHeader(hdr)
+}
+
+func (v *verifyWriter) Write(p []byte) (int, error) {
+	n, err := v.ArchiveWriter.Write(p)
+	v.h.Write(p[:n])
+	return n, err
+}
+
+func (v *verifyWriter) Flush() error {
+	return flushArchive(v.ArchiveWriter)
+}
+
+func (v *verifyWriter) Close() error {
+	v.finishEntry()
+	return v.ArchiveWriter.Close()
+}
+
+// finishEntry records the digest of the current entry's content.
+func (v *verifyWriter) finishEntry() {
+	if len(v.entries) > 0 && v.entries[len(v.entries)-1].sum == nil {
+		v.entries[len(v.entries)-1].sum = v.h.Sum(nil)
+	}
+	v.h.Reset()
+}
+
+// verifyFile reads back the archive at path, the temporary output, and checks that its headers and
+// content match what was written. Each difference is logged as an error, and mtar exits with
+// exitFatal if the output is corrupt, leaving the output path untouched.
+func verifyFile(path string) {
+	if outputVerifier == nil {
+		return
+	}
+	f, err := os.Open(path)
+	failOnError("--verify: cannot open output", err)
+	defer f.Close()
+
+	problems := 0
+	problemf := func(name, format string, args ...interface{}) {
+		problems++
+		logEvent(levelError, name, "--verify: "+fmt.Sprintf(format, args...), nil)
+	}
+	if err := verifyArchive(f, outputVerifier.entries, problemf); err != nil {
+		problemf("", "cannot read archive: %v", err)
+	}
+	if problems > 0 {
+		fatalf("--verify: %s is corrupt (%d problems)", outputPath, problems)
+	}
+	debugf("verified %d entries in %s", len(outputVerifier.entries), outputPath)
+}
+
+// verifyArchive reads the archive in r and compares it to the written entries, passing each
+// difference to problemf. It returns an error if the archive can't be read.
+func verifyArchive(r io.Reader, entries []verifiedEntry, problemf func(name, format string, args ...interface{})) error {
+	br := bufio.NewReader(r)
+	var zr io.Reader
+	var err error
+	switch {
+	case compression == "brotli":
+		zr = brotli.NewReader(br)
+	case compression == "zstd" && zstdDict != nil:
+		zr, err = zstd.NewReader(br, zstd.WithDecoderDicts(zstdDict))
+	default:
+		zr, err = decompressedReader(br)
+	}
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(zr)
+	h := newDigest()
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			if i < len(entries) {
+				problemf(entries[i].name, "entry missing: the archive ends after %d of %d entries", i, len(entries))
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		if i >= len(entries) {
+			problemf(hdr.Name, "unexpected entry %d: only %d entries were written", i+1, len(entries))
+			return nil
+		}
+
+		want := entries[i]
+		if hdr.Name != want.name {
+			problemf(want.name, "entry %d: name is %q", i+1, hdr.Name)
+		}
+		if normalTypeflag(hdr.Typeflag) != normalTypeflag(want.typeflag) {
+			problemf(want.name, "type is %q, not %q", hdr.Typeflag, want.typeflag)
+		}
+		if hdr.Size != want.size {
+			problemf(want.name, "size is %d, not %d", hdr.Size, want.size)
+		}
+		h.Reset()
+		if _, err := io.Copy(h, tr); err != nil {
+			return fmt.Errorf("%s: %w", want.name, err)
+		}
+		if sum := h.Sum(nil); !bytes.Equal(sum, want.sum) {
+			problemf(want.name, "content digest is %s:%x, not %s:%x", digestAlgo, sum, digestAlgo, want.sum)
+		}
+	}
+}
+
+// normalTypeflag returns typeflag with TypeRegA, which readers treat as TypeReg, replaced.
+func normalTypeflag(typeflag byte) byte {
+	if typeflag == tar.TypeRegA {
+		return tar.TypeReg
+	}
+	return typeflag
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Noel Cower
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// walkOrder controls the order that directories and their contents are added in.
+type walkOrder int
+
+const (
+	orderDirsFirst  walkOrder = iota // Add each directory before its contents
+	orderFilesFirst                  // Add each directory, then its files, then its subdirectories
+	orderDepthFirst                  // Add each directory after its contents
+)
+
+var order = orderDirsFirst
+
+// walkTree walks the tree rooted at root, calling fn for each path in it in lexical order,
+// subject to the walk order. As with filepath.Walk, fn is called with a non-nil err for
+// directories that can't be read (after which their contents are skipped) and for paths that
+// can't be stat'd (with a nil info). Symlinks are not followed.
+func walkTree(root string, fn func(p string, info os.FileInfo, err error)) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		fn(root, nil, err)
+		return
+	}
+	walkPath(root, info, fn)
+}
+
+func walkPath(p string, info os.FileInfo, fn func(p string, info os.FileInfo, err error)) {
+	if !info.IsDir() {
+		fn(p, info, nil)
+		return
+	}
+
+	names, err := readDirNames(p)
+	if err != nil {
+		fn(p, info, err)
+		return
+	}
+	if order != orderDepthFirst {
+		fn(p, info, nil)
+	}
+	// The directory is only entered once fn has been called for it, so that it isn't taken to be
+	// a loop itself.
+	leave := enterWalkedDir(p, info)
+
+	type child struct {
+		path string
+		info os.FileInfo
+		dir  bool
+	}
+	children := make([]child, 0, len(names))
+	for _, name := range names {
+		cp := filepath.Join(p, name)
+		ci, err := os.Lstat(cp)
+		if err != nil {
+			fn(cp, nil, err)
+			continue
+		}
+		children = append(children, child{cp, ci, order == orderFilesFirst && isWalkDir(cp, ci)})
+	}
+
+	if order == orderFilesFirst {
+		sort.SliceStable(children, func(i, j int) bool {
+			return !children[i].dir && children[j].dir
+		})
+	}
+	for _, c := range children {
+		walkPath(c.path, c.info, fn)
+	}
+	leave()
+
+	if order == orderDepthFirst {
+		fn(p, info, nil)
+	}
+}
+
+// isWalkDir returns whether p is a directory for the purpose of ordering, which includes symlinks
+// to directories if links are followed.
+func isWalkDir(p string, info os.FileInfo) bool {
+	if followLinks && info.Mode()&os.ModeSymlink != 0 {
+		if st, err := os.Stat(p); err == nil {
+			return st.IsDir()
+		}
+	}
+	return info.IsDir()
+}
+
+// readDirNames returns the sorted names of the entries in the directory p.
+func readDirNames(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}